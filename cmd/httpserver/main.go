@@ -1,19 +1,23 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/metrics"
+	"httpfromtcp/internal/middleware"
+	"httpfromtcp/internal/proxy"
+	"httpfromtcp/internal/ratelimit"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
 	"httpfromtcp/internal/server"
+	"httpfromtcp/internal/sse"
+	"httpfromtcp/internal/websocket"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 )
 
 func respond400() []byte {
@@ -52,89 +56,126 @@ func respond200() []byte {
 			</html>`)
 }
 
+func handleYourProblem(w *response.Writer, req *request.Request) {
+	w.WriteStatusLine(response.StatusBadRequest)
+	headers := headers.NewHeaders()
+	headers.Set("Content-Type", "text/html")
+	w.WriteHeaders(headers)
+	w.WriteBody(respond400())
+}
+
+func handleMyProblem(w *response.Writer, req *request.Request) {
+	w.WriteStatusLine(response.StatusInternalServerError)
+	headers := headers.NewHeaders()
+	headers.Set("Content-Type", "text/html")
+	w.WriteHeaders(headers)
+	w.WriteBody(respond500())
+}
+
+func handleVideo(w *response.Writer, req *request.Request) {
+	videoData, err := os.ReadFile("assets/vim.mp4")
+	if err != nil {
+		w.WriteStatusLine(response.StatusInternalServerError)
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "text/html")
+		w.WriteHeaders(h)
+		w.WriteBody(respond500())
+	} else {
+		w.WriteStatusLine(response.StatusOK)
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "video/mp4")
+		w.WriteHeaders(h)
+		w.WriteBody(videoData)
+	}
+}
+
+func handleRoot(w *response.Writer, req *request.Request) {
+	w.SetDefaultHeader("vary", "Accept")
+	contentType, herr := server.Negotiate(req, "text/html", "application/json")
+	if herr != nil {
+		herr.Respond(w)
+		return
+	}
+	w.WriteStatusLine(response.StatusOK)
+	headers := headers.NewHeaders()
+	headers.Set("Content-Type", contentType)
+	w.WriteHeaders(headers)
+	if contentType == "application/json" {
+		w.WriteBody([]byte(`{"status":"ok","message":"Your request was an absolute banger."}`))
+		return
+	}
+	w.WriteBody(respond200())
+}
+
+func handleUpload(w *response.Writer, req *request.Request) {
+	err := req.ParseMultipartForm(request.MultipartOptions{})
+	if err != nil {
+		server.NewHandlerError(response.StatusBadRequest, err.Error()).Respond(w)
+		return
+	}
+
+	var b strings.Builder
+	for _, p := range req.MultipartForm.Values {
+		fmt.Fprintf(&b, "field %s = %q\n", p.Key, p.Value)
+	}
+	for _, f := range req.MultipartForm.Files {
+		fmt.Fprintf(&b, "file %s: %s, %d bytes\n", f.FormName, f.Filename, f.Size)
+	}
+	w.WriteStatusLine(response.StatusOK)
+	h := response.GetDefaultHeaders(0)
+	h.Set("Content-Type", "text/plain")
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(b.String()))
+}
+
+func handleEcho(w *response.Writer, req *request.Request) {
+	conn, err := websocket.Upgrade(w, req, &websocket.Options{EnableCompression: true})
+	if err != nil {
+		return
+	}
+	for {
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if conn.WriteMessage(msgType, data) != nil {
+			return
+		}
+	}
+}
+
 func main() {
 	const port = 42069
 
-	handler := func(w *response.Writer, req *request.Request) {
-		if req.RequestLine.RequestTarget == "/yourproblem" {
-			w.WriteStatusLine(response.StatusBadRequest)
-			headers := headers.NewHeaders()
-			headers.Set("Content-Type", "text/html")
-			w.WriteHeaders(headers)
-			w.WriteBody(respond400())
-
-		} else if req.RequestLine.RequestTarget == "/myproblem" {
-			w.WriteStatusLine(response.StatusInternalServerError)
-			headers := headers.NewHeaders()
-			headers.Set("Content-Type", "text/html")
-			w.WriteHeaders(headers)
-			w.WriteBody(respond500())
-		} else if req.RequestLine.RequestTarget == "/video" {
-			videoData, err := os.ReadFile("assets/vim.mp4")
-			if err != nil {
-				w.WriteStatusLine(response.StatusInternalServerError)
-				h := headers.NewHeaders()
-				h.Set("Content-Type", "text/html")
-				w.WriteHeaders(h)
-				w.WriteBody(respond500())
-			} else {
-				w.WriteStatusLine(response.StatusOK)
-				h := headers.NewHeaders()
-				h.Set("Content-Type", "video/mp4")
-				w.WriteHeaders(h)
-				w.WriteBody(videoData)
-			}
-
-		} else if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/html") {
-			res, err := http.Get("https://httpbin.org/html")
-			if err != nil {
-				w.WriteStatusLine(response.StatusInternalServerError)
-				h := headers.NewHeaders()
-				h.Set("Content-Type", "text/html")
-				w.WriteHeaders(h)
-				w.WriteBody(respond500())
-			} else {
-				defer res.Body.Close()
-				w.WriteStatusLine(response.StatusOK)
-				h := headers.NewHeaders()
-				w.DeleteHeader("content-length")
-				h.Set("transfer-encoding", "chunked")
-				h.Set("trailer", "X-Content-SHA256, X-Content-Length")
-				h.Set("content-type", res.Header.Get("Content-Type"))
-				w.WriteHeaders(h)
-
-				var fullBody []byte
-				for {
-					data := make([]byte, 32)
-					n, err := res.Body.Read(data)
-					if n > 0 {
-						fullBody = append(fullBody, data[:n]...)
-						w.WriteChunkedBody(data[:n])
-					}
-					if err != nil {
-						break
-					}
-				}
-				w.WriteChunkedBodyDone()
-
-				hash := sha256.Sum256(fullBody)
-				trailers := headers.NewHeaders()
-				trailers.Set("X-Content-SHA256", hex.EncodeToString(hash[:]))
-				trailers.Set("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
-				w.WriteTrailers(trailers)
-			}
-
-		} else {
-			w.WriteStatusLine(response.StatusOK)
-			headers := headers.NewHeaders()
-			headers.Set("Content-Type", "text/html")
-			w.WriteHeaders(headers)
-			w.WriteBody(respond200())
+	router := server.NewRouter()
+	router.Handle("GET", "/yourproblem", handleYourProblem)
+	router.Handle("GET", "/myproblem", handleMyProblem)
+	router.Handle("GET", "/video", handleVideo)
+	httpbin := &proxy.ReverseProxy{Upstream: "https://httpbin.org", StripPrefix: "/httpbin", Digest: true}
+	httpbinLimit := ratelimit.New(ratelimit.Options{Limit: 30, Window: time.Minute}) // be nice to httpbin.org
+	for _, method := range []string{"GET", "POST", "PUT", "PATCH", "DELETE"} {
+		router.Handle(method, "/httpbin/", httpbinLimit.Middleware(httpbin.Serve))
+	}
+	router.Handle("POST", "/upload", handleUpload)
+	router.Handle("GET", "/ws", handleEcho)
+	router.Handle("GET", "/", handleRoot)
 
+	broker := sse.NewBroker(32, 15*time.Second)
+	defer broker.Close()
+	router.Handle("GET", "/events", broker.Serve)
+	go func() {
+		for now := range time.Tick(time.Second) {
+			broker.Publish(sse.Event{Event: "tick", Data: now.Format(time.RFC3339)})
 		}
-	}
+	}()
+
+	registry := metrics.NewRegistry()
+	serverMetrics := metrics.NewServerMetrics(registry)
+	router.Handle("GET", "/metrics", registry.Serve)
 
-	srv, err := server.Serve(port, handler)
+	accessLog := middleware.AccessLog(middleware.AccessLogOptions{Format: middleware.CombinedLog, Skip: []string{"/metrics"}})
+	handler := server.Chain(router.Serve, accessLog, middleware.RequestID, serverMetrics.Middleware(router.Route))
+	srv, err := server.Serve(port, handler, server.WithObserver(serverMetrics))
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
@@ -143,6 +184,12 @@ func main() {
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-	log.Println("Server gracefully stopped")
+	stopped := make(chan error, 1)
+	go func() { stopped <- srv.Wait() }()
+	select {
+	case <-sigChan:
+		log.Println("Server gracefully stopped")
+	case err := <-stopped:
+		log.Printf("Server stopped: %v", err)
+	}
 }
@@ -0,0 +1,341 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ERROR_UPSTREAM_ABORTED = errors.New("Upstream handler gave up halfway through the response")
+
+// What ends up in the X-Cache header.
+const (
+	hit         = "HIT"
+	miss        = "MISS"
+	stale       = "STALE" // served stale while a revalidation runs in the background
+	revalidated = "REVALIDATED"
+)
+
+// Fields that describe one particular message on one particular connection,
+// they're never stored.
+var unstored = []string{"connection", "keep-alive", "transfer-encoding", "content-length", "trailer", "te", "upgrade"}
+
+const DefaultMaxEntryBytes = 8 << 20
+
+type Options struct {
+	Store         Store // nil means a MemoryStore of DefaultMaxBytes
+	MaxEntryBytes int64 // bigger bodies aren't stored but streamed through, 0 means DefaultMaxEntryBytes
+}
+
+type flight struct {
+	done   chan struct{}
+	entry  *Entry
+	stored bool
+}
+
+// Cache is a shared HTTP cache (RFC 9111) in front of another handler, usually
+// a proxy. Only GET responses get stored, HEAD is answered from them.
+type Cache struct {
+	next     server.Handler
+	store    Store
+	maxEntry int64
+	now      func() time.Time
+
+	mu       sync.Mutex
+	inflight map[string]*flight // misses being fetched, so concurrent ones wait instead
+}
+
+func New(next server.Handler, opts Options) *Cache {
+	store := opts.Store
+	if store == nil {
+		store = NewMemoryStore(DefaultMaxBytes)
+	}
+	maxEntry := opts.MaxEntryBytes
+	if maxEntry <= 0 {
+		maxEntry = DefaultMaxEntryBytes
+	}
+	return &Cache{
+		next:     next,
+		store:    store,
+		maxEntry: maxEntry,
+		now:      time.Now,
+		inflight: make(map[string]*flight),
+	}
+}
+
+// key is the primary cache key. Only GETs are stored, so the method isn't part
+// of it.
+func key(req *request.Request) string {
+	return req.Headers.Get("host") + req.RequestLine.RequestTarget
+}
+
+func cloneRequest(req *request.Request) *request.Request {
+	c := *req
+	c.Headers = headers.NewHeaders()
+	for k, v := range req.Headers {
+		c.Headers.Set(k, v)
+	}
+	return &c
+}
+
+func (c *Cache) lookup(k string, req *request.Request) *Entry {
+	for _, e := range c.store.Get(k) {
+		if e.matches(req) {
+			return e
+		}
+	}
+	return nil
+}
+
+func (c *Cache) Serve(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+	k := key(req)
+	if method != "GET" && method != "HEAD" {
+		c.next(w, req)
+		if !client.Idempotent(method) {
+			c.store.Delete(k) // RFC 9111 4.4, whatever we had is probably outdated now
+		}
+		return
+	}
+
+	now := c.now()
+	reqCC := parseCacheControl(req.Headers.Get("cache-control"))
+	e := c.lookup(k, req)
+	if e != nil {
+		cc := e.cacheControl()
+		age, lifetime := e.age(now), e.lifetime()
+		_, noCache := cc["no-cache"]
+		_, mustRevalidate := cc["must-revalidate"]
+		_, reqNoCache := reqCC["no-cache"]
+		reqMaxAge, hasReqMaxAge := seconds(reqCC, "max-age")
+		forced := noCache || reqNoCache || (hasReqMaxAge && age > reqMaxAge)
+
+		if !forced && age < lifetime {
+			c.write(w, e, now, hit)
+			return
+		}
+		swr, ok := seconds(cc, "stale-while-revalidate")
+		if ok && !forced && !mustRevalidate && age < lifetime+swr {
+			c.write(w, e, now, stale)
+			bg := cloneRequest(req)
+			bg = bg.WithContext(context.WithoutCancel(req.Context())) // outlives this request
+			go c.fetch(k, bg, e, nil)
+			return
+		}
+	}
+	if method == "HEAD" {
+		c.next(w, req) // not worth fetching a whole body for
+		return
+	}
+
+	res, label, err := c.fetch(k, req, e, w)
+	if err != nil {
+		server.NewHandlerError(response.StatusBadGateway, err.Error()).Respond(w)
+		return
+	}
+	if res != nil { // nil when it went straight through to w
+		c.write(w, res, c.now(), label)
+	}
+}
+
+// fetch gets a response for req from next, revalidating old when it has a
+// validator. Concurrent fetches for the same key wait for the first one and
+// share its result when it was stored and fits their request. Responses that
+// won't be stored go straight to w, and fetch returns a nil Entry for them.
+func (c *Cache) fetch(k string, req *request.Request, old *Entry, w *response.Writer) (*Entry, string, error) {
+	c.mu.Lock()
+	if f, ok := c.inflight[k]; ok {
+		c.mu.Unlock()
+		<-f.done
+		if f.stored && f.entry.matches(req) {
+			return f.entry, hit, nil
+		}
+		return c.fetchAlone(k, req, old, w)
+	}
+	f := &flight{done: make(chan struct{})}
+	c.inflight[k] = f
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.inflight, k)
+		c.mu.Unlock()
+		close(f.done)
+	}()
+	e, label, err := c.fetchAlone(k, req, old, w)
+	if err == nil && e != nil {
+		f.entry, f.stored = e, label != miss || storable(req, e)
+	}
+	return e, label, err
+}
+
+func (c *Cache) fetchAlone(k string, req *request.Request, old *Entry, w *response.Writer) (*Entry, string, error) {
+	up := req
+	if old != nil && old.hasValidator() {
+		up = cloneRequest(req)
+		if etag := old.Headers.Get("etag"); etag != "" {
+			up.Headers.Set("if-none-match", etag)
+		}
+		if lm := old.Headers.Get("last-modified"); lm != "" {
+			up.Headers.Set("if-modified-since", lm)
+		}
+	}
+
+	keep := func(e *Entry) bool {
+		return storable(req, e) || (up != req && e.Status == response.StatusNotModified)
+	}
+	e, err := c.forward(up, w, keep)
+	if err != nil || e == nil {
+		return nil, "", err
+	}
+	if old != nil && up != req && e.Status == response.StatusNotModified {
+		// RFC 9111 4.3.4: the stored response is still good, with the new fields
+		updated := *old
+		updated.Headers = headers.NewHeaders()
+		for k, v := range old.Headers {
+			updated.Headers.Set(k, v)
+		}
+		for k, v := range e.Headers {
+			updated.Headers.Set(k, v)
+		}
+		updated.RequestTime, updated.ResponseTime = e.RequestTime, e.ResponseTime
+		c.put(k, req, &updated)
+		return &updated, revalidated, nil
+	}
+
+	if storable(req, e) {
+		c.put(k, req, e)
+	}
+	return e, miss, nil
+}
+
+// forward runs next and reads its response back. Only responses keep wants
+// (judging from the head) are buffered, up to maxEntry: the rest go to w as
+// they come, so big downloads and event streams aren't held up, and forward
+// returns a nil Entry. Without a w they're read and dropped.
+func (c *Cache) forward(req *request.Request, w *response.Writer, keep func(e *Entry) bool) (*Entry, error) {
+	pr, pw := io.Pipe()
+	defer pr.Close() // a handler still writing gets an error instead of blocking
+	uw := response.NewStreamingWriter(pw)
+	uw.SetServerName("") // the server in front adds its own
+	start := c.now()
+	go func() {
+		c.next(uw, req)
+		err := uw.Finish()
+		if uw.Aborted() {
+			err = ERROR_UPSTREAM_ABORTED
+		}
+		pw.CloseWithError(err) // nil is a plain EOF
+	}()
+
+	res, err := client.StreamFromReader(pr, req.RequestLine.Method)
+	if err != nil {
+		return nil, err
+	}
+	e := &Entry{
+		Status:      res.StatusLine.StatusCode,
+		Headers:     res.Headers,
+		RequestTime: start,
+	}
+	for _, name := range unstored {
+		e.Headers.Delete(name)
+	}
+	for _, name := range strings.Split(e.Headers.Get("vary"), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			if e.Vary == nil {
+				e.Vary = make(map[string]string)
+			}
+			e.Vary[name] = req.Headers.Get(name)
+		}
+	}
+
+	var body []byte
+	if n, err := strconv.ParseInt(res.Headers.Get("content-length"), 10, 64); keep(e) && (err != nil || n <= c.maxEntry) {
+		body, err = io.ReadAll(io.LimitReader(res, c.maxEntry+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(body)) <= c.maxEntry {
+			e.Body, e.ResponseTime = body, c.now()
+			return e, nil
+		}
+	}
+	if w == nil {
+		io.Copy(io.Discard, res)
+		return nil, nil
+	}
+	c.passThrough(w, e, body, res)
+	return nil, nil
+}
+
+// passThrough sends a response that isn't going to be stored on to the client,
+// starting with what was read of its body already.
+func (c *Cache) passThrough(w *response.Writer, e *Entry, read []byte, rest io.Reader) {
+	h := headers.NewHeaders()
+	for k, v := range e.Headers {
+		h.Set(k, v)
+	}
+	h.Set("x-cache", miss)
+	w.WriteStatusLine(e.Status)
+	w.WriteHeaders(h)
+	if e.Status < response.StatusOK || e.Status == response.StatusNoContent || e.Status == response.StatusNotModified {
+		return
+	}
+
+	body := w.ChunkedWriter()
+	if len(read) > 0 {
+		body.Write(read)
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		if w.Flush() != nil {
+			w.Abort()
+			return
+		}
+		n, err := rest.Read(buf)
+		if n > 0 {
+			body.Write(buf[:n])
+		}
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil { // the head is out already, all we can do is cut the client off
+			w.Abort()
+			return
+		}
+	}
+}
+
+// put stores e next to the variants it doesn't replace.
+func (c *Cache) put(k string, req *request.Request, e *Entry) {
+	variants := []*Entry{e}
+	for _, v := range c.store.Get(k) {
+		if !v.matches(req) {
+			variants = append(variants, v)
+		}
+	}
+	c.store.Set(k, variants)
+}
+
+func (c *Cache) write(w *response.Writer, e *Entry, now time.Time, label string) {
+	h := headers.NewHeaders()
+	for k, v := range e.Headers {
+		h.Set(k, v)
+	}
+	if label != miss {
+		h.Set("age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	}
+	h.Set("x-cache", label)
+	w.WriteStatusLine(e.Status)
+	w.WriteHeaders(h)
+	w.WriteBody(e.Body)
+}
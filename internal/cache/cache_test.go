@@ -0,0 +1,398 @@
+package cache
+
+import (
+	"encoding/json"
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dated returns default headers with a Date from the test's clock, so ages
+// add up.
+func dated(clock *time.Time) headers.Headers {
+	h := response.GetDefaultHeaders(0)
+	h.Set("date", headers.FormatHTTPDate(*clock))
+	return h
+}
+
+// origin answers with body and extra headers, counting how often it was asked.
+func origin(calls *atomic.Int32, clock *time.Time, body string, extra headers.Headers) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		calls.Add(1)
+		h := dated(clock)
+		for k, v := range extra {
+			h.Set(k, v)
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+}
+
+// newClock is a clock the test moves by hand.
+func newClock() *time.Time {
+	clock := time.Now().Truncate(time.Second)
+	return &clock
+}
+
+func newCache(next server.Handler, clock *time.Time) *Cache {
+	c := New(next, Options{})
+	c.now = func() time.Time { return *clock }
+	return c
+}
+
+func get(t *testing.T, h server.Handler, raw string) *client.Response {
+	srv, err := server.Serve(0, h)
+	require.NoError(t, err)
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Addr().String())
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte(raw))
+	res, err := client.ResponseFromReader(conn, strings.Fields(raw)[0])
+	require.NoError(t, err)
+	return res
+}
+
+const plainGet = "GET /thing HTTP/1.1\r\nHost: x\r\n\r\n"
+
+func TestFreshness(t *testing.T) {
+	var calls atomic.Int32
+	clock := newClock()
+	c := newCache(origin(&calls, clock, "hello", headers.Headers{"cache-control": "max-age=60"}), clock)
+
+	// Test: First request misses, the second one is served from the cache
+	res := get(t, c.Serve, plainGet)
+	assert.Equal(t, "MISS", res.Headers.Get("x-cache"))
+	*clock = clock.Add(10 * time.Second)
+	res = get(t, c.Serve, plainGet)
+	assert.Equal(t, "HIT", res.Headers.Get("x-cache"))
+	assert.Equal(t, "", res.Headers.Get("connection")) // the server's business, not the cache's
+	assert.Equal(t, "10", res.Headers.Get("age"))
+	assert.Equal(t, "hello", string(res.Body))
+	assert.Equal(t, int32(1), calls.Load())
+
+	// Test: HEAD is answered from the stored GET
+	res = get(t, c.Serve, "HEAD /thing HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, "HIT", res.Headers.Get("x-cache"))
+	assert.Equal(t, "5", res.Headers.Get("content-length"))
+	assert.Equal(t, int32(1), calls.Load())
+
+	// Test: The request can ask for something younger
+	res = get(t, c.Serve, "GET /thing HTTP/1.1\r\nHost: x\r\nCache-Control: max-age=5\r\n\r\n")
+	assert.Equal(t, "MISS", res.Headers.Get("x-cache"))
+	assert.Equal(t, int32(2), calls.Load())
+
+	// Test: Once max-age runs out it goes upstream again
+	*clock = clock.Add(61 * time.Second)
+	res = get(t, c.Serve, plainGet)
+	assert.Equal(t, "MISS", res.Headers.Get("x-cache"))
+	assert.Equal(t, int32(3), calls.Load())
+
+	// Test: An unsafe method invalidates the stored response
+	get(t, c.Serve, "POST /thing HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\n\r\n")
+	res = get(t, c.Serve, plainGet)
+	assert.Equal(t, "MISS", res.Headers.Get("x-cache"))
+	assert.Equal(t, int32(5), calls.Load())
+}
+
+func TestNotStored(t *testing.T) {
+	cases := []struct {
+		name  string
+		extra headers.Headers
+		req   string
+	}{
+		{"no-store", headers.Headers{"cache-control": "max-age=60, no-store"}, plainGet},
+		{"private", headers.Headers{"cache-control": "private, max-age=60"}, plainGet},
+		{"vary star", headers.Headers{"cache-control": "max-age=60", "vary": "*"}, plainGet},
+		{"no freshness info", headers.Headers{"cache-control": ""}, plainGet},
+		{"request no-store", headers.Headers{"cache-control": "max-age=60"}, "GET /thing HTTP/1.1\r\nHost: x\r\nCache-Control: no-store\r\n\r\n"},
+		{"authorization", headers.Headers{"cache-control": "max-age=60"}, "GET /thing HTTP/1.1\r\nHost: x\r\nAuthorization: secret\r\n\r\n"},
+		{"set-cookie", headers.Headers{"cache-control": "max-age=60", "set-cookie": "id=1"}, plainGet},
+		{"event stream", headers.Headers{"cache-control": "max-age=60", "content-type": "text/event-stream"}, plainGet},
+	}
+	for _, tc := range cases {
+		var calls atomic.Int32
+		clock := newClock()
+		c := newCache(origin(&calls, clock, "hello", tc.extra), clock)
+		get(t, c.Serve, tc.req)
+		get(t, c.Serve, tc.req)
+		assert.Equal(t, int32(2), calls.Load(), tc.name)
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	var calls atomic.Int32
+	clock := newClock()
+	big := strings.Repeat("x", 100)
+
+	// Test: Bodies over MaxEntryBytes come through whole but aren't stored
+	c := New(origin(&calls, clock, big, headers.Headers{"cache-control": "max-age=60"}), Options{MaxEntryBytes: 10})
+	for range 2 {
+		res := get(t, c.Serve, plainGet)
+		assert.Equal(t, big, string(res.Body))
+		assert.Equal(t, "MISS", res.Headers.Get("x-cache"))
+	}
+	assert.Equal(t, int32(2), calls.Load())
+
+	// Test: Same when the length isn't known up front
+	c = New(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(headers.Headers{"cache-control": "max-age=60"})
+		for range 10 {
+			w.WriteBody([]byte(big[:10]))
+			w.Flush()
+		}
+	}, Options{MaxEntryBytes: 50})
+	assert.Equal(t, big, string(get(t, c.Serve, plainGet).Body))
+
+	// Test: A response that won't be stored is streamed as it's written
+	release := make(chan struct{})
+	c = New(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(headers.Headers{"content-type": "text/event-stream", "cache-control": "no-cache"})
+		w.WriteBody([]byte("data: one\n\n"))
+		w.Flush()
+		<-release
+	}, Options{})
+	defer close(release)
+	srv, err := server.Serve(0, c.Serve)
+	require.NoError(t, err)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte(plainGet))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	res, err := client.StreamFromReader(conn, "GET")
+	require.NoError(t, err)
+	first := make([]byte, len("data: one\n\n"))
+	_, err = io.ReadFull(res, first)
+	require.NoError(t, err)
+	assert.Equal(t, "data: one\n\n", string(first))
+}
+
+func TestVary(t *testing.T) {
+	var calls atomic.Int32
+	clock := newClock()
+	c := newCache(func(w *response.Writer, req *request.Request) {
+		calls.Add(1)
+		h := dated(clock)
+		h.Set("cache-control", "max-age=60")
+		h.Set("vary", "Accept-Language")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(req.Headers.Get("accept-language")))
+	}, clock)
+	en := "GET / HTTP/1.1\r\nHost: x\r\nAccept-Language: en\r\n\r\n"
+	fr := "GET / HTTP/1.1\r\nHost: x\r\nAccept-Language: fr\r\n\r\n"
+
+	// Test: Each language gets its own variant
+	assert.Equal(t, "en", string(get(t, c.Serve, en).Body))
+	assert.Equal(t, "fr", string(get(t, c.Serve, fr).Body))
+	res := get(t, c.Serve, en)
+	assert.Equal(t, "HIT", res.Headers.Get("x-cache"))
+	assert.Equal(t, "en", string(res.Body))
+	res = get(t, c.Serve, fr)
+	assert.Equal(t, "HIT", res.Headers.Get("x-cache"))
+	assert.Equal(t, "fr", string(res.Body))
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestRevalidation(t *testing.T) {
+	var calls, notModified atomic.Int32
+	clock := newClock()
+	c := newCache(func(w *response.Writer, req *request.Request) {
+		calls.Add(1)
+		h := dated(clock)
+		h.Set("cache-control", "max-age=10")
+		h.Set("etag", `"v1"`)
+		if req.Headers.Get("if-none-match") == `"v1"` {
+			notModified.Add(1)
+			h.Set("x-checked", "yes")
+			w.WriteStatusLine(response.StatusNotModified)
+			w.WriteHeaders(h)
+			return
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("body"))
+	}, clock)
+	get(t, c.Serve, plainGet)
+
+	// Test: A stale entry with an ETag is revalidated, the 304 refreshes it
+	*clock = clock.Add(20 * time.Second)
+	res := get(t, c.Serve, plainGet)
+	assert.Equal(t, "REVALIDATED", res.Headers.Get("x-cache"))
+	assert.Equal(t, "body", string(res.Body))
+	assert.Equal(t, "yes", res.Headers.Get("x-checked"))
+	assert.Equal(t, int32(1), notModified.Load())
+
+	// Test: And it's fresh again afterwards
+	res = get(t, c.Serve, plainGet)
+	assert.Equal(t, "HIT", res.Headers.Get("x-cache"))
+	assert.Equal(t, int32(2), calls.Load())
+
+	// Test: no-cache from the client forces a check even while fresh
+	res = get(t, c.Serve, "GET /thing HTTP/1.1\r\nHost: x\r\nCache-Control: no-cache\r\n\r\n")
+	assert.Equal(t, "REVALIDATED", res.Headers.Get("x-cache"))
+	assert.Equal(t, int32(2), notModified.Load())
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var calls atomic.Int32
+	clock := newClock()
+	c := newCache(func(w *response.Writer, req *request.Request) {
+		n := calls.Add(1)
+		h := dated(clock)
+		h.Set("cache-control", "max-age=10, stale-while-revalidate=30")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte{'0' + byte(n)})
+	}, clock)
+	get(t, c.Serve, plainGet)
+
+	// Test: Within the window the stale copy goes out and a refresh happens behind it
+	*clock = clock.Add(20 * time.Second)
+	res := get(t, c.Serve, plainGet)
+	assert.Equal(t, "STALE", res.Headers.Get("x-cache"))
+	assert.Equal(t, "1", string(res.Body))
+	require.Eventually(t, func() bool {
+		res := get(t, c.Serve, plainGet)
+		return res.Headers.Get("x-cache") == "HIT" && string(res.Body) == "2"
+	}, time.Second, 10*time.Millisecond)
+
+	// Test: Past the window it's a plain miss
+	*clock = clock.Add(time.Minute)
+	res = get(t, c.Serve, plainGet)
+	assert.Equal(t, "MISS", res.Headers.Get("x-cache"))
+	assert.Equal(t, "3", string(res.Body))
+}
+
+func TestRequestCollapsing(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	clock := newClock()
+	slow := origin(&calls, clock, "slow", headers.Headers{"cache-control": "max-age=60"})
+	c := newCache(func(w *response.Writer, req *request.Request) {
+		<-release
+		slow(w, req)
+	}, clock)
+
+	// Test: Concurrent misses for one key make a single upstream request
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bodies[i] = string(get(t, c.Serve, plainGet).Body)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.inflight) == 1
+	}, time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond) // let the others pile up behind it
+	close(release)
+	wg.Wait()
+	assert.Equal(t, []string{"slow", "slow", "slow", "slow", "slow"}, bodies)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestStores(t *testing.T) {
+	e := &Entry{
+		Status:       response.StatusOK,
+		Headers:      headers.Headers{"etag": `"a"`},
+		Body:         []byte("0123456789"),
+		RequestTime:  time.Unix(100, 0),
+		ResponseTime: time.Unix(101, 0),
+		Vary:         map[string]string{"accept": "text/html"},
+	}
+
+	// Test: DiskStore gives back what it was given
+	disk, err := NewDiskStore(t.TempDir(), 0)
+	require.NoError(t, err)
+	disk.Set("x/a", []*Entry{e})
+	got := disk.Get("x/a")
+	require.Len(t, got, 1)
+	assert.Equal(t, e.Body, got[0].Body)
+	assert.Equal(t, e.Vary, got[0].Vary)
+	assert.True(t, e.ResponseTime.Equal(got[0].ResponseTime))
+	disk.Delete("x/a")
+	assert.Nil(t, disk.Get("x/a"))
+
+	// Test: DiskStore evicts the least recently used key when full, a new
+	// store on the same directory picks up where it left off
+	dir := t.TempDir()
+	one, _ := json.Marshal([]*Entry{e})
+	disk, err = NewDiskStore(dir, int64(2*len(one)+10))
+	require.NoError(t, err)
+	past := time.Now().Add(-time.Hour)
+	disk.Set("a", []*Entry{e})
+	os.Chtimes(disk.path("a"), past, past)
+	disk.Set("b", []*Entry{e})
+	os.Chtimes(disk.path("b"), past.Add(time.Second), past.Add(time.Second))
+	disk.Get("a")
+	disk.Set("c", []*Entry{e})
+	assert.NotNil(t, disk.Get("a"))
+	assert.Nil(t, disk.Get("b"))
+	assert.NotNil(t, disk.Get("c"))
+	disk, err = NewDiskStore(dir, int64(len(one)))
+	require.NoError(t, err)
+	files, _ := os.ReadDir(dir)
+	assert.Len(t, files, 1)
+
+	// Test: MemoryStore evicts the least recently used key when full
+	mem := NewMemoryStore(40)
+	mem.Set("a", []*Entry{e})
+	mem.Set("b", []*Entry{e})
+	mem.Get("a")
+	mem.Set("c", []*Entry{e})
+	assert.NotNil(t, mem.Get("a"))
+	assert.Nil(t, mem.Get("b"))
+	assert.NotNil(t, mem.Get("c"))
+}
+
+func TestLifetime(t *testing.T) {
+	date := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	entry := func(h headers.Headers) *Entry {
+		h.Set("date", headers.FormatHTTPDate(date))
+		return &Entry{Status: response.StatusOK, Headers: h, RequestTime: date, ResponseTime: date}
+	}
+
+	// Test: s-maxage wins over max-age for a shared cache
+	assert.Equal(t, 30*time.Second, entry(headers.Headers{"cache-control": "max-age=10, s-maxage=30"}).lifetime())
+
+	// Test: Expires counts from Date
+	e := entry(headers.Headers{"expires": headers.FormatHTTPDate(date.Add(time.Hour))})
+	assert.Equal(t, time.Hour, e.lifetime())
+
+	// Test: An Expires that doesn't parse means already stale
+	assert.Equal(t, time.Duration(0), entry(headers.Headers{"expires": "0"}).lifetime())
+
+	// Test: Heuristic is 10% of the time since Last-Modified, capped at a day
+	e = entry(headers.Headers{"last-modified": headers.FormatHTTPDate(date.Add(-10 * time.Hour))})
+	assert.Equal(t, time.Hour, e.lifetime())
+	e = entry(headers.Headers{"last-modified": headers.FormatHTTPDate(date.AddDate(-1, 0, 0))})
+	assert.Equal(t, 24*time.Hour, e.lifetime())
+
+	// Test: Age adds what the upstream reported to the time spent here
+	e = entry(headers.Headers{"age": "100"})
+	assert.Equal(t, 105*time.Second, e.age(date.Add(5*time.Second)))
+}
@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Heuristic freshness is capped so a file last touched years ago doesn't get
+// cached for a year.
+const maxHeuristicLifetime = 24 * time.Hour
+
+// RFC 9111 4.2.2: statuses that can be cached without being told how long.
+var heuristicallyCacheable = map[response.StatusCode]bool{
+	response.StatusOK:                   true,
+	response.StatusNonAuthoritativeInfo: true,
+	response.StatusNoContent:            true,
+	response.StatusMultipleChoices:      true,
+	response.StatusMovedPermanently:     true,
+	response.StatusPermanentRedirect:    true,
+	response.StatusNotFound:             true,
+	response.StatusMethodNotAllowed:     true,
+	response.StatusGone:                 true,
+	response.StatusURITooLong:           true,
+	response.StatusNotImplemented:       true,
+}
+
+// parseCacheControl turns a Cache-Control value into directive -> argument,
+// names lowercased and quotes stripped.
+func parseCacheControl(value string) map[string]string {
+	cc := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name == "" {
+			continue
+		}
+		cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+	}
+	return cc
+}
+
+// seconds reads a delta-seconds argument, ok is false when the directive is
+// missing or broken.
+func seconds(cc map[string]string, name string) (time.Duration, bool) {
+	arg, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// Entry is a stored response along with what's needed to work out its age.
+type Entry struct {
+	Status       response.StatusCode
+	Headers      headers.Headers
+	Body         []byte
+	RequestTime  time.Time
+	ResponseTime time.Time
+	Vary         map[string]string // the request fields Vary names, with the values they had
+}
+
+func (e *Entry) cacheControl() map[string]string {
+	return parseCacheControl(e.Headers.Get("cache-control"))
+}
+
+func (e *Entry) date() time.Time {
+	if t, err := headers.ParseHTTPDate(e.Headers.Get("date")); err == nil {
+		return t
+	}
+	return e.ResponseTime
+}
+
+// lifetime is how long the response stays fresh after it was generated, RFC
+// 9111 4.2.1 from a shared cache's point of view.
+func (e *Entry) lifetime() time.Duration {
+	cc := e.cacheControl()
+	if d, ok := seconds(cc, "s-maxage"); ok {
+		return d
+	}
+	if d, ok := seconds(cc, "max-age"); ok {
+		return d
+	}
+	if exp := e.Headers.Get("expires"); exp != "" {
+		t, err := headers.ParseHTTPDate(exp)
+		if err != nil {
+			return 0 // an invalid Expires means already expired
+		}
+		return t.Sub(e.date())
+	}
+	if lm, err := headers.ParseHTTPDate(e.Headers.Get("last-modified")); err == nil && heuristicallyCacheable[e.Status] {
+		return min(e.date().Sub(lm)/10, maxHeuristicLifetime)
+	}
+	return 0
+}
+
+// age follows RFC 9111 4.2.3.
+func (e *Entry) age(now time.Time) time.Duration {
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(e.Headers.Get("age"), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	apparent := max(0, e.ResponseTime.Sub(e.date()))
+	corrected := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	return max(apparent, corrected) + now.Sub(e.ResponseTime)
+}
+
+func (e *Entry) matches(req *request.Request) bool {
+	for name, value := range e.Vary {
+		if req.Headers.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Entry) hasValidator() bool {
+	return e.Headers.Get("etag") != "" || e.Headers.Get("last-modified") != ""
+}
+
+// storable decides whether a shared cache may keep e at all, RFC 9111 3.
+func storable(req *request.Request, e *Entry) bool {
+	if req.RequestLine.Method != "GET" || e.Status < response.StatusOK || e.Status == response.StatusNotModified || e.Status == response.StatusPartialContent {
+		return false
+	}
+	reqCC := parseCacheControl(req.Headers.Get("cache-control"))
+	cc := e.cacheControl()
+	if _, ok := reqCC["no-store"]; ok {
+		return false
+	}
+	for _, d := range []string{"no-store", "private"} {
+		if _, ok := cc[d]; ok {
+			return false
+		}
+	}
+	if strings.TrimSpace(e.Headers.Get("vary")) == "*" {
+		return false
+	}
+	if e.Headers.Get("set-cookie") != "" {
+		return false // someone's cookie, not something to hand the next client
+	}
+	if mediaType, _, _ := strings.Cut(e.Headers.Get("content-type"), ";"); strings.TrimSpace(mediaType) == "text/event-stream" {
+		return false // never done, and a stream of events isn't a representation to reuse
+	}
+
+	_, public := cc["public"]
+	_, sMaxAge := cc["s-maxage"]
+	_, mustRevalidate := cc["must-revalidate"]
+	if req.Headers.Get("authorization") != "" && !public && !sMaxAge && !mustRevalidate {
+		return false // RFC 9111 3.5
+	}
+
+	_, maxAge := cc["max-age"]
+	explicit := public || sMaxAge || maxAge || e.Headers.Get("expires") != ""
+	return explicit || heuristicallyCacheable[e.Status]
+}
@@ -0,0 +1,237 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const DefaultMaxBytes = 64 << 20
+
+// Store keeps every variant of a response under its primary key, the Host
+// header plus the request target (only GETs are stored, so no method).
+// Implementations have to be safe for concurrent use.
+type Store interface {
+	Get(key string) []*Entry
+	Set(key string, variants []*Entry)
+	Delete(key string)
+}
+
+func size(variants []*Entry) int64 {
+	var n int64
+	for _, e := range variants {
+		n += int64(len(e.Body))
+		for k, v := range e.Headers {
+			n += int64(len(k) + len(v))
+		}
+	}
+	return n
+}
+
+type memoryItem struct {
+	key      string
+	variants []*Entry
+	size     int64
+}
+
+// MemoryStore drops the least recently used keys once it holds more than
+// maxBytes of bodies and headers.
+type MemoryStore struct {
+	mu       sync.Mutex
+	maxBytes int64
+	used     int64
+	lru      *list.List // front is the most recently used
+	items    map[string]*list.Element
+}
+
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	return &MemoryStore{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (m *MemoryStore) Get(key string) []*Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.items[key]
+	if !ok {
+		return nil
+	}
+	m.lru.MoveToFront(el)
+	return el.Value.(*memoryItem).variants
+}
+
+func (m *MemoryStore) Set(key string, variants []*Entry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(key)
+
+	item := &memoryItem{key: key, variants: variants, size: size(variants)}
+	if item.size > m.maxBytes {
+		return // would push everything else out and still not fit
+	}
+	m.items[key] = m.lru.PushFront(item)
+	m.used += item.size
+	for m.used > m.maxBytes {
+		m.remove(m.lru.Back().Value.(*memoryItem).key)
+	}
+}
+
+func (m *MemoryStore) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(key)
+}
+
+func (m *MemoryStore) remove(key string) {
+	el, ok := m.items[key]
+	if !ok {
+		return
+	}
+	m.used -= el.Value.(*memoryItem).size
+	m.lru.Remove(el)
+	delete(m.items, key)
+}
+
+// DiskStore keeps one JSON file per key in a directory, so the cache survives
+// restarts. Once the files add up to more than maxBytes the least recently
+// used ones go, a file's modification time is when it was last used.
+type DiskStore struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	used     int64
+}
+
+// NewDiskStore takes 0 for maxBytes to mean DefaultMaxBytes. Entries already
+// in dir count towards it.
+func NewDiskStore(dir string, maxBytes int64) (*DiskStore, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	d := &DiskStore{dir: dir, maxBytes: maxBytes}
+	for _, f := range d.files() {
+		d.used += f.Size()
+	}
+	d.evict("")
+	return d, nil
+}
+
+func (d *DiskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// files lists the entries, leaving out temp files.
+func (d *DiskStore) files() []os.FileInfo {
+	entries, _ := os.ReadDir(d.dir)
+	var files []os.FileInfo
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			files = append(files, info)
+		}
+	}
+	return files
+}
+
+// fileSize is 0 for files that aren't there.
+func fileSize(path string) int64 {
+	if info, err := os.Stat(path); err == nil {
+		return info.Size()
+	}
+	return 0
+}
+
+// Get treats anything it can't read back as a miss.
+func (d *DiskStore) Get(key string) []*Entry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	path := d.path(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var variants []*Entry
+	if json.Unmarshal(data, &variants) != nil {
+		return nil
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now) // used just now, last in line for eviction
+	return variants
+}
+
+// Set writes to a temp file first, a crash halfway leaves the old entry.
+func (d *DiskStore) Set(key string, variants []*Entry) {
+	data, err := json.Marshal(variants)
+	if err != nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	path := d.path(key)
+	if int64(len(data)) > d.maxBytes {
+		d.remove(path) // would push everything else out and still not fit
+		return
+	}
+	tmp, err := os.CreateTemp(d.dir, "tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	tmp.Close()
+	old := fileSize(path)
+	if err != nil || os.Rename(tmp.Name(), path) != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	d.used += int64(len(data)) - old
+	d.evict(path)
+}
+
+func (d *DiskStore) Delete(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.remove(d.path(key))
+}
+
+func (d *DiskStore) remove(path string) {
+	size := fileSize(path)
+	if os.Remove(path) == nil {
+		d.used -= size
+	}
+}
+
+// evict removes the least recently used files until they fit in maxBytes,
+// keep excepted.
+func (d *DiskStore) evict(keep string) {
+	if d.used <= d.maxBytes {
+		return
+	}
+	files := d.files()
+	slices.SortFunc(files, func(a, b os.FileInfo) int { return a.ModTime().Compare(b.ModTime()) })
+	for _, f := range files {
+		if d.used <= d.maxBytes {
+			return
+		}
+		if path := filepath.Join(d.dir, f.Name()); path != keep {
+			d.remove(path)
+		}
+	}
+}
@@ -0,0 +1,491 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ERROR_UNSUPPORTED_URL = errors.New("Only absolute http and https URLs are supported")
+var ERROR_TOO_MANY_REDIRECTS = errors.New("Stopped after too many redirects")
+
+const (
+	DefaultDialTimeout     = 10 * time.Second
+	DefaultTimeout         = 30 * time.Second
+	DefaultIdleConnTimeout = 90 * time.Second
+	DefaultMaxIdlePerHost  = 2
+	DefaultMaxRedirects    = 10
+	DefaultUserAgent       = "httpfromtcp"
+)
+
+// Dialer opens connections to servers, *net.Dialer is one.
+type Dialer interface {
+	Dial(network string, address string) (net.Conn, error)
+}
+
+// Client sends requests whose RequestTarget is an absolute URL, which is
+// exactly how a request to a proxy looks. Connections are kept around and
+// reused per host. The zero value is ready to use.
+type Client struct {
+	Dialer         Dialer        // nil means a net.Dialer with DefaultDialTimeout
+	TLSConfig      *tls.Config   // for https, nil means the defaults
+	Timeout        time.Duration // for writing the request, the head to arrive and between body reads, 0 means DefaultTimeout
+	IdleTimeout    time.Duration // how long an unused connection is kept, 0 means DefaultIdleConnTimeout
+	MaxIdlePerHost int           // 0 means DefaultMaxIdlePerHost, negative turns pooling off
+	MaxRedirects   int           // 0 means DefaultMaxRedirects, negative means redirects come back as they are
+
+	mu   sync.Mutex
+	idle map[string][]*persistConn
+}
+
+type persistConn struct {
+	conn        net.Conn
+	r           io.Reader
+	key         string
+	buf         []byte
+	readToIndex int
+	timeout     time.Duration
+	broken      bool // can't take another request
+	reused      bool
+	idleSince   time.Time
+
+	ctx  context.Context // of the request being served, nil while idle
+	stop func() bool     // stops the watch on ctx
+}
+
+// watch makes reads fail as soon as ctx is done, for as long as the request
+// owns the connection.
+func (pc *persistConn) watch(ctx context.Context) {
+	pc.ctx = ctx
+	if ctx.Done() != nil {
+		pc.stop = context.AfterFunc(ctx, func() {
+			pc.conn.SetDeadline(time.Unix(1, 0))
+		})
+	}
+}
+
+// detach ends the watch. A connection the context already got to has a
+// deadline in the past and can't be reused.
+func (pc *persistConn) detach() {
+	if pc.stop != nil && !pc.stop() {
+		pc.broken = true
+	}
+	pc.ctx, pc.stop = nil, nil
+}
+
+func (pc *persistConn) read(p []byte) (int, error) {
+	if pc.ctx != nil && pc.ctx.Err() != nil {
+		return 0, pc.ctx.Err()
+	}
+	if pc.conn != nil && pc.timeout > 0 {
+		deadline := time.Now().Add(pc.timeout)
+		if pc.ctx != nil {
+			if d, ok := pc.ctx.Deadline(); ok && d.Before(deadline) {
+				deadline = d
+			}
+		}
+		pc.conn.SetReadDeadline(deadline)
+		// the context may have fired before that and had its deadline overwritten
+		if pc.ctx != nil && pc.ctx.Err() != nil {
+			return 0, pc.ctx.Err()
+		}
+	}
+	n, err := pc.r.Read(p)
+	if err != nil && pc.ctx != nil {
+		if ctxErr := contextErr(pc.ctx, err); ctxErr != nil {
+			return n, ctxErr
+		}
+	}
+	return n, err
+}
+
+// contextErr returns the context's error when it's what made err happen.
+// The socket deadline copied from ctx can go off a moment before ctx's own
+// timer, while ctx.Err() is still nil.
+func contextErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var netErr net.Error
+	if d, ok := ctx.Deadline(); ok && errors.As(err, &netErr) && netErr.Timeout() && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// NewRequest builds a request for Do and Stream. Headers can be added to the
+// result before sending it.
+func NewRequest(method string, rawURL string, body []byte) (*request.Request, error) {
+	if _, _, err := parseURL(rawURL); err != nil {
+		return nil, err
+	}
+	return &request.Request{
+		RequestLine: request.RequestLine{
+			HttpVersion:   "1.1",
+			RequestTarget: rawURL,
+			Method:        method,
+		},
+		State:   request.StateDone,
+		Headers: headers.NewHeaders(),
+		Body:    body,
+	}, nil
+}
+
+// parseURL returns the URL and the host:port to connect to.
+func parseURL(rawURL string) (*url.URL, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, "", ERROR_UNSUPPORTED_URL
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return u, net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// ResponseFromReader parses a whole response, body included. method is the
+// one of the request it answers, HEAD responses have no body.
+func ResponseFromReader(reader io.Reader, method string) (*Response, error) {
+	res := newResponse(method)
+	res.conn = &persistConn{r: reader, buf: make([]byte, 8)}
+	for res.State != StateDone {
+		if err := res.fill(false); err != nil {
+			return nil, err
+		}
+	}
+	res.conn = nil
+	return res, nil
+}
+
+// StreamFromReader parses a response head and leaves the body to Read, the
+// way Stream does for a connection.
+func StreamFromReader(reader io.Reader, method string) (*Response, error) {
+	res := newResponse(method)
+	res.conn = &persistConn{r: reader, buf: make([]byte, 1024)}
+	if err := res.fill(true); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (c *Client) getConn(u *url.URL, address string) (*persistConn, error) {
+	key := u.Scheme + "://" + address
+	idleTimeout := c.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleConnTimeout
+	}
+
+	c.mu.Lock()
+	for len(c.idle[key]) > 0 {
+		conns := c.idle[key]
+		pc := conns[len(conns)-1]
+		c.idle[key] = conns[:len(conns)-1]
+		if time.Since(pc.idleSince) < idleTimeout {
+			c.mu.Unlock()
+			pc.reused = true
+			return pc, nil
+		}
+		pc.conn.Close()
+	}
+	c.mu.Unlock()
+
+	conn, err := c.dial(u, address)
+	if err != nil {
+		return nil, err
+	}
+	return &persistConn{
+		conn:    conn,
+		r:       conn,
+		key:     key,
+		buf:     make([]byte, 4096),
+		timeout: c.timeout(),
+	}, nil
+}
+
+func (c *Client) dial(u *url.URL, address string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if c.Dialer != nil {
+		conn, err = c.Dialer.Dial("tcp", address)
+	} else {
+		d := &net.Dialer{Timeout: DefaultDialTimeout}
+		conn, err = d.Dial("tcp", address)
+	}
+	if err != nil || u.Scheme != "https" {
+		return conn, err
+	}
+
+	cfg := &tls.Config{}
+	if c.TLSConfig != nil {
+		cfg = c.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+	tlsConn := tls.Client(conn, cfg)
+	tlsConn.SetDeadline(time.Now().Add(c.timeout()))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func (c *Client) putConn(pc *persistConn) {
+	pc.detach()
+	maxIdle := c.MaxIdlePerHost
+	if maxIdle == 0 {
+		maxIdle = DefaultMaxIdlePerHost
+	}
+	if pc.broken || pc.readToIndex > 0 || maxIdle < 0 { // leftover bytes mean the server is confused
+		pc.conn.Close()
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idle == nil {
+		c.idle = make(map[string][]*persistConn)
+	}
+	if len(c.idle[pc.key]) >= maxIdle {
+		pc.conn.Close()
+		return
+	}
+	pc.conn.SetDeadline(time.Time{})
+	pc.idleSince = time.Now()
+	c.idle[pc.key] = append(c.idle[pc.key], pc)
+}
+
+// CloseIdleConnections drops every pooled connection.
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conns := range c.idle {
+		for _, pc := range conns {
+			pc.conn.Close()
+		}
+	}
+	c.idle = nil
+}
+
+func writeRequest(w io.Writer, u *url.URL, req *request.Request) error {
+	h := headers.NewHeaders()
+	for k, v := range req.Headers {
+		h.Set(k, v)
+	}
+	h.Set("host", u.Host)
+	if h.Get("user-agent") == "" {
+		h.Set("user-agent", DefaultUserAgent)
+	}
+	h.Delete("transfer-encoding")
+	h.Delete("content-length")
+	method := req.RequestLine.Method
+	if len(req.Body) > 0 || method == "POST" || method == "PUT" || method == "PATCH" {
+		h.Set("content-length", strconv.Itoa(len(req.Body)))
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s %s HTTP/1.1\r\n", method, u.RequestURI())
+	response.WriteHeaders(bw, h)
+	bw.WriteString("\r\n")
+	bw.Write(req.Body)
+	return bw.Flush()
+}
+
+// Idempotent is true for the methods that are safe to send twice, RFC 9110
+// 9.2.2.
+func Idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// roundTrip sends one request and reads the response head. A pooled
+// connection the server closed in the meantime gets one retry on a fresh one,
+// as long as the request is safe to repeat.
+func (c *Client) roundTrip(req *request.Request) (*Response, error) {
+	u, address, err := parseURL(req.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := req.Context()
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		pc, err := c.getConn(u, address)
+		if err != nil {
+			return nil, err
+		}
+		res, silent, err := c.exchange(pc, u, req)
+		if err == nil {
+			return res, nil
+		}
+		pc.detach()
+		pc.conn.Close()
+		if !pc.reused || !silent || !Idempotent(req.RequestLine.Method) {
+			return nil, err
+		}
+	}
+}
+
+// exchange writes the request and reads the response head. silent means the
+// server never sent a byte back and didn't time out either, which is what a
+// pooled connection closed on the other end looks like.
+func (c *Client) exchange(pc *persistConn, u *url.URL, req *request.Request) (*Response, bool, error) {
+	ctx := req.Context()
+	deadline := time.Now().Add(c.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	pc.conn.SetWriteDeadline(deadline)
+	pc.watch(ctx)
+	if err := writeRequest(pc.conn, u, req); err != nil {
+		if ctxErr := contextErr(ctx, err); ctxErr != nil {
+			return nil, false, ctxErr
+		}
+		return nil, true, err
+	}
+
+	res := newResponse(req.RequestLine.Method)
+	res.conn = pc
+	res.client = c
+	if err := res.fill(true); err != nil {
+		if ctxErr := contextErr(ctx, err); ctxErr != nil {
+			return nil, false, ctxErr
+		}
+		var netErr net.Error
+		timedOut := errors.As(err, &netErr) && netErr.Timeout()
+		return nil, !timedOut && res.State == StateStatusLine && pc.readToIndex == 0, err
+	}
+	return res, false, nil
+}
+
+func isRedirect(code response.StatusCode) bool {
+	switch code {
+	case response.StatusMovedPermanently, response.StatusFound, response.StatusSeeOther,
+		response.StatusTemporaryRedirect, response.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirect builds the request that follows res, RFC 9110 15.4.
+func redirect(req *request.Request, res *Response) (*request.Request, error) {
+	from, err := url.Parse(req.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := url.Parse(res.Headers.Get("location"))
+	if err != nil {
+		return nil, err
+	}
+	to := from.ResolveReference(loc)
+
+	method := req.RequestLine.Method
+	body := req.Body
+	code := res.StatusLine.StatusCode
+	// 303 always turns into GET, and for 301/302 everyone does that to POST too
+	if code == response.StatusSeeOther && method != "HEAD" || (code == response.StatusMovedPermanently || code == response.StatusFound) && method == "POST" {
+		method = "GET"
+		body = nil
+	}
+
+	next, err := NewRequest(method, to.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range req.Headers {
+		next.Headers.Set(k, v)
+	}
+	if body == nil {
+		next.Headers.Delete("content-type")
+	}
+	if to.Host != from.Host { // credentials stay with the host they were meant for
+		next.Headers.Delete("authorization")
+		next.Headers.Delete("cookie")
+	}
+	return next.WithContext(req.Context()), nil
+}
+
+// Stream sends the request and returns once the response head is in. The body
+// is read through the response itself and the caller has to Close it, which
+// puts the connection back in the pool.
+func (c *Client) Stream(req *request.Request) (*Response, error) {
+	maxRedirects := c.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = DefaultMaxRedirects
+	}
+
+	for redirects := 0; ; redirects++ {
+		res, err := c.roundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		if maxRedirects < 0 || !isRedirect(res.StatusLine.StatusCode) || res.Headers.Get("location") == "" {
+			return res, nil
+		}
+
+		io.Copy(io.Discard, res) // drain it so the connection can be reused
+		res.Close()
+		if redirects >= maxRedirects {
+			return nil, ERROR_TOO_MANY_REDIRECTS
+		}
+		req, err = redirect(req, res)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Do sends the request and reads the whole response, the body ends up in
+// Body.
+func (c *Client) Do(req *request.Request) (*Response, error) {
+	res, err := c.Stream(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	body, err := io.ReadAll(res)
+	if err != nil {
+		return nil, err
+	}
+	res.Body = body
+	return res, nil
+}
+
+// Get is Do for a plain GET.
+func (c *Client) Get(rawURL string) (*Response, error) {
+	req, err := NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
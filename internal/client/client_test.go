@@ -0,0 +1,252 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// keepAliveServer answers every request on a connection with whatever reply
+// returns, until reply returns "" which closes the connection.
+func keepAliveServer(t *testing.T, reply func(req *request.Request) string) (string, *atomic.Int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	var conns atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conn.Close()
+				reader := request.NewConnReader(conn)
+				for {
+					req, err := reader.Next()
+					if err != nil {
+						return
+					}
+					res := reply(req)
+					if res == "" {
+						return
+					}
+					conn.Write([]byte(res))
+				}
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String(), &conns
+}
+
+func ok(body string) string {
+	return fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func TestDo(t *testing.T) {
+	base, conns := keepAliveServer(t, func(req *request.Request) string {
+		return ok(req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + string(req.Body) + " " + req.Headers.Get("host"))
+	})
+	c := &Client{}
+
+	// Test: Request goes out in origin-form with a Host header
+	res, err := c.Get(base + "/hello?x=1")
+	require.NoError(t, err)
+	assert.Equal(t, "GET /hello?x=1  "+base[len("http://"):], string(res.Body))
+
+	// Test: Second request reuses the connection, body included
+	req, err := NewRequest("POST", base+"/items", []byte("data"))
+	require.NoError(t, err)
+	res, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "POST /items data "+base[len("http://"):], string(res.Body))
+	assert.Equal(t, int32(1), conns.Load())
+
+	// Test: Connection: close keeps it out of the pool
+	closing, conns := keepAliveServer(t, func(req *request.Request) string {
+		return "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 2\r\n\r\nok"
+	})
+	c.Get(closing)
+	c.Get(closing)
+	assert.Equal(t, int32(2), conns.Load())
+
+	// Test: Only absolute http URLs
+	_, err = c.Get("/relative")
+	require.ErrorIs(t, err, ERROR_UNSUPPORTED_URL)
+	_, err = c.Get("ftp://example.com")
+	require.ErrorIs(t, err, ERROR_UNSUPPORTED_URL)
+}
+
+func TestStalePooledConnection(t *testing.T) {
+	// Test: The server drops idle connections, requests get retried on a fresh one
+	var served atomic.Int32
+	base, conns := keepAliveServer(t, func(req *request.Request) string {
+		if served.Add(1)%2 == 0 {
+			return "" // quietly closes instead of answering
+		}
+		return ok("fine")
+	})
+	c := &Client{}
+	for i := 0; i < 2; i++ {
+		res, err := c.Get(base)
+		require.NoError(t, err)
+		assert.Equal(t, "fine", string(res.Body))
+	}
+	assert.Equal(t, int32(2), conns.Load())
+
+	// Test: A POST isn't repeated
+	_, err := c.Get(base) // every other request gets dropped, this one leaves a doomed pooled connection
+	require.NoError(t, err)
+	req, _ := NewRequest("POST", base, []byte("once"))
+	_, err = c.Do(req)
+	require.Error(t, err)
+}
+
+func TestRedirects(t *testing.T) {
+	var base string
+	base, _ = keepAliveServer(t, func(req *request.Request) string {
+		switch req.RequestLine.RequestTarget {
+		case "/old":
+			return "HTTP/1.1 301 Moved Permanently\r\nLocation: /new\r\nContent-Length: 5\r\n\r\nmoved"
+		case "/form":
+			return "HTTP/1.1 303 See Other\r\nLocation: " + base + "/done\r\nContent-Length: 0\r\n\r\n"
+		case "/keep":
+			return "HTTP/1.1 307 Temporary Redirect\r\nLocation: /new\r\nContent-Length: 0\r\n\r\n"
+		case "/loop":
+			return "HTTP/1.1 302 Found\r\nLocation: /loop\r\nContent-Length: 0\r\n\r\n"
+		}
+		return ok(req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + string(req.Body))
+	})
+	c := &Client{}
+
+	// Test: Relative Location
+	res, err := c.Get(base + "/old")
+	require.NoError(t, err)
+	assert.Equal(t, "GET /new ", string(res.Body))
+
+	// Test: 303 turns a POST into a GET without the body
+	req, _ := NewRequest("POST", base+"/form", []byte("payload"))
+	res, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "GET /done ", string(res.Body))
+
+	// Test: 307 keeps the method and the body
+	req, _ = NewRequest("PUT", base+"/keep", []byte("payload"))
+	res, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "PUT /new payload", string(res.Body))
+
+	// Test: Redirect loops stop
+	_, err = c.Get(base + "/loop")
+	require.ErrorIs(t, err, ERROR_TOO_MANY_REDIRECTS)
+
+	// Test: Following can be turned off
+	c = &Client{MaxRedirects: -1}
+	res, err = c.Get(base + "/old")
+	require.NoError(t, err)
+	assert.Equal(t, 301, int(res.StatusLine.StatusCode))
+	assert.Equal(t, "moved", string(res.Body))
+}
+
+func TestStreamAndTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := request.RequestFromReader(conn)
+				if err != nil || req.RequestLine.RequestTarget == "/silent" {
+					<-release
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nfirst\r\n"))
+				<-release
+				conn.Write([]byte("6\r\nsecond\r\n0\r\n\r\n"))
+			}()
+		}
+	}()
+	base := "http://" + l.Addr().String()
+	c := &Client{Timeout: 100 * time.Millisecond}
+
+	// Test: Stream hands out the body as it arrives
+	req, _ := NewRequest("GET", base+"/stream", nil)
+	res, err := c.Stream(req)
+	require.NoError(t, err)
+	buf := make([]byte, 64)
+	n, err := res.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(buf[:n]))
+
+	// Test: A stalled body times out
+	_, err = io.ReadAll(res)
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr) && netErr.Timeout())
+	res.Close()
+
+	// Test: A server that never answers times out too
+	_, err = c.Get(base + "/silent")
+	require.True(t, errors.As(err, &netErr) && netErr.Timeout())
+	close(release)
+}
+
+func TestContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	base, _ := keepAliveServer(t, func(req *request.Request) string {
+		if req.RequestLine.RequestTarget == "/slow" {
+			<-release
+		}
+		return ok("fine")
+	})
+	c := &Client{}
+
+	// Test: Cancelling the context stops a request waiting on the server
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := NewRequest("GET", base+"/slow", nil)
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, err := c.Do(req.WithContext(ctx))
+	require.ErrorIs(t, err, context.Canceled)
+
+	// Test: A context deadline shorter than the client timeout wins
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = c.Do(req.WithContext(ctx))
+	require.ErrorIs(t, err, context.DeadlineExceeded) // even when the socket deadline goes off first
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Test: An already cancelled context doesn't get as far as dialing
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = c.Do(req.WithContext(ctx))
+	require.ErrorIs(t, err, context.Canceled)
+
+	// Test: A finished request leaves a reusable connection behind
+	ctx, cancel = context.WithCancel(context.Background())
+	fast, _ := NewRequest("GET", base+"/fast", nil)
+	res, err := c.Do(fast.WithContext(ctx))
+	require.NoError(t, err)
+	assert.Equal(t, "fine", string(res.Body))
+	cancel()
+	res, err = c.Get(base + "/fast")
+	require.NoError(t, err)
+	assert.Equal(t, "fine", string(res.Body))
+}
@@ -0,0 +1,348 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/response"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var CRLF = []byte("\r\n")
+var ERROR_MALFORMED_STATUS_LINE = errors.New("Malformed Status Line Error")
+var ERROR_MALFORMED_RESPONSE = errors.New("Malformed Http Response Error")
+var ERROR_READING_IN_DONE_STATE = errors.New("Trying to read in a done state")
+
+// Nothing that isn't body (status line, a field line, a chunk size) gets to be
+// bigger than this.
+const maxLineBytes = 1 << 20
+
+type ParserState int
+
+const (
+	StateStatusLine ParserState = iota
+	StateHeaders
+	StateBody // Content-Length or read until close
+	StateChunkSize
+	StateChunkData
+	StateChunkEnd
+	StateTrailers
+	StateDone
+)
+
+type StatusLine struct {
+	HttpVersion  string
+	StatusCode   response.StatusCode
+	ReasonPhrase string
+}
+
+// Response is the response side of request.Request: the same kind of state
+// machine, fed whatever bytes are around and picking up where it stopped.
+// Body holds the body bytes parsed so far, streamed responses hand them out
+// through Read instead.
+type Response struct {
+	StatusLine StatusLine
+	State      ParserState
+	Headers    headers.Headers
+	Body       []byte
+	Trailers   headers.Headers
+
+	method    string // HEAD responses never have a body
+	remaining int64  // left in the current chunk or Content-Length body, -1 means until close
+	conn      *persistConn
+	client    *Client
+	closed    bool
+}
+
+func newResponse(method string) *Response {
+	return &Response{
+		State:    StateStatusLine,
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+		method:   method,
+	}
+}
+
+func ParseStatusLine(data []byte) (*StatusLine, int, error) {
+	idx := bytes.Index(data, CRLF)
+	if idx == -1 {
+		return nil, 0, nil
+	}
+
+	// the reason phrase can have spaces in it, or be missing altogether
+	parts := strings.SplitN(string(data[:idx]), " ", 3)
+	if len(parts) < 2 {
+		return nil, 0, ERROR_MALFORMED_STATUS_LINE
+	}
+	version, ok := strings.CutPrefix(parts[0], "HTTP/")
+	if !ok || (version != "1.1" && version != "1.0") {
+		return nil, 0, ERROR_MALFORMED_STATUS_LINE
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil || len(parts[1]) != 3 || code < 100 {
+		return nil, 0, ERROR_MALFORMED_STATUS_LINE
+	}
+	reason := ""
+	if len(parts) == 3 {
+		reason = parts[2]
+	}
+
+	return &StatusLine{
+		HttpVersion:  version,
+		StatusCode:   response.StatusCode(code),
+		ReasonPhrase: reason,
+	}, idx + len(CRLF), nil
+}
+
+// startBody picks the framing, RFC 9112 6.3.
+func (r *Response) startBody() error {
+	code := r.StatusLine.StatusCode
+	if r.method == "HEAD" || code < 200 || code == response.StatusNoContent || code == response.StatusNotModified {
+		r.State = StateDone
+		return nil
+	}
+
+	if te := r.Headers.Get("transfer-encoding"); te != "" {
+		codings := strings.Split(te, ",")
+		if strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			r.State = StateChunkSize
+			return nil
+		}
+		r.State = StateBody // not chunked last, so the body runs until close
+		r.remaining = -1
+		return nil
+	}
+
+	if l := r.Headers.Get("content-length"); l != "" {
+		length, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || length < 0 {
+			return ERROR_MALFORMED_RESPONSE
+		}
+		r.remaining = length
+		r.State = StateBody
+		if length == 0 {
+			r.State = StateDone
+		}
+		return nil
+	}
+
+	r.State = StateBody
+	r.remaining = -1
+	return nil
+}
+
+func (r *Response) parseSingle(data []byte) (int, error) {
+	switch r.State {
+	case StateStatusLine:
+		sl, read, err := ParseStatusLine(data)
+		if err != nil {
+			return 0, err
+		}
+		if read == 0 {
+			return 0, nil
+		}
+		r.StatusLine = *sl
+		r.State = StateHeaders
+		return read, nil
+
+	case StateHeaders:
+		n, done, err := r.Headers.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+		if done {
+			code := r.StatusLine.StatusCode
+			if code < 200 && code != response.StatusSwitchingProtocols { // interim, the real one follows
+				r.Headers = headers.NewHeaders()
+				r.State = StateStatusLine
+				return n, nil
+			}
+			if err := r.startBody(); err != nil {
+				return 0, err
+			}
+		}
+		return n, nil
+
+	case StateBody:
+		take := len(data)
+		if r.remaining >= 0 {
+			take = int(min(r.remaining, int64(len(data))))
+			r.remaining -= int64(take)
+			if r.remaining == 0 {
+				r.State = StateDone
+			}
+		}
+		r.Body = append(r.Body, data[:take]...)
+		return take, nil
+
+	case StateChunkSize:
+		idx := bytes.Index(data, CRLF)
+		if idx == -1 {
+			return 0, nil
+		}
+		size, _, _ := bytes.Cut(data[:idx], []byte(";")) // extensions are ignored
+		n, err := strconv.ParseInt(string(bytes.TrimSpace(size)), 16, 64)
+		if err != nil || n < 0 {
+			return 0, ERROR_MALFORMED_RESPONSE
+		}
+		r.remaining = n
+		r.State = StateChunkData
+		if n == 0 {
+			r.State = StateTrailers
+		}
+		return idx + len(CRLF), nil
+
+	case StateChunkData:
+		take := int(min(r.remaining, int64(len(data))))
+		r.Body = append(r.Body, data[:take]...)
+		r.remaining -= int64(take)
+		if r.remaining == 0 {
+			r.State = StateChunkEnd
+		}
+		return take, nil
+
+	case StateChunkEnd:
+		if len(data) < len(CRLF) {
+			return 0, nil
+		}
+		if !bytes.HasPrefix(data, CRLF) {
+			return 0, ERROR_MALFORMED_RESPONSE
+		}
+		r.State = StateChunkSize
+		return len(CRLF), nil
+
+	case StateTrailers:
+		n, done, err := r.Trailers.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+		if done {
+			r.State = StateDone
+		}
+		return n, nil
+
+	case StateDone:
+		return 0, ERROR_READING_IN_DONE_STATE
+	}
+
+	return 0, errors.New("Undefined state")
+}
+
+func (r *Response) parse(data []byte) (int, error) {
+	consumed := 0
+	for r.State != StateDone {
+		n, err := r.parseSingle(data[consumed:])
+		consumed += n
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	return consumed, nil
+}
+
+// headDone is true once the parser is past the header section.
+func (r *Response) headDone() bool {
+	return r.State > StateHeaders
+}
+
+// fill reads from the connection until the parser moves on. With head set it
+// stops after the header section, otherwise after any body progress.
+func (r *Response) fill(head bool) error {
+	pc := r.conn
+	for r.State != StateDone {
+		if pc.readToIndex > 0 {
+			before := len(r.Body)
+			read, err := r.parse(pc.buf[:pc.readToIndex])
+			if err != nil {
+				return err
+			}
+			copy(pc.buf, pc.buf[read:pc.readToIndex])
+			pc.readToIndex -= read
+			if head && r.headDone() || !head && (len(r.Body) > before || r.State == StateDone) {
+				return nil
+			}
+		}
+
+		if pc.readToIndex >= len(pc.buf) {
+			if len(pc.buf) >= maxLineBytes {
+				return ERROR_MALFORMED_RESPONSE
+			}
+			nbuf := make([]byte, len(pc.buf)*2)
+			copy(nbuf, pc.buf)
+			pc.buf = nbuf
+		}
+
+		n, err := pc.read(pc.buf[pc.readToIndex:])
+		pc.readToIndex += n
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				return err
+			}
+			if n == 0 {
+				if r.State == StateBody && r.remaining < 0 { // close-delimited, so that's the end
+					r.State = StateDone
+					pc.broken = true
+					return nil
+				}
+				return io.ErrUnexpectedEOF
+			}
+		}
+	}
+	return nil
+}
+
+// Read streams the body of a response from Client.Stream. The trailers are in
+// once it returns io.EOF.
+func (r *Response) Read(p []byte) (int, error) {
+	for len(r.Body) == 0 {
+		if r.State == StateDone || r.conn == nil {
+			r.release()
+			return 0, io.EOF
+		}
+		if err := r.fill(false); err != nil {
+			r.Close()
+			return 0, err
+		}
+	}
+	n := copy(p, r.Body)
+	r.Body = r.Body[n:]
+	return n, nil
+}
+
+// Close gives the connection back to the pool if the body was read to the
+// end, and closes it otherwise.
+func (r *Response) Close() error {
+	if r.State != StateDone && r.conn != nil {
+		r.conn.broken = true
+	}
+	r.release()
+	return nil
+}
+
+func (r *Response) release() {
+	if r.closed || r.conn == nil {
+		return
+	}
+	r.closed = true
+	keepAlive := r.StatusLine.HttpVersion == "1.1" && !hasToken(r.Headers.Get("connection"), "close")
+	if !keepAlive || r.State != StateDone {
+		r.conn.broken = true
+	}
+	if r.client != nil { // nil when it came from StreamFromReader
+		r.client.putConn(r.conn)
+	}
+}
+
+func hasToken(value string, token string) bool {
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"httpfromtcp/internal/response"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type chunkReader struct {
+	data            string
+	numBytesPerRead int
+	pos             int
+}
+
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+
+	endIndex := min(cr.pos+cr.numBytesPerRead, len(cr.data))
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+
+	return n, nil
+}
+
+func TestStatusLineParse(t *testing.T) {
+	// Test: Good status line
+	reader := &chunkReader{
+		data:            "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "1.1", r.StatusLine.HttpVersion)
+	assert.Equal(t, response.StatusNotFound, r.StatusLine.StatusCode)
+	assert.Equal(t, "Not Found", r.StatusLine.ReasonPhrase)
+
+	// Test: Missing reason phrase and HTTP/1.0
+	reader = &chunkReader{
+		data:            "HTTP/1.0 200\r\n\r\n",
+		numBytesPerRead: 1,
+	}
+	r, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.StatusLine.HttpVersion)
+	assert.Equal(t, "", r.StatusLine.ReasonPhrase)
+
+	// Test: Not HTTP
+	reader = &chunkReader{
+		data:            "SSH-2.0-OpenSSH_9.6\r\n",
+		numBytesPerRead: 8,
+	}
+	_, err = ResponseFromReader(reader, "GET")
+	require.ErrorIs(t, err, ERROR_MALFORMED_STATUS_LINE)
+
+	// Test: Four digit status code
+	reader = &chunkReader{
+		data:            "HTTP/1.1 2000 OK\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	_, err = ResponseFromReader(reader, "GET")
+	require.ErrorIs(t, err, ERROR_MALFORMED_STATUS_LINE)
+
+	// Test: Interim responses are skipped
+	reader = &chunkReader{
+		data:            "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 201 Created\r\nX-Real: yes\r\nContent-Length: 2\r\n\r\nok",
+		numBytesPerRead: 5,
+	}
+	r, err = ResponseFromReader(reader, "POST")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCreated, r.StatusLine.StatusCode)
+	assert.Equal(t, "yes", r.Headers.Get("x-real"))
+	assert.Equal(t, "ok", string(r.Body))
+}
+
+func TestBodyParse(t *testing.T) {
+	// Test: Content-Length body
+	reader := &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 13\r\n\r\nhello world!\n",
+		numBytesPerRead: 3,
+	}
+	r, err := ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(r.Body))
+
+	// Test: Body shorter than reported content length
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\npartial content",
+		numBytesPerRead: 3,
+	}
+	_, err = ResponseFromReader(reader, "GET")
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Chunked body with extensions and trailers
+	reader = &chunkReader{
+		data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n" +
+			"4;name=value\r\nWiki\r\n5\r\npedia\r\nE\r\n in\r\n\r\nchunks.\r\n0\r\nX-Sum: 1\r\n\r\n",
+		numBytesPerRead: 1,
+	}
+	r, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "Wikipedia in\r\n\r\nchunks.", string(r.Body))
+	assert.Equal(t, "1", r.Trailers.Get("x-sum"))
+
+	// Test: Bad chunk size
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n",
+		numBytesPerRead: 4,
+	}
+	_, err = ResponseFromReader(reader, "GET")
+	require.ErrorIs(t, err, ERROR_MALFORMED_RESPONSE)
+
+	// Test: Chunk data longer than its size
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nabc\r\n0\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	_, err = ResponseFromReader(reader, "GET")
+	require.ErrorIs(t, err, ERROR_MALFORMED_RESPONSE)
+
+	// Test: No framing at all, the body runs until close
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\n\r\nuntil the very end",
+		numBytesPerRead: 4,
+	}
+	r, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "until the very end", string(r.Body))
+
+	// Test: HEAD and 304 have no body whatever the headers say
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 50\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = ResponseFromReader(reader, "HEAD")
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+	reader = &chunkReader{
+		data:            "HTTP/1.1 304 Not Modified\r\nContent-Length: 50\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+}
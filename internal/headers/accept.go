@@ -0,0 +1,223 @@
+package headers
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// AcceptValue is one element of an Accept, Accept-Language, Accept-Charset or
+// Accept-Encoding header: "text/html;level=1;q=0.5" is Value "text/html",
+// Params {"level": "1"} and Q 0.5.
+type AcceptValue struct {
+	Value  string // lowercased
+	Params map[string]string
+	Q      float64 // 1 when the client didn't say
+}
+
+// splitList splits on commas outside of quoted strings.
+func splitList(s string) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseQ takes the RFC 9110 12.4.2 qvalue grammar, "0" to "1" with at most
+// three decimals.
+func parseQ(s string) (float64, bool) {
+	if len(s) == 0 || len(s) > 5 || (s[0] != '0' && s[0] != '1') || (len(s) > 1 && s[1] != '.') {
+		return 0, false
+	}
+	q, err := strconv.ParseFloat(s, 64)
+	if err != nil || q > 1 {
+		return 0, false
+	}
+	return q, true
+}
+
+// ParseAccept parses any of the Accept* headers, best first: by q, then by
+// how specific the value is ("text/html" before "text/*" before "*/*"), then
+// in the order they came. Elements that don't parse are left out.
+func ParseAccept(header string) []AcceptValue {
+	var values []AcceptValue
+	for _, element := range splitList(header) {
+		fields := strings.Split(element, ";")
+		v := AcceptValue{Value: strings.ToLower(strings.TrimSpace(fields[0])), Q: 1}
+		if v.Value == "" {
+			continue
+		}
+		ok := true
+		for _, param := range fields[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "q" {
+				v.Q, ok = parseQ(strings.TrimSpace(value))
+				break // whatever comes after q is an accept-ext, which nobody uses
+			}
+			if v.Params == nil {
+				v.Params = map[string]string{}
+			}
+			v.Params[name] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+		if ok {
+			values = append(values, v)
+		}
+	}
+	slices.SortStableFunc(values, func(a, b AcceptValue) int {
+		if a.Q != b.Q {
+			if a.Q > b.Q {
+				return -1
+			}
+			return 1
+		}
+		return mediaSpecificity(b) - mediaSpecificity(a)
+	})
+	return values
+}
+
+// mediaSpecificity ranks "*/*" < "text/*" < "text/html" < "text/html;level=1".
+// Values that aren't media ranges all rank the same except for "*".
+func mediaSpecificity(v AcceptValue) int {
+	switch {
+	case v.Value == "*/*" || v.Value == "*":
+		return 0
+	case strings.HasSuffix(v.Value, "/*"):
+		return 1
+	}
+	return 2 + len(v.Params)
+}
+
+// matchFunc says whether an accepted value covers an offer, and how
+// specifically. The most specific match decides the offer's q.
+type matchFunc func(accepted AcceptValue, offer string) (specificity int, ok bool)
+
+// negotiate picks the offer with the highest q, the earlier one on a tie
+// since offers come in the server's order of preference.
+func negotiate(accepted []AcceptValue, offers []string, match matchFunc) (string, bool) {
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q, specificity := 0.0, -1
+		for _, a := range accepted {
+			if s, ok := match(a, offer); ok && s > specificity {
+				q, specificity = a.Q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+func matchMediaType(a AcceptValue, offer string) (int, bool) {
+	offerType, offerParams := parseOffer(offer)
+	typ, sub, _ := strings.Cut(offerType, "/")
+	aType, aSub, _ := strings.Cut(a.Value, "/")
+	switch {
+	case a.Value == "*/*":
+	case aType == typ && aSub == "*":
+	case aType == typ && aSub == sub:
+		for name, value := range a.Params {
+			if !strings.EqualFold(offerParams[name], value) {
+				return 0, false
+			}
+		}
+	default:
+		return 0, false
+	}
+	return mediaSpecificity(a), true
+}
+
+// parseOffer splits "text/html; charset=utf-8" into type and parameters.
+func parseOffer(offer string) (string, map[string]string) {
+	fields := strings.Split(offer, ";")
+	params := map[string]string{}
+	for _, param := range fields[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		params[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	return strings.ToLower(strings.TrimSpace(fields[0])), params
+}
+
+// NegotiateMediaType picks the offer ("text/html", "application/json"...) an
+// Accept header likes best. No Accept header means anything goes, so the
+// first offer.
+func NegotiateMediaType(accept string, offers ...string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return firstOffer(offers)
+	}
+	return negotiate(ParseAccept(accept), offers, matchMediaType)
+}
+
+// NegotiateLanguage picks a language tag for an Accept-Language header, with
+// RFC 4647 basic filtering: "en" covers "en-GB" but not the other way round.
+func NegotiateLanguage(acceptLanguage string, offers ...string) (string, bool) {
+	if strings.TrimSpace(acceptLanguage) == "" {
+		return firstOffer(offers)
+	}
+	return negotiate(ParseAccept(acceptLanguage), offers, func(a AcceptValue, offer string) (int, bool) {
+		offer = strings.ToLower(offer)
+		switch {
+		case a.Value == "*":
+			return 0, true
+		case offer == a.Value || strings.HasPrefix(offer, a.Value+"-"):
+			return len(a.Value), true
+		}
+		return 0, false
+	})
+}
+
+// NegotiateCharset picks a charset for an Accept-Charset header.
+func NegotiateCharset(acceptCharset string, offers ...string) (string, bool) {
+	if strings.TrimSpace(acceptCharset) == "" {
+		return firstOffer(offers)
+	}
+	return negotiate(ParseAccept(acceptCharset), offers, matchToken)
+}
+
+// NegotiateEncoding picks a content coding for an Accept-Encoding header.
+// "identity" (no coding at all) is fine unless the client ruled it out with
+// "identity;q=0" or "*;q=0", RFC 9110 12.5.3.
+func NegotiateEncoding(acceptEncoding string, offers ...string) (string, bool) {
+	if strings.TrimSpace(acceptEncoding) == "" {
+		return firstOffer(offers)
+	}
+	accepted := ParseAccept(acceptEncoding)
+	if !slices.ContainsFunc(accepted, func(a AcceptValue) bool { return a.Value == "identity" || a.Value == "*" }) {
+		accepted = append(accepted, AcceptValue{Value: "identity", Q: 0.001}) // anything listed beats it
+	}
+	return negotiate(accepted, offers, matchToken)
+}
+
+// matchToken is for charsets and codings, one name or "*".
+func matchToken(a AcceptValue, offer string) (int, bool) {
+	switch {
+	case a.Value == "*":
+		return 0, true
+	case strings.EqualFold(a.Value, offer):
+		return 1, true
+	}
+	return 0, false
+}
+
+func firstOffer(offers []string) (string, bool) {
+	if len(offers) == 0 {
+		return "", false
+	}
+	return offers[0], true
+}
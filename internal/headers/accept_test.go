@@ -0,0 +1,69 @@
+package headers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAccept(t *testing.T) {
+	// Test: Ordered by q, then specificity, then as sent
+	values := ParseAccept(`text/*;q=0.5, Text/HTML;level=1, */*;q=0.1, text/html, application/json;q=0.5, image/png;q=oops`)
+	var order []string
+	for _, v := range values {
+		order = append(order, v.Value)
+	}
+	assert.Equal(t, []string{"text/html", "text/html", "application/json", "text/*", "*/*"}, order)
+	assert.Equal(t, map[string]string{"level": "1"}, values[0].Params)
+	assert.Equal(t, 0.1, values[4].Q)
+
+	// Test: Commas inside quoted parameters don't split
+	values = ParseAccept(`text/plain; note="a, b", text/html`)
+	assert.Len(t, values, 2)
+	assert.Equal(t, "a, b", values[0].Params["note"])
+
+	// Test: Only the qvalue grammar counts
+	assert.Empty(t, ParseAccept("a;q=1.5, b;q=0.1234, c;q=.5, d;q="))
+	assert.Len(t, ParseAccept("a;q=1.000, b;q=0"), 2)
+}
+
+func TestNegotiate(t *testing.T) {
+	cases := []struct {
+		name   string
+		fn     func(string, ...string) (string, bool)
+		header string
+		offers []string
+		want   string
+	}{
+		// Test: Media types, the most specific range decides an offer's q
+		{"browser", NegotiateMediaType, "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", []string{"application/json", "text/html"}, "text/html"},
+		{"api", NegotiateMediaType, "application/json", []string{"text/html", "application/json"}, "application/json"},
+		{"wildcard ties go to the server", NegotiateMediaType, "*/*", []string{"application/json", "text/html"}, "application/json"},
+		{"no header", NegotiateMediaType, "", []string{"text/html", "application/json"}, "text/html"},
+		{"excluded", NegotiateMediaType, "text/*, text/html;q=0", []string{"text/html", "text/plain"}, "text/plain"},
+		{"params", NegotiateMediaType, "text/html;level=1, text/html;q=0.2", []string{"text/html", "text/html;level=1"}, "text/html;level=1"},
+		{"nothing", NegotiateMediaType, "image/*", []string{"text/html"}, ""},
+
+		// Test: Languages, a range covers its subtags
+		{"prefix", NegotiateLanguage, "de-CH, en;q=0.8", []string{"en-GB", "fr"}, "en-GB"},
+		{"exact beats prefix", NegotiateLanguage, "en;q=0.5, en-US", []string{"en-GB", "en-US"}, "en-US"},
+		{"no reverse prefix", NegotiateLanguage, "en-US", []string{"en"}, ""},
+		{"any", NegotiateLanguage, "fr, *;q=0.1", []string{"de"}, "de"},
+
+		// Test: Charsets
+		{"charset", NegotiateCharset, "iso-8859-5, UTF-8;q=0.9", []string{"utf-8"}, "utf-8"},
+		{"charset refused", NegotiateCharset, "iso-8859-5", []string{"utf-8"}, ""},
+
+		// Test: Encodings, identity unless ruled out
+		{"gzip", NegotiateEncoding, "gzip, deflate, br;q=0.9", []string{"br", "gzip", "identity"}, "gzip"},
+		{"identity fallback", NegotiateEncoding, "br", []string{"gzip", "identity"}, "identity"},
+		{"listed beats identity", NegotiateEncoding, "gzip;q=0.1", []string{"identity", "gzip"}, "gzip"},
+		{"identity refused", NegotiateEncoding, "gzip;q=0, identity;q=0", []string{"gzip", "identity"}, ""},
+		{"star refuses identity", NegotiateEncoding, "br, *;q=0", []string{"identity"}, ""},
+	}
+	for _, c := range cases {
+		got, ok := c.fn(c.header, c.offers...)
+		assert.Equal(t, c.want, got, c.name)
+		assert.Equal(t, c.want != "", ok, c.name)
+	}
+}
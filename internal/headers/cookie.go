@@ -0,0 +1,140 @@
+package headers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ERROR_INVALID_COOKIE = errors.New("Invalid cookie")
+
+type SameSite int
+
+const (
+	SameSiteDefault SameSite = iota // no attribute, the browser decides
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone // needs Secure
+)
+
+// Cookie is a cookie from a Cookie header (only Name and Value are set then)
+// or one to send in a Set-Cookie, RFC 6265.
+type Cookie struct {
+	Name  string
+	Value string
+
+	Domain      string
+	Path        string
+	Expires     time.Time // zero means no Expires
+	MaxAge      int       // 0 means no Max-Age, negative means delete it now
+	Secure      bool
+	HttpOnly    bool
+	SameSite    SameSite
+	Partitioned bool // CHIPS, needs Secure
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`()<>@,;:\"/[]?={}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// RFC 6265 4.1.1: visible ASCII minus DQUOTE, comma, semicolon and backslash.
+func isCookieValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || c == '"' || c == ',' || c == ';' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseCookies reads a Cookie header, "a=1; b=2". Pairs that aren't valid
+// are skipped, the rest still count.
+func ParseCookies(header string) []*Cookie {
+	var cookies []*Cookie
+	// several Cookie lines end up comma-joined by Add, and a comma can't be
+	// part of a cookie anyway
+	for _, pair := range strings.FieldsFunc(header, func(r rune) bool { return r == ';' || r == ',' }) {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !isToken(name) {
+			continue
+		}
+		if len(value) > 1 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		if !isCookieValue(value) {
+			continue
+		}
+		cookies = append(cookies, &Cookie{Name: name, Value: value})
+	}
+	return cookies
+}
+
+// Valid checks the name, value and attributes, including what browsers
+// insist on for SameSite=None, Partitioned and the __Secure-/__Host- prefixes.
+func (c *Cookie) Valid() error {
+	switch {
+	case !isToken(c.Name):
+		return fmt.Errorf("%w: name isn't a token", ERROR_INVALID_COOKIE)
+	case !isCookieValue(c.Value):
+		return fmt.Errorf("%w: value has characters a cookie can't", ERROR_INVALID_COOKIE)
+	case strings.ContainsAny(c.Domain, ";\r\n ") || strings.ContainsAny(c.Path, ";\r\n"):
+		return fmt.Errorf("%w: domain or path has characters they can't", ERROR_INVALID_COOKIE)
+	case (c.SameSite == SameSiteNone || c.Partitioned) && !c.Secure:
+		return fmt.Errorf("%w: SameSite=None and Partitioned need Secure", ERROR_INVALID_COOKIE)
+	case strings.HasPrefix(c.Name, "__Secure-") && !c.Secure:
+		return fmt.Errorf("%w: __Secure- cookies need Secure", ERROR_INVALID_COOKIE)
+	case strings.HasPrefix(c.Name, "__Host-") && (!c.Secure || c.Domain != "" || c.Path != "/"):
+		return fmt.Errorf("%w: __Host- cookies need Secure, Path=/ and no Domain", ERROR_INVALID_COOKIE)
+	}
+	return nil
+}
+
+// String is the Set-Cookie value, call Valid first.
+func (c *Cookie) String() string {
+	var b strings.Builder
+	b.WriteString(c.Name + "=" + c.Value)
+	if c.Domain != "" {
+		b.WriteString("; Domain=" + strings.TrimPrefix(c.Domain, "."))
+	}
+	if c.Path != "" {
+		b.WriteString("; Path=" + c.Path)
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=" + FormatHTTPDate(c.Expires))
+	}
+	if c.MaxAge > 0 {
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	} else if c.MaxAge < 0 {
+		b.WriteString("; Max-Age=0")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	switch c.SameSite {
+	case SameSiteLax:
+		b.WriteString("; SameSite=Lax")
+	case SameSiteStrict:
+		b.WriteString("; SameSite=Strict")
+	case SameSiteNone:
+		b.WriteString("; SameSite=None")
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+	return b.String()
+}
@@ -0,0 +1,68 @@
+package headers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCookies(t *testing.T) {
+	// Test: Pairs in order, quotes dropped
+	cookies := ParseCookies(`session=abc123; theme="dark"; empty=`)
+	require.Len(t, cookies, 3)
+	assert.Equal(t, "session", cookies[0].Name)
+	assert.Equal(t, "abc123", cookies[0].Value)
+	assert.Equal(t, "dark", cookies[1].Value)
+	assert.Equal(t, "", cookies[2].Value)
+
+	// Test: Broken pairs are skipped, Cookie lines joined by Add still work
+	h := NewHeaders()
+	h.Add("cookie", "a=1; bad name=2; noequals; c=x\\y")
+	h.Add("cookie", "d=4")
+	cookies = ParseCookies(h.Get("cookie"))
+	require.Len(t, cookies, 2)
+	assert.Equal(t, "a", cookies[0].Name)
+	assert.Equal(t, "d", cookies[1].Name)
+}
+
+func TestSetCookieString(t *testing.T) {
+	// Test: Every attribute
+	c := &Cookie{
+		Name: "id", Value: "42", Domain: ".example.com", Path: "/app",
+		Expires: time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC), MaxAge: 3600,
+		Secure: true, HttpOnly: true, SameSite: SameSiteNone, Partitioned: true,
+	}
+	require.NoError(t, c.Valid())
+	assert.Equal(t, "id=42; Domain=example.com; Path=/app; Expires=Wed, 02 Jan 2030 03:04:05 GMT; Max-Age=3600; Secure; HttpOnly; SameSite=None; Partitioned", c.String())
+
+	// Test: Deleting
+	assert.Equal(t, "id=; Max-Age=0; SameSite=Lax", (&Cookie{Name: "id", MaxAge: -1, SameSite: SameSiteLax}).String())
+
+	// Test: What browsers would drop anyway
+	for _, c := range []*Cookie{
+		{Name: "bad name", Value: "x"},
+		{Name: "a", Value: "has space"},
+		{Name: "a", Path: "/x;Domain=evil.com"},
+		{Name: "a", SameSite: SameSiteNone},
+		{Name: "a", Partitioned: true},
+		{Name: "__Secure-a"},
+		{Name: "__Host-a", Secure: true, Path: "/", Domain: "example.com"},
+	} {
+		assert.ErrorIs(t, c.Valid(), ERROR_INVALID_COOKIE, c.Name)
+	}
+	assert.NoError(t, (&Cookie{Name: "__Host-a", Secure: true, Path: "/"}).Valid())
+}
+
+func TestSetCookieLines(t *testing.T) {
+	// Test: Set-Cookie lines aren't comma-joined, Values gives them back
+	h := NewHeaders()
+	h.Add("Set-Cookie", "a=1; Expires=Wed, 02 Jan 2030 03:04:05 GMT")
+	h.Add("set-cookie", "b=2")
+	h.Add("vary", "accept")
+	h.Add("vary", "cookie")
+	assert.Equal(t, []string{"a=1; Expires=Wed, 02 Jan 2030 03:04:05 GMT", "b=2"}, h.Values("set-cookie"))
+	assert.Equal(t, []string{"accept, cookie"}, h.Values("vary"))
+	assert.Nil(t, h.Values("missing"))
+}
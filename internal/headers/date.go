@@ -0,0 +1,33 @@
+package headers
+
+import (
+	"errors"
+	"time"
+)
+
+var ERROR_INVALID_HTTP_DATE = errors.New("Invalid HTTP-date")
+
+// RFC 9110 5.6.7: IMF-fixdate is what we send, but recipients have to accept
+// the two obsolete formats as well.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+var obsoleteDateFormats = []string{
+	"Monday, 02-Jan-06 15:04:05 GMT", // RFC 850
+	"Mon Jan _2 15:04:05 2006",       // asctime()
+}
+
+func FormatHTTPDate(t time.Time) string {
+	return t.UTC().Format(TimeFormat)
+}
+
+func ParseHTTPDate(value string) (time.Time, error) {
+	if t, err := time.Parse(TimeFormat, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range obsoleteDateFormats {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, ERROR_INVALID_HTTP_DATE
+}
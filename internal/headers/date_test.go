@@ -0,0 +1,37 @@
+package headers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPDate(t *testing.T) {
+	want := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+
+	// Test: IMF-fixdate round trip
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", FormatHTTPDate(want))
+	got, err := ParseHTTPDate("Sun, 06 Nov 1994 08:49:37 GMT")
+	require.NoError(t, err)
+	assert.True(t, want.Equal(got))
+
+	// Test: Formatting always happens in GMT
+	est := time.FixedZone("EST", -5*60*60)
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", FormatHTTPDate(want.In(est)))
+
+	// Test: Obsolete RFC 850 format
+	got, err = ParseHTTPDate("Sunday, 06-Nov-94 08:49:37 GMT")
+	require.NoError(t, err)
+	assert.True(t, want.Equal(got))
+
+	// Test: Obsolete asctime format
+	got, err = ParseHTTPDate("Sun Nov  6 08:49:37 1994")
+	require.NoError(t, err)
+	assert.True(t, want.Equal(got))
+
+	// Test: Garbage
+	_, err = ParseHTTPDate("yesterday")
+	require.ErrorIs(t, err, ERROR_INVALID_HTTP_DATE)
+}
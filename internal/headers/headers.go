@@ -24,15 +24,35 @@ func (h Headers) Set(field_name string, field_value string) {
 	h[strings.ToLower(field_name)] = field_value
 }
 
+// Add appends to a field that's already there with a comma, RFC 9110 5.3.
+// Set-Cookie is the exception, its lines are kept apart with "\n" since a
+// cookie's Expires has a comma in it. Values splits them again.
 func (h Headers) Add(field_name string, field_value string) {
 	key := strings.ToLower(field_name)
+	sep := ", "
+	if key == "set-cookie" {
+		sep = "\n"
+	}
 	if val, ok := h[key]; ok {
-		h[key] = val + ", " + field_value
+		h[key] = val + sep + field_value
 	} else {
 		h[key] = field_value
 	}
 }
 
+// Values returns a field as the separate lines it has to be sent as, which
+// is one line for everything but Set-Cookie.
+func (h Headers) Values(name string) []string {
+	v, ok := h[strings.ToLower(name)]
+	if !ok {
+		return nil
+	}
+	if strings.ToLower(name) != "set-cookie" {
+		return []string{v}
+	}
+	return strings.Split(v, "\n")
+}
+
 func (h Headers) Delete(field_name string) {
 	key := strings.ToLower(field_name)
 	delete(h, key)
@@ -53,6 +73,9 @@ func (h Headers) Parse(data []byte) (int, bool, error) { // this function should
 	if len(parts) != 2 || bytes.ContainsAny(parts[0], " \t") { // field name can't have spaces
 		return 0, false, ERROR_INVALID_FIELD_LINE
 	}
+	if bytes.ContainsAny(parts[1], "\r\n") { // a bare CR or LF would split it into two lines on the way out
+		return 0, false, ERROR_INVALID_FIELD_LINE
+	}
 
 	field_name := strings.ToLower(string(parts[0]))
 	field_value := string(bytes.TrimSpace(parts[1]))
@@ -24,3 +24,22 @@ func TestSingleHeader(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 }
+
+func TestLineBreaksInValues(t *testing.T) {
+	// Test: A bare LF or CR inside a value is rejected
+	for _, data := range []string{"X-Note: one\ntwo\r\n\r\n", "X-Note: one\rtwo\r\n\r\n"} {
+		headers := NewHeaders()
+		n, done, err := headers.Parse([]byte(data))
+		assert.ErrorIs(t, err, ERROR_INVALID_FIELD_LINE)
+		assert.Equal(t, 0, n)
+		assert.False(t, done)
+	}
+
+	// Test: Only Set-Cookie comes back as several lines
+	headers := NewHeaders()
+	headers.Set("X-Note", "one\ntwo")
+	assert.Equal(t, []string{"one\ntwo"}, headers.Values("x-note"))
+	headers.Add("Set-Cookie", "a=1")
+	headers.Add("Set-Cookie", "b=2")
+	assert.Equal(t, []string{"a=1", "b=2"}, headers.Values("Set-Cookie"))
+}
@@ -0,0 +1,227 @@
+package metrics
+
+import (
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Latency buckets in seconds, same as the Prometheus client libraries use.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// A metric family: one name, one type, a series per combination of label
+// values.
+type family struct {
+	name    string
+	help    string
+	kind    string // counter, gauge or histogram
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series // label values joined by labelSep
+}
+
+// Can't show up in label values that came in as valid UTF-8.
+const labelSep = "\xff"
+
+type series struct {
+	values []string
+	value  float64  // counters and gauges
+	counts []uint64 // histograms, per bucket and not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, labelSep)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: slices.Clone(values)}
+		if f.kind == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+type Counter struct{ f *family }
+type Gauge struct{ f *family }
+type Histogram struct{ f *family }
+
+// Add panics on a negative v, counters only go up.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counters can't go down")
+	}
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	c.f.get(labelValues).value += v
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	g.f.get(labelValues).value = v
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	g.f.get(labelValues).value += v
+}
+
+func (g *Gauge) Inc(labelValues ...string) { g.Add(1, labelValues...) }
+func (g *Gauge) Dec(labelValues ...string) { g.Add(-1, labelValues...) }
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	s := h.f.get(labelValues)
+	if i, _ := slices.BinarySearch(h.f.buckets, v); i < len(s.counts) {
+		s.counts[i]++ // the first bucket with le >= v
+	}
+	s.sum += v
+	s.count++
+}
+
+// Registry holds metrics and writes them out in the Prometheus text format.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(name, help, kind string, buckets []float64, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.families {
+		if f.name == name {
+			panic("metrics: " + name + " is already registered")
+		}
+	}
+	f := &family{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*series)}
+	r.families = append(r.families, f)
+	return f
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, "counter", nil, labels)}
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, "gauge", nil, labels)}
+}
+
+// NewHistogram uses DefaultBuckets when buckets is nil. The +Inf bucket is
+// always there, no need to pass it.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	return &Histogram{r.register(name, help, "histogram", buckets, labels)}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// labelSet renders {a="x",b="y"}, extra is appended as is (le for buckets).
+func labelSet(names, values []string, extra string) string {
+	parts := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		parts = append(parts, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if extra != "" {
+		parts = append(parts, extra)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (f *family) write(b *strings.Builder) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, helpEscaper.Replace(f.help), f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		if f.kind != "histogram" {
+			fmt.Fprintf(b, "%s%s %s\n", f.name, labelSet(f.labels, s.values, ""), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, le := range f.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, labelSet(f.labels, s.values, `le="`+formatFloat(le)+`"`), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, labelSet(f.labels, s.values, `le="+Inf"`), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", f.name, labelSet(f.labels, s.values, ""), formatFloat(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, labelSet(f.labels, s.values, ""), s.count)
+	}
+}
+
+// WriteTo writes every metric in the text exposition format, families in the
+// order they were registered.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := slices.Clone(r.families)
+	r.mu.Unlock()
+
+	var b strings.Builder
+	for _, f := range families {
+		f.write(&b)
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Serve is a handler for the scrape endpoint, mount it wherever you like.
+func (r *Registry) Serve(w *response.Writer, req *request.Request) {
+	var b strings.Builder
+	r.WriteTo(&b)
+	w.WriteStatusLine(response.StatusOK)
+	h := response.GetDefaultHeaders(0)
+	h.Set("content-type", contentType)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(b.String()))
+}
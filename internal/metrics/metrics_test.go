@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func exposition(r *Registry) string {
+	var b strings.Builder
+	r.WriteTo(&b)
+	return b.String()
+}
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("jobs_total", "Jobs done.", "queue")
+	g := r.NewGauge("temperature", "Line one\nline two.")
+	h := r.NewHistogram("latency_seconds", "How long.", []float64{1, 0.1}, "op")
+
+	// Test: Nothing observed yet, only the metadata
+	assert.Equal(t, "# HELP jobs_total Jobs done.\n# TYPE jobs_total counter\n"+
+		"# HELP temperature Line one\\nline two.\n# TYPE temperature gauge\n"+
+		"# HELP latency_seconds How long.\n# TYPE latency_seconds histogram\n", exposition(r))
+
+	// Test: Series sorted by label values, label values escaped
+	c.Inc("b")
+	c.Add(2.5, "a")
+	c.Inc(`say "hi"\`)
+	g.Set(21)
+	g.Dec()
+	out := exposition(r)
+	assert.Contains(t, out, "jobs_total{queue=\"a\"} 2.5\njobs_total{queue=\"b\"} 1\njobs_total{queue=\"say \\\"hi\\\"\\\\\"} 1\n")
+	assert.Contains(t, out, "temperature 20\n")
+
+	// Test: Histogram buckets are cumulative, sorted, and end with +Inf
+	h.Observe(0.05, "read")
+	h.Observe(0.1, "read")
+	h.Observe(0.5, "read")
+	h.Observe(3, "read")
+	assert.Contains(t, exposition(r), `latency_seconds_bucket{op="read",le="0.1"} 2
+latency_seconds_bucket{op="read",le="1"} 3
+latency_seconds_bucket{op="read",le="+Inf"} 4
+latency_seconds_sum{op="read"} 3.65
+latency_seconds_count{op="read"} 4
+`)
+
+	// Test: Wrong number of label values, a counter going down and duplicate names are bugs
+	assert.Panics(t, func() { c.Inc() })
+	assert.Panics(t, func() { c.Add(-1, "a") })
+	assert.Panics(t, func() { r.NewGauge("temperature", "again") })
+}
+
+func TestServerMetrics(t *testing.T) {
+	reg := NewRegistry()
+	m := NewServerMetrics(reg)
+	router := server.NewRouter()
+	router.Handle("POST", "/items/", func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCreated)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		w.WriteBody([]byte("created"))
+	})
+	router.Handle("GET", "/metrics", reg.Serve)
+	srv, err := server.Serve(0, server.Chain(router.Serve, m.Middleware(router.Route)), server.WithObserver(m))
+	require.NoError(t, err)
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Addr().String())
+	send := func(raw string) {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.Write([]byte(raw))
+		io.ReadAll(conn)
+	}
+
+	send("POST /items/1 HTTP/1.1\r\nHost: x\r\nContent-Length: 4\r\n\r\nbody")
+	send("POST /items/2 HTTP/1.1\r\nHost: x\r\nContent-Length: 4\r\n\r\nbody")
+	send("GET /nowhere HTTP/1.1\r\nHost: x\r\n\r\n")
+	send("BREW /items/pot HTTP/1.1\r\nHost: x\r\n\r\n")
+	send("WHATEVERYOULIKE /items/pot HTTP/1.1\r\nHost: x\r\n\r\n")
+	send("GET / HTTP/1.1\r\nbroken header\r\n\r\n")
+	send("get / HTTP/1.1\r\n\r\n")
+	send("POST / HTTP/1.1\r\nContent-Length: -1\r\n\r\n")
+
+	// Test: Requests are counted by route, not by path
+	res, err := (&client.Client{}).Get("http://127.0.0.1:" + port + "/metrics")
+	require.NoError(t, err)
+	out := string(res.Body)
+	assert.Equal(t, contentType, res.Headers.Get("content-type"))
+	assert.Contains(t, out, `http_server_requests_total{method="POST",route="/items/",status="201"} 2`)
+	assert.Contains(t, out, `http_server_requests_total{method="GET",route="",status="404"} 1`)
+	assert.Contains(t, out, `http_server_request_duration_seconds_count{method="POST",route="/items/"} 2`)
+	assert.Contains(t, out, `http_server_request_body_bytes_total{method="POST",route="/items/"} 8`)
+	assert.Contains(t, out, `http_server_response_body_bytes_total{method="POST",route="/items/"} 14`)
+
+	// Test: Made up methods share one series
+	assert.Contains(t, out, `http_server_requests_total{method="OTHER",route="/items/",status="405"} 2`)
+	assert.NotContains(t, out, "BREW")
+
+	// Test: Parse errors by type, connections accepted
+	assert.Contains(t, out, `http_server_parse_errors_total{type="header"} 1`)
+	assert.Contains(t, out, `http_server_parse_errors_total{type="request_line"} 1`)
+	assert.Contains(t, out, `http_server_parse_errors_total{type="content_length"} 1`)
+	assert.Contains(t, out, "http_server_accepted_connections_total 9\n")
+
+	// Test: Every connection is let go once its request is done
+	require.Eventually(t, func() bool {
+		return strings.Contains(exposition(reg), "http_server_active_connections 0\n")
+	}, time.Second, 5*time.Millisecond)
+}
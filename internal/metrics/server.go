@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"strconv"
+	"time"
+)
+
+// ServerMetrics is the usual set for an HTTP server. Pass it to
+// server.WithObserver for the connection side and wrap the handler in
+// Middleware for the request side.
+type ServerMetrics struct {
+	ActiveConns   *Gauge
+	AcceptedConns *Counter
+	RejectedConns *Counter
+	ParseErrors   *Counter
+	AcceptErrors  *Counter
+	Requests      *Counter
+	Duration      *Histogram
+	RequestBytes  *Counter
+	ResponseBytes *Counter
+}
+
+func NewServerMetrics(r *Registry) *ServerMetrics {
+	return &ServerMetrics{
+		ActiveConns:   r.NewGauge("http_server_active_connections", "Connections currently being served."),
+		AcceptedConns: r.NewCounter("http_server_accepted_connections_total", "Connections accepted."),
+		RejectedConns: r.NewCounter("http_server_rejected_connections_total", "Connections dropped without being served."),
+		ParseErrors:   r.NewCounter("http_server_parse_errors_total", "Requests that couldn't be parsed, by what was wrong.", "type"),
+		AcceptErrors:  r.NewCounter("http_server_accept_errors_total", "Failed accepts on the listener, temporary or fatal.", "type"),
+		Requests:      r.NewCounter("http_server_requests_total", "Requests handled.", "method", "route", "status"),
+		Duration:      r.NewHistogram("http_server_request_duration_seconds", "Time spent in the handler.", nil, "method", "route"),
+		RequestBytes:  r.NewCounter("http_server_request_body_bytes_total", "Request body bytes received.", "method", "route"),
+		ResponseBytes: r.NewCounter("http_server_response_body_bytes_total", "Response body bytes written.", "method", "route"),
+	}
+}
+
+func (m *ServerMetrics) ConnAccepted() {
+	m.AcceptedConns.Inc()
+	m.ActiveConns.Inc()
+}
+
+func (m *ServerMetrics) ConnRejected() {
+	m.RejectedConns.Inc()
+}
+
+func (m *ServerMetrics) ConnClosed() {
+	m.ActiveConns.Dec()
+}
+
+func (m *ServerMetrics) ParseError(kind string) {
+	m.ParseErrors.Inc(kind)
+}
+
+func (m *ServerMetrics) AcceptError(temporary bool) {
+	if temporary {
+		m.AcceptErrors.Inc("temporary")
+	} else {
+		m.AcceptErrors.Inc("fatal")
+	}
+}
+
+// The methods RFC 9110 and RFC 5789 define, anything else is "OTHER": the
+// parser takes any token as a method and each one would be a new series.
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+	"PATCH": true, "OPTIONS": true, "CONNECT": true, "TRACE": true,
+}
+
+func methodLabel(method string) string {
+	if knownMethods[method] {
+		return method
+	}
+	return "OTHER"
+}
+
+// Middleware records every request once its handler returns. route turns a
+// request into a label with few possible values, Router.Route for instance,
+// raw paths would make a new series per URL. nil puts everything under "".
+func (m *ServerMetrics) Middleware(route func(req *request.Request) string) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			next(w, req)
+			elapsed := time.Since(start)
+
+			method := methodLabel(req.RequestLine.Method)
+			r := ""
+			if route != nil {
+				r = route(req)
+			}
+			m.Requests.Inc(method, r, strconv.Itoa(int(w.Status())))
+			m.Duration.Observe(elapsed.Seconds(), method, r)
+			m.RequestBytes.Add(float64(len(req.Body)), method, r)
+			m.ResponseBytes.Add(float64(w.BytesWritten()), method, r)
+		}
+	}
+}
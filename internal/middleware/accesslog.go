@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type LogFormat int
+
+const (
+	CommonLog   LogFormat = iota // NCSA Common Log Format
+	CombinedLog                  // Common plus referer and user agent
+	JSONLog                      // one slog record per request, JSON unless Logger says otherwise
+)
+
+// Day/month/year the way Apache writes it.
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+type AccessLogOptions struct {
+	Format      LogFormat
+	Output      io.Writer    // where CommonLog and CombinedLog lines go, nil means os.Stdout
+	Logger      *slog.Logger // for JSONLog, nil means a JSON handler on os.Stdout
+	SampleEvery int          // log one request out of every N, 0 means all of them. Server errors are always logged
+	Skip        []string     // paths that never get logged, a trailing "/" covers everything below like in the router
+}
+
+type accessLog struct {
+	opts AccessLogOptions
+	seen atomic.Uint64
+	mu   sync.Mutex // one line at a time on Output
+}
+
+// AccessLog logs a line for every request once its handler returns, so
+// streamed and hijacked responses show up when they're over.
+func AccessLog(opts AccessLogOptions) server.Middleware {
+	if opts.Output == nil {
+		opts.Output = os.Stdout
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	}
+	l := &accessLog{opts: opts}
+	return l.wrap
+}
+
+func (l *accessLog) skipped(req *request.Request) bool {
+	path, _, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+	for _, p := range l.opts.Skip {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *accessLog) wrap(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		if l.skipped(req) {
+			next(w, req)
+			return
+		}
+		start := time.Now()
+		next(w, req)
+		duration := time.Since(start)
+
+		n := l.seen.Add(1) - 1
+		if l.opts.SampleEvery > 1 && n%uint64(l.opts.SampleEvery) != 0 && w.Status() < response.StatusInternalServerError {
+			return
+		}
+		l.log(w, req, start, duration)
+	}
+}
+
+func remoteHost(req *request.Request) string {
+	if req.ClientIP != "" {
+		return req.ClientIP
+	}
+	addr := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	if addr == "" {
+		return "-"
+	}
+	return addr
+}
+
+// orDash is how CLF writes a missing field.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (l *accessLog) log(w *response.Writer, req *request.Request, start time.Time, duration time.Duration) {
+	rl := req.RequestLine
+	proto := "HTTP/" + rl.HttpVersion
+	if l.opts.Format == JSONLog {
+		attrs := []slog.Attr{
+			slog.String("remote_addr", req.RemoteAddr),
+			slog.String("client_ip", req.ClientIP),
+			slog.String("method", rl.Method),
+			slog.String("target", rl.RequestTarget),
+			slog.String("proto", proto),
+			slog.Int("status", int(w.Status())),
+			slog.Int64("bytes", w.BytesWritten()),
+			slog.Duration("duration", duration),
+			slog.String("user_agent", req.Headers.Get("user-agent")),
+		}
+		if id := req.Headers.Get(RequestIDHeader); id != "" { // RequestID puts it there when it makes one up
+			attrs = append(attrs, slog.String("request_id", id))
+		}
+		l.opts.Logger.LogAttrs(req.Context(), slog.LevelInfo, "request", attrs...)
+		return
+	}
+
+	size := "-"
+	if n := w.BytesWritten(); n > 0 {
+		size = strconv.FormatInt(n, 10)
+	}
+	line := fmt.Sprintf("%s - - [%s] %s %d %s",
+		remoteHost(req),
+		start.Format(clfTime),
+		strconv.Quote(rl.Method+" "+rl.RequestTarget+" "+proto),
+		w.Status(),
+		size,
+	)
+	if l.opts.Format == CombinedLog {
+		line += " " + strconv.Quote(orDash(req.Headers.Get("referer"))) + " " + strconv.Quote(orDash(req.Headers.Get("user-agent")))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintln(l.opts.Output, line)
+}
@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func hello(w *response.Writer, req *request.Request) {
+	code := response.StatusOK
+	if req.RequestLine.RequestTarget == "/broken" {
+		code = response.StatusInternalServerError
+	}
+	w.WriteStatusLine(code)
+	w.WriteHeaders(response.GetDefaultHeaders(0))
+	w.WriteBody([]byte("hello"))
+}
+
+// do sends raw to h behind a real server and waits for the whole answer.
+func do(t *testing.T, h server.Handler, raw string) {
+	srv, err := server.Serve(0, h)
+	require.NoError(t, err)
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Addr().String())
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte(raw))
+	io.ReadAll(conn)
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	var out bytes.Buffer
+	raw := "GET /apache_pb.gif?x=1 HTTP/1.1\r\nHost: x\r\nReferer: http://example.com/\r\nUser-Agent: curl/8.0\r\n\r\n"
+
+	// Test: Common Log Format
+	do(t, server.Chain(hello, AccessLog(AccessLogOptions{Output: &out})), raw)
+	line := out.String()
+	assert.Regexp(t, `^127\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /apache_pb.gif\?x=1 HTTP/1.1" 200 5\n$`, line)
+
+	// Test: Combined adds referer and user agent
+	out.Reset()
+	do(t, server.Chain(hello, AccessLog(AccessLogOptions{Format: CombinedLog, Output: &out})), raw)
+	assert.True(t, strings.HasSuffix(out.String(), `" 200 5 "http://example.com/" "curl/8.0"`+"\n"), out.String())
+
+	// Test: Missing fields become dashes, quotes in them get escaped
+	out.Reset()
+	do(t, server.Chain(hello, AccessLog(AccessLogOptions{Format: CombinedLog, Output: &out})), "HEAD / HTTP/1.1\r\nHost: x\r\nUser-Agent: say \"hi\"\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out.String(), `" 200 5 "-" "say \"hi\""`+"\n"), out.String())
+
+	// Test: JSON through slog
+	out.Reset()
+	logger := slog.New(slog.NewJSONHandler(&out, nil))
+	do(t, server.Chain(hello, AccessLog(AccessLogOptions{Format: JSONLog, Logger: logger})), raw)
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &record))
+	assert.Equal(t, "request", record["msg"])
+	assert.Equal(t, "GET", record["method"])
+	assert.Equal(t, "/apache_pb.gif?x=1", record["target"])
+	assert.Equal(t, "HTTP/1.1", record["proto"])
+	assert.Equal(t, float64(200), record["status"])
+	assert.Equal(t, float64(5), record["bytes"])
+	assert.Equal(t, "curl/8.0", record["user_agent"])
+	assert.Contains(t, record["remote_addr"], "127.0.0.1:")
+	assert.Contains(t, record, "duration")
+}
+
+func TestAccessLogFiltering(t *testing.T) {
+	var out bytes.Buffer
+
+	// Test: Skipped routes stay out of the log, with or without a query
+	h := server.Chain(hello, AccessLog(AccessLogOptions{Output: &out, Skip: []string{"/healthz", "/static/"}}))
+	do(t, h, "GET /healthz HTTP/1.1\r\nHost: x\r\n\r\n")
+	do(t, h, "GET /healthz?verbose HTTP/1.1\r\nHost: x\r\n\r\n")
+	do(t, h, "GET /static/app.js HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Empty(t, out.String())
+	do(t, h, "GET /healthzz HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, 1, strings.Count(out.String(), "\n"))
+
+	// Test: Sampling keeps one in N, but never drops a server error
+	out.Reset()
+	h = server.Chain(hello, AccessLog(AccessLogOptions{Output: &out, SampleEvery: 3}))
+	for i := 0; i < 6; i++ {
+		do(t, h, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	}
+	assert.Equal(t, 2, strings.Count(out.String(), "\n"))
+	do(t, h, "GET /broken HTTP/1.1\r\nHost: x\r\n\r\n")
+	do(t, h, "GET /broken HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, 4, strings.Count(out.String(), "\n"))
+}
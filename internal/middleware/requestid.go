@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+const RequestIDHeader = "x-request-id"
+
+// Longer incoming IDs get replaced, they only end up in logs and headers.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// RequestIDFrom returns the ID RequestID put in ctx, "" if there's none.
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e { // visible ASCII only
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestID keeps the client's X-Request-ID or makes one up, then puts it in
+// the request context, the request headers (so a proxy passes it on) and the
+// response.
+func RequestID(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		id := req.Headers.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			req.Headers.Set(RequestIDHeader, id)
+		}
+		w.SetDefaultHeader(RequestIDHeader, id)
+		next(w, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+	}
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen, forwarded string
+	h := RequestID(func(w *response.Writer, req *request.Request) {
+		seen = RequestIDFrom(req.Context())
+		forwarded = req.Headers.Get("x-request-id")
+		hello(w, req)
+	})
+	srv, err := server.Serve(0, h)
+	require.NoError(t, err)
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Addr().String())
+	c := &client.Client{MaxIdlePerHost: -1}
+	get := func(id string) *client.Response {
+		req, _ := client.NewRequest("GET", "http://127.0.0.1:"+port+"/", nil)
+		if id != "" {
+			req.Headers.Set("X-Request-ID", id)
+		}
+		res, err := c.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+
+	// Test: The client's ID is kept and echoed
+	res := get("abc-123")
+	assert.Equal(t, "abc-123", res.Headers.Get("x-request-id"))
+	assert.Equal(t, "abc-123", seen)
+
+	// Test: Without one a fresh ID goes everywhere
+	res = get("")
+	assert.Len(t, seen, 32)
+	assert.Equal(t, seen, res.Headers.Get("x-request-id"))
+	assert.Equal(t, seen, forwarded)
+	first := seen
+	get("")
+	assert.NotEqual(t, first, seen)
+
+	// Test: Junk gets replaced
+	res = get("has spaces")
+	assert.NotEqual(t, "has spaces", res.Headers.Get("x-request-id"))
+	assert.Len(t, seen, 32)
+
+	// Test: No ID outside the middleware
+	assert.Equal(t, "", RequestIDFrom((&request.Request{}).Context()))
+}
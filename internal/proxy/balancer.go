@@ -0,0 +1,309 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"hash/crc32"
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ERROR_NO_BACKENDS = errors.New("A balancer needs at least one backend")
+
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultMaxFails            = 3
+	DefaultEjectTime           = 30 * time.Second
+	DefaultRetries             = 2
+)
+
+// Points per backend on the hash ring, more of them spread the keys evenly.
+const ringReplicas = 128
+
+type Strategy int
+
+const (
+	RoundRobin Strategy = iota
+	LeastConnections
+	ConsistentHash // the same key keeps landing on the same backend while it's up
+)
+
+type BalancerOptions struct {
+	Strategy            Strategy
+	HashKey             func(req *request.Request) string // for ConsistentHash, nil means req.ClientIP
+	HealthCheckPath     string                            // GET this on every backend periodically, empty turns active checks off
+	HealthCheckInterval time.Duration                     // 0 means DefaultHealthCheckInterval
+	MaxFails            int                               // consecutive failures before a backend is ejected, 0 means DefaultMaxFails
+	EjectTime           time.Duration                     // how long an ejected backend sits out, 0 means DefaultEjectTime
+	Retries             int                               // other backends to try for idempotent requests, 0 means DefaultRetries, negative means none
+	StripPrefix         string
+	Dialer              Dialer
+	TLSConfig           *tls.Config
+	Timeout             time.Duration // 0 means DefaultUpstreamTimeout
+	MaxIdlePerBackend   int           // pooled connections per backend, 0 means the client's default
+}
+
+type backend struct {
+	url    *url.URL
+	client *client.Client // every backend has its own pool
+	active atomic.Int64   // requests in flight
+	up     atomic.Bool    // what the last health check said
+
+	mu           sync.Mutex
+	fails        int
+	ejectedUntil time.Time
+}
+
+func (b *backend) available(now time.Time) bool {
+	if !b.up.Load() {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !now.Before(b.ejectedUntil)
+}
+
+type ringPoint struct {
+	hash    uint32
+	backend *backend
+}
+
+// Balancer is a server.Handler that spreads requests over several backends,
+// taking the ones that fail out of rotation for a while.
+type Balancer struct {
+	backends []*backend
+	ring     []ringPoint
+	opts     BalancerOptions
+	next     atomic.Uint64
+	done     chan struct{}
+	once     sync.Once
+}
+
+func NewBalancer(urls []string, opts BalancerOptions) (*Balancer, error) {
+	if len(urls) == 0 {
+		return nil, ERROR_NO_BACKENDS
+	}
+	if opts.MaxFails <= 0 {
+		opts.MaxFails = DefaultMaxFails
+	}
+	if opts.EjectTime <= 0 {
+		opts.EjectTime = DefaultEjectTime
+	}
+	if opts.Retries == 0 {
+		opts.Retries = DefaultRetries
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultUpstreamTimeout
+	}
+	if opts.HealthCheckInterval <= 0 {
+		opts.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+
+	lb := &Balancer{opts: opts, done: make(chan struct{})}
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, client.ERROR_UNSUPPORTED_URL
+		}
+		b := &backend{
+			url: u,
+			client: &client.Client{
+				Dialer:         opts.Dialer,
+				TLSConfig:      opts.TLSConfig,
+				Timeout:        opts.Timeout,
+				MaxIdlePerHost: opts.MaxIdlePerBackend,
+				MaxRedirects:   -1,
+			},
+		}
+		b.up.Store(true)
+		lb.backends = append(lb.backends, b)
+		for i := 0; i < ringReplicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(raw + "#" + strconv.Itoa(i)))
+			lb.ring = append(lb.ring, ringPoint{hash: h, backend: b})
+		}
+	}
+	slices.SortFunc(lb.ring, func(a, b ringPoint) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+
+	if opts.HealthCheckPath != "" {
+		go lb.healthCheckLoop()
+	}
+	return lb, nil
+}
+
+// Close stops the health checks and drops the pooled connections.
+func (lb *Balancer) Close() {
+	lb.once.Do(func() { close(lb.done) })
+	for _, b := range lb.backends {
+		b.client.CloseIdleConnections()
+	}
+}
+
+func (lb *Balancer) healthCheckLoop() {
+	ticker := time.NewTicker(lb.opts.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		lb.checkAll()
+		select {
+		case <-lb.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (lb *Balancer) checkAll() {
+	var wg sync.WaitGroup
+	for _, b := range lb.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			target, ok := upstreamPath(b.url, lb.opts.HealthCheckPath, "")
+			if !ok {
+				b.up.Store(false)
+				return
+			}
+			res, err := b.client.Get(b.url.Scheme + "://" + b.url.Host + target)
+			b.up.Store(err == nil && res.StatusLine.StatusCode >= 200 && res.StatusLine.StatusCode < 400)
+		}()
+	}
+	wg.Wait()
+}
+
+// failed counts a failure against b, ejecting it once there are enough in a
+// row.
+func (lb *Balancer) failed(b *backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fails++
+	if b.fails >= lb.opts.MaxFails {
+		b.ejectedUntil = time.Now().Add(lb.opts.EjectTime)
+		b.fails = 0
+	}
+}
+
+func (lb *Balancer) succeeded(b *backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fails = 0
+}
+
+// pick returns an available backend that isn't in tried, nil when there's none
+// left.
+func (lb *Balancer) pick(req *request.Request, tried map[*backend]bool) *backend {
+	now := time.Now()
+	usable := func(b *backend) bool {
+		return !tried[b] && b.available(now)
+	}
+
+	switch lb.opts.Strategy {
+	case ConsistentHash:
+		key := req.ClientIP
+		if key == "" {
+			key = clientIP(req.RemoteAddr)
+		}
+		if lb.opts.HashKey != nil {
+			key = lb.opts.HashKey(req)
+		}
+		h := crc32.ChecksumIEEE([]byte(key))
+		start, _ := slices.BinarySearchFunc(lb.ring, h, func(p ringPoint, h uint32) int {
+			return cmp.Compare(p.hash, h)
+		})
+		// walk clockwise, so a dead backend's keys move to its neighbour only
+		for i := range lb.ring {
+			p := lb.ring[(start+i)%len(lb.ring)]
+			if usable(p.backend) {
+				return p.backend
+			}
+		}
+		return nil
+
+	case LeastConnections:
+		var best *backend
+		offset := int(lb.next.Add(1) % uint64(len(lb.backends))) // ties go round-robin
+		for i := range lb.backends {
+			b := lb.backends[(offset+i)%len(lb.backends)]
+			if usable(b) && (best == nil || b.active.Load() < best.active.Load()) {
+				best = b
+			}
+		}
+		return best
+
+	default:
+		offset := int((lb.next.Add(1) - 1) % uint64(len(lb.backends)))
+		for i := range lb.backends {
+			b := lb.backends[(offset+i)%len(lb.backends)]
+			if usable(b) {
+				return b
+			}
+		}
+		return nil
+	}
+}
+
+func (lb *Balancer) Serve(w *response.Writer, req *request.Request) {
+	attempts := 1
+	if lb.opts.Retries > 0 && client.Idempotent(req.RequestLine.Method) {
+		attempts += lb.opts.Retries
+	}
+
+	tried := make(map[*backend]bool)
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		b := lb.pick(req, tried)
+		if b == nil {
+			break
+		}
+		tried[b] = true
+
+		path, ok := upstreamPath(b.url, req.RequestLine.RequestTarget, lb.opts.StripPrefix)
+		if !ok {
+			writeError(w, response.StatusBadRequest, nil)
+			return
+		}
+		up, err := upstreamRequest(b.url, path, req)
+		if err != nil {
+			writeError(w, response.StatusBadRequest, nil)
+			return
+		}
+
+		b.active.Add(1)
+		res, err := b.client.Stream(up)
+		if err != nil {
+			b.active.Add(-1)
+			if req.Context().Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return // the client left, that's not the backend's fault and nobody wants a retry
+			}
+			lb.failed(b)
+			lastErr = err
+			continue // nothing reached the client yet, so another backend can have a go
+		}
+
+		switch res.StatusLine.StatusCode {
+		case response.StatusBadGateway, response.StatusServiceUnavailable, response.StatusGatewayTimeout:
+			lb.failed(b)
+		default:
+			lb.succeeded(b)
+		}
+		copyResponse(w, req, res, false)
+		res.Close()
+		b.active.Add(-1)
+		return
+	}
+
+	if lastErr != nil {
+		gatewayError(w, lastErr)
+		return
+	}
+	writeError(w, response.StatusServiceUnavailable, nil)
+}
@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// backendServer answers with its name, or with handler when one is given.
+func backendServer(t *testing.T, name string, handler server.Handler) string {
+	if handler == nil {
+		handler = func(w *response.Writer, req *request.Request) {
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.GetDefaultHeaders(0))
+			w.WriteBody([]byte(name))
+		}
+	}
+	srv, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	_, port, _ := net.SplitHostPort(srv.Addr().String())
+	return "http://127.0.0.1:" + port
+}
+
+// deadBackend is an address nothing listens on.
+func deadBackend(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	return "http://" + addr
+}
+
+func newBalancer(t *testing.T, urls []string, opts BalancerOptions) *Balancer {
+	lb, err := NewBalancer(urls, opts)
+	require.NoError(t, err)
+	t.Cleanup(lb.Close)
+	return lb
+}
+
+// send sends one request through h and returns the status line and body.
+func send(t *testing.T, h server.Handler, raw string) (string, string) {
+	srv, err := server.Serve(0, h)
+	require.NoError(t, err)
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Addr().String())
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte(raw))
+	res, err := client.ResponseFromReader(conn, strings.Fields(raw)[0])
+	require.NoError(t, err)
+	sl := res.StatusLine
+	return fmt.Sprintf("HTTP/%s %d %s", sl.HttpVersion, sl.StatusCode, sl.ReasonPhrase), string(res.Body)
+}
+
+func TestRoundRobin(t *testing.T) {
+	a := backendServer(t, "a", nil)
+	b := backendServer(t, "b", nil)
+	c := backendServer(t, "c", nil)
+	lb := newBalancer(t, []string{a, b, c}, BalancerOptions{})
+
+	// Test: Every backend gets its turn
+	var got []string
+	for i := 0; i < 6; i++ {
+		_, name := send(t, lb.Serve, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+		got = append(got, name)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, got)
+
+	// Test: No backends is a configuration error
+	_, err := NewBalancer(nil, BalancerOptions{})
+	require.ErrorIs(t, err, ERROR_NO_BACKENDS)
+}
+
+func TestLeastConnections(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := backendServer(t, "slow", func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/hold" {
+			close(started)
+			<-release
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		w.WriteBody([]byte("slow"))
+	})
+	fast := backendServer(t, "fast", nil)
+	lb := newBalancer(t, []string{slow, fast}, BalancerOptions{Strategy: LeastConnections})
+
+	// Test: While slow is busy everything goes to fast
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, name := send(t, lb.Serve, "GET /hold HTTP/1.1\r\nHost: x\r\n\r\n"); name == "slow" {
+				return
+			}
+		}
+	}()
+	<-started
+	for i := 0; i < 4; i++ {
+		_, name := send(t, lb.Serve, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+		assert.Equal(t, "fast", name)
+	}
+	close(release)
+	<-done
+}
+
+func TestConsistentHash(t *testing.T) {
+	urls := []string{backendServer(t, "a", nil), backendServer(t, "b", nil), backendServer(t, "c", nil)}
+	opts := BalancerOptions{
+		Strategy: ConsistentHash,
+		HashKey:  func(req *request.Request) string { return req.Headers.Get("x-user") },
+	}
+	lb := newBalancer(t, urls, opts)
+	users := []string{"ann", "bob", "cid", "dee", "eve", "fay", "gus", "hal"}
+
+	// Test: The same key always lands on the same backend
+	placement := make(map[string]string)
+	for _, u := range users {
+		_, placement[u] = send(t, lb.Serve, "GET / HTTP/1.1\r\nHost: x\r\nX-User: "+u+"\r\n\r\n")
+		_, again := send(t, lb.Serve, "GET / HTTP/1.1\r\nHost: x\r\nX-User: "+u+"\r\n\r\n")
+		assert.Equal(t, placement[u], again)
+	}
+
+	// Test: Losing a backend only moves the keys it had
+	lost := placement[users[0]]
+	names := map[string]string{"a": urls[0], "b": urls[1], "c": urls[2]}
+	names[lost] = deadBackend(t)
+	lb = newBalancer(t, []string{names["a"], names["b"], names["c"]}, opts)
+	for _, u := range users {
+		_, name := send(t, lb.Serve, "GET / HTTP/1.1\r\nHost: x\r\nX-User: "+u+"\r\n\r\n")
+		if placement[u] != lost {
+			assert.Equal(t, placement[u], name, u)
+		} else {
+			assert.NotEqual(t, lost, name, u)
+		}
+	}
+}
+
+func TestPassiveEjectionAndRetries(t *testing.T) {
+	dead := deadBackend(t)
+	alive := backendServer(t, "alive", nil)
+	lb := newBalancer(t, []string{dead, alive}, BalancerOptions{MaxFails: 2, EjectTime: time.Minute})
+
+	// Test: A POST isn't retried
+	status, _ := send(t, lb.Serve, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 502 Bad Gateway", status)
+
+	// Test: A GET that hits the dead backend moves on to the live one
+	_, name := send(t, lb.Serve, "GET / HTTP/1.1\r\nHost: x\r\n\r\n") // alive's turn anyway
+	assert.Equal(t, "alive", name)
+	_, name = send(t, lb.Serve, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, "alive", name)
+
+	// Test: After two failures in a row the dead one is out, even for POSTs
+	for i := 0; i < 4; i++ {
+		status, _ := send(t, lb.Serve, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\n\r\n")
+		assert.Equal(t, "HTTP/1.1 200 OK", status)
+	}
+
+	// Test: Nothing left to try
+	lb = newBalancer(t, []string{dead}, BalancerOptions{MaxFails: 1})
+	status, _ = send(t, lb.Serve, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 502 Bad Gateway", status)
+	status, _ = send(t, lb.Serve, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 503 Service Unavailable", status)
+}
+
+func TestClientGoesAway(t *testing.T) {
+	var hits atomic.Int64
+	slow := func(w *response.Writer, req *request.Request) {
+		hits.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}
+	a, b := backendServer(t, "a", slow), backendServer(t, "b", slow)
+	lb := newBalancer(t, []string{a, b}, BalancerOptions{MaxFails: 1, EjectTime: time.Minute})
+
+	// Test: A client hanging up neither ejects the backend nor gets retried
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	lb.Serve(response.NewWriter(), req.WithContext(ctx))
+	assert.Equal(t, int64(1), hits.Load())
+	now := time.Now()
+	for _, backend := range lb.backends {
+		assert.True(t, backend.available(now))
+	}
+}
+
+func TestActiveHealthChecks(t *testing.T) {
+	sick := backendServer(t, "sick", func(w *response.Writer, req *request.Request) {
+		code := response.StatusOK
+		if strings.HasPrefix(req.RequestLine.RequestTarget, "/healthz") {
+			code = response.StatusServiceUnavailable
+		}
+		w.WriteStatusLine(code)
+		h := headers.NewHeaders()
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("sick"))
+	})
+	well := backendServer(t, "well", nil)
+	lb := newBalancer(t, []string{sick, well}, BalancerOptions{
+		HealthCheckPath:     "/healthz",
+		HealthCheckInterval: 10 * time.Millisecond,
+	})
+
+	// Test: The backend failing its health check gets no traffic
+	require.Eventually(t, func() bool { return !lb.backends[0].up.Load() }, time.Second, 5*time.Millisecond)
+	for i := 0; i < 4; i++ {
+		_, name := send(t, lb.Serve, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+		assert.Equal(t, "well", name)
+	}
+}
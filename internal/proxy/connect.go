@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultDialTimeout = 10 * time.Second
+	DefaultIdleTimeout = 5 * time.Minute
+)
+
+// Dialer opens the upstream side of a tunnel, *net.Dialer is one.
+type Dialer interface {
+	Dial(network string, address string) (net.Conn, error)
+}
+
+// Resolver looks up the addresses of a tunnel's target, *net.Resolver is one.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Tunnel is a server.Handler for CONNECT, the way browsers talk HTTPS through
+// a forward proxy. Host lists take exact names, "*.example.com" for every
+// subdomain, IP literals and CIDRs. Deny always wins over allow, and an empty
+// allow list means anything not denied.
+//
+// Names are resolved before the lists are checked: IPs and CIDRs apply to
+// every address a name has, so a name pointing into a denied range is denied
+// too. The tunnel then dials the addresses it checked, not the name, or DNS
+// could hand out a different one in between.
+type Tunnel struct {
+	Dialer      Dialer        // nil means a net.Dialer with DefaultDialTimeout
+	Resolver    Resolver      // nil means net.DefaultResolver
+	IdleTimeout time.Duration // tunnel closes after this long without traffic, 0 means DefaultIdleTimeout
+	AllowHosts  []string
+	DenyHosts   []string
+	AllowPorts  []int
+	DenyPorts   []int
+}
+
+func matchHost(host string, patterns []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		switch {
+		case strings.Contains(p, "/"):
+			if _, cidr, err := net.ParseCIDR(p); err == nil && ip != nil && cidr.Contains(ip) {
+				return true
+			}
+		case strings.HasPrefix(p, "*."):
+			if strings.HasSuffix(host, p[1:]) {
+				return true
+			}
+		case ip != nil:
+			if pip := net.ParseIP(p); pip != nil && pip.Equal(ip) {
+				return true
+			}
+		case host == p:
+			return true
+		}
+	}
+	return false
+}
+
+func matchPort(port int, ports []int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Tunnel) allowed(host string, ips []net.IP, port int) bool {
+	if matchHost(host, t.DenyHosts) || matchPort(port, t.DenyPorts) {
+		return false
+	}
+	for _, ip := range ips {
+		if matchHost(ip.String(), t.DenyHosts) {
+			return false
+		}
+	}
+	if len(t.AllowPorts) > 0 && !matchPort(port, t.AllowPorts) {
+		return false
+	}
+	if len(t.AllowHosts) > 0 && !matchHost(host, t.AllowHosts) {
+		// a name that isn't allowed itself still is if all its addresses are
+		if len(ips) == 0 {
+			return false
+		}
+		for _, ip := range ips {
+			if !matchHost(ip.String(), t.AllowHosts) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (t *Tunnel) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	resolver := t.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(ctx, DefaultDialTimeout)
+	defer cancel()
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+// dial tries the addresses in order, the first that connects wins.
+func (t *Tunnel) dial(ips []net.IP, port string) (net.Conn, error) {
+	var dialer Dialer = &net.Dialer{Timeout: DefaultDialTimeout}
+	if t.Dialer != nil {
+		dialer = t.Dialer
+	}
+	var lastErr error = &net.AddrError{Err: "no addresses to dial"}
+	for _, ip := range ips {
+		conn, err := dialer.Dial("tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// upstreamError is 504 for timeouts and 502 for anything else.
+func upstreamError(w *response.Writer, err error) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		writeError(w, response.StatusGatewayTimeout, nil)
+	} else {
+		writeError(w, response.StatusBadGateway, nil)
+	}
+}
+
+func writeError(w *response.Writer, code response.StatusCode, extra headers.Headers) {
+	w.WriteStatusLine(code)
+	h := response.GetDefaultHeaders(0)
+	for k, v := range extra {
+		h.Set(k, v)
+	}
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(code.String()))
+}
+
+func (t *Tunnel) Serve(w *response.Writer, req *request.Request) {
+	if req.RequestLine.Method != "CONNECT" {
+		writeError(w, response.StatusMethodNotAllowed, headers.Headers{"allow": "CONNECT"})
+		return
+	}
+
+	host, portStr, err := net.SplitHostPort(req.RequestLine.RequestTarget)
+	port, _ := strconv.Atoi(portStr)
+	if err != nil || port == 0 {
+		writeError(w, response.StatusBadRequest, nil)
+		return
+	}
+	ips, err := t.resolve(req.Context(), host)
+	if err != nil {
+		upstreamError(w, err)
+		return
+	}
+	if !t.allowed(host, ips, port) {
+		writeError(w, response.StatusForbidden, nil)
+		return
+	}
+
+	upstream, err := t.dial(ips, portStr)
+	if err != nil {
+		upstreamError(w, err)
+		return
+	}
+
+	client, buffered, err := w.Hijack()
+	if err != nil {
+		upstream.Close()
+		writeError(w, response.StatusInternalServerError, nil)
+		return
+	}
+
+	// RFC 9110 9.3.6: no Content-Length or Transfer-Encoding on this one, the
+	// tunnel starts right after the blank line
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+	if len(buffered) > 0 { // the client didn't wait for our answer
+		if _, err := upstream.Write(buffered); err != nil {
+			client.Close()
+			upstream.Close()
+			return
+		}
+	}
+
+	idle := t.IdleTimeout
+	if idle <= 0 {
+		idle = DefaultIdleTimeout
+	}
+	pipe(client, upstream, idle)
+}
+
+// pipe copies both ways until both sides are done, or nothing moved in either
+// direction for idle.
+func pipe(a net.Conn, b net.Conn, idle time.Duration) {
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	var wg sync.WaitGroup
+	copyHalf := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+		buf := make([]byte, 32*1024)
+		for {
+			src.SetReadDeadline(time.Now().Add(idle))
+			n, err := src.Read(buf)
+			if n > 0 {
+				lastActive.Store(time.Now().UnixNano())
+				dst.SetWriteDeadline(time.Now().Add(idle))
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					break
+				}
+			}
+			if err != nil {
+				var netErr net.Error
+				quiet := time.Since(time.Unix(0, lastActive.Load()))
+				if errors.As(err, &netErr) && netErr.Timeout() && quiet < idle {
+					continue // only this direction is quiet, the other one is busy
+				}
+				break
+			}
+		}
+		// pass the EOF along but let the other direction finish
+		if tcp, ok := dst.(interface{ CloseWrite() error }); ok {
+			tcp.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+
+	wg.Add(2)
+	go copyHalf(b, a)
+	go copyHalf(a, b)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
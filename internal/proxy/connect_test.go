@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"httpfromtcp/internal/proxyproto"
+	"httpfromtcp/internal/server"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func startProxy(t *testing.T, tunnel *Tunnel) net.Conn {
+	srv, err := server.Serve(0, tunnel.Serve)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func statusLine(t *testing.T, br *bufio.Reader) string {
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	return strings.TrimSpace(line)
+}
+
+type failingDialer struct{ err error }
+
+func (d failingDialer) Dial(network string, address string) (net.Conn, error) {
+	return nil, d.err
+}
+
+// fakeDNS maps names to addresses, anything else doesn't exist.
+type fakeDNS map[string][]string
+
+func (d fakeDNS) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	var addrs []net.IPAddr
+	for _, a := range d[host] {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(a)})
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// recordingDialer remembers what it was asked to dial.
+type recordingDialer struct{ addresses []string }
+
+func (d *recordingDialer) Dial(network string, address string) (net.Conn, error) {
+	d.addresses = append(d.addresses, address)
+	return net.Dial(network, address)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestTunnel(t *testing.T) {
+	upstream := echoServer(t)
+	_, port, _ := net.SplitHostPort(upstream.Addr().String())
+
+	// Test: Bytes flow both ways, including the ones sent before our answer
+	conn := startProxy(t, &Tunnel{})
+	_, err := conn.Write([]byte("CONNECT " + upstream.Addr().String() + " HTTP/1.1\r\nHost: x\r\n\r\nearly "))
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	assert.Equal(t, "HTTP/1.1 200 Connection Established", statusLine(t, br))
+	assert.Equal(t, "", statusLine(t, br))
+	conn.Write([]byte("bird"))
+	got := make([]byte, len("early bird"))
+	_, err = io.ReadFull(br, got)
+	require.NoError(t, err)
+	assert.Equal(t, "early bird", string(got))
+
+	// Test: Denied host
+	conn = startProxy(t, &Tunnel{DenyHosts: []string{"127.0.0.0/8"}})
+	conn.Write([]byte("CONNECT " + upstream.Addr().String() + " HTTP/1.1\r\n\r\n"))
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", statusLine(t, bufio.NewReader(conn)))
+
+	// Test: Port not on the allow list
+	conn = startProxy(t, &Tunnel{AllowPorts: []int{443}})
+	conn.Write([]byte("CONNECT 127.0.0.1:" + port + " HTTP/1.1\r\n\r\n"))
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", statusLine(t, bufio.NewReader(conn)))
+
+	// Test: Upstream refuses
+	dns := fakeDNS{"example.com": {"93.184.215.14"}, "evil.example": {"203.0.113.7", "127.0.0.1"}, "local.example": {"127.0.0.1"}}
+	conn = startProxy(t, &Tunnel{Resolver: dns, Dialer: failingDialer{errors.New("connection refused")}})
+	conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\n\r\n"))
+	assert.Equal(t, "HTTP/1.1 502 Bad Gateway", statusLine(t, bufio.NewReader(conn)))
+
+	// Test: Upstream times out
+	conn = startProxy(t, &Tunnel{Resolver: dns, Dialer: failingDialer{timeoutError{}}})
+	conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\n\r\n"))
+	assert.Equal(t, "HTTP/1.1 504 Gateway Timeout", statusLine(t, bufio.NewReader(conn)))
+
+	// Test: A name that resolves into a denied range is denied, whatever else it resolves to
+	conn = startProxy(t, &Tunnel{Resolver: dns, DenyHosts: []string{"127.0.0.0/8"}})
+	conn.Write([]byte("CONNECT evil.example:" + port + " HTTP/1.1\r\n\r\n"))
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", statusLine(t, bufio.NewReader(conn)))
+
+	// Test: CIDR allow lists need every address of a name to be in them
+	conn = startProxy(t, &Tunnel{Resolver: dns, AllowHosts: []string{"127.0.0.0/8"}})
+	conn.Write([]byte("CONNECT evil.example:" + port + " HTTP/1.1\r\n\r\n"))
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", statusLine(t, bufio.NewReader(conn)))
+
+	// Test: The address that was checked is what gets dialed, not the name
+	dialer := &recordingDialer{}
+	conn = startProxy(t, &Tunnel{Resolver: dns, Dialer: dialer, AllowHosts: []string{"127.0.0.0/8"}})
+	conn.Write([]byte("CONNECT local.example:" + port + " HTTP/1.1\r\n\r\n"))
+	assert.Equal(t, "HTTP/1.1 200 Connection Established", statusLine(t, bufio.NewReader(conn)))
+	assert.Equal(t, []string{"127.0.0.1:" + port}, dialer.addresses)
+
+	// Test: Names that don't resolve
+	conn = startProxy(t, &Tunnel{Resolver: dns})
+	conn.Write([]byte("CONNECT nowhere.example:443 HTTP/1.1\r\n\r\n"))
+	assert.Equal(t, "HTTP/1.1 502 Bad Gateway", statusLine(t, bufio.NewReader(conn)))
+
+	// Test: Not a CONNECT
+	conn = startProxy(t, &Tunnel{})
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	assert.Equal(t, "HTTP/1.1 405 Method Not Allowed", statusLine(t, bufio.NewReader(conn)))
+}
+
+func TestTunnelHalfClose(t *testing.T) {
+	// upstream reads until EOF and answers with what it got, or with "hello"
+	// and a half-close first when asked to
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	got := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				first, _ := br.ReadString('\n')
+				if first == "hello first\n" {
+					conn.Write([]byte("hello"))
+					conn.(*net.TCPConn).CloseWrite()
+				}
+				rest, _ := io.ReadAll(br)
+				got <- string(rest)
+				conn.Write([]byte("got " + first + string(rest)))
+			}()
+		}
+	}()
+
+	// behind a load balancer, the tunnel's client side is a *proxyproto.Conn
+	srv, err := server.Serve(0, (&Tunnel{}).Serve, server.WithProxyProtocol(proxyproto.Options{
+		Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")},
+	}))
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	open := func() (*net.TCPConn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", srv.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		conn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 5555 443\r\nCONNECT " + l.Addr().String() + " HTTP/1.1\r\n\r\n"))
+		br := bufio.NewReader(conn)
+		assert.Equal(t, "HTTP/1.1 200 Connection Established", statusLine(t, br))
+		assert.Equal(t, "", statusLine(t, br))
+		return conn.(*net.TCPConn), br
+	}
+
+	// Test: The client half-closes first and still gets the answer
+	conn, br := open()
+	conn.Write([]byte("ping\nmore"))
+	conn.CloseWrite()
+	answer, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "got ping\nmore", string(answer))
+	<-got
+
+	// Test: Upstream half-closes first and what the client sends after still arrives
+	conn, br = open()
+	conn.Write([]byte("hello first\n"))
+	hello := make([]byte, 5)
+	_, err = io.ReadFull(br, hello)
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond) // give the EOF time to reach the proxy
+	conn.Write([]byte("late"))
+	conn.CloseWrite()
+	select {
+	case rest := <-got:
+		assert.Equal(t, "late", rest)
+	case <-time.After(time.Second):
+		t.Fatal("upstream never saw the client finish")
+	}
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	upstream := echoServer(t)
+
+	// Test: A quiet tunnel gets closed
+	conn := startProxy(t, &Tunnel{IdleTimeout: 50 * time.Millisecond})
+	conn.Write([]byte("CONNECT " + upstream.Addr().String() + " HTTP/1.1\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	assert.Equal(t, "HTTP/1.1 200 Connection Established", statusLine(t, br))
+	statusLine(t, br)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := br.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestMatchHost(t *testing.T) {
+	// Test: Exact names, wildcards, IPs and CIDRs
+	assert.True(t, matchHost("Example.com.", []string{"example.com"}))
+	assert.True(t, matchHost("api.example.com", []string{"*.example.com"}))
+	assert.False(t, matchHost("example.com", []string{"*.example.com"}))
+	assert.False(t, matchHost("badexample.com", []string{"*.example.com"}))
+	assert.True(t, matchHost("10.1.2.3", []string{"10.0.0.0/8"}))
+	assert.True(t, matchHost("::1", []string{"0:0::1"}))
+	assert.False(t, matchHost("internal.corp", []string{"10.0.0.0/8"}))
+}
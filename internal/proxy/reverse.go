@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultUpstreamTimeout = 30 * time.Second
+
+// RFC 9110 7.6.1: these describe a single connection, not the message, so
+// they stop at the proxy. Trailer goes too since we reframe the body.
+var hopByHop = []string{
+	"connection",
+	"keep-alive",
+	"proxy-connection",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+// ReverseProxy is a server.Handler that hands every request to one upstream
+// and streams the answer back.
+type ReverseProxy struct {
+	Upstream    string        // "http://host:port" or "https://host", a path in it goes in front of every request path
+	StripPrefix string        // cut off the request path before forwarding, for proxies mounted under a prefix
+	Dialer      Dialer        // nil means a net.Dialer with DefaultDialTimeout
+	TLSConfig   *tls.Config   // for https upstreams, nil means the defaults
+	Timeout     time.Duration // for the upstream to answer and between body reads, 0 means DefaultUpstreamTimeout
+	Digest      bool          // add X-Content-SHA256, X-Content-Length and Content-Digest trailers
+
+	once   sync.Once
+	client *client.Client
+}
+
+func withoutHopByHop(h headers.Headers) headers.Headers {
+	out := headers.NewHeaders()
+	for k, v := range h {
+		out.Set(k, v)
+	}
+	for _, name := range strings.Split(h.Get("connection"), ",") {
+		out.Delete(strings.TrimSpace(name))
+	}
+	for _, name := range hopByHop {
+		out.Delete(name)
+	}
+	return out
+}
+
+// forwardedValue quotes what isn't a plain token, IPv6 addresses and host:port
+// need it (RFC 7239 6).
+func forwardedValue(v string) string {
+	if strings.ContainsAny(v, `:[]"`) {
+		return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+	}
+	return v
+}
+
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+func (p *ReverseProxy) timeout() time.Duration {
+	if p.Timeout > 0 {
+		return p.Timeout
+	}
+	return DefaultUpstreamTimeout
+}
+
+// upstream connections are pooled, redirects go back to the client untouched
+func (p *ReverseProxy) httpClient() *client.Client {
+	p.once.Do(func() {
+		p.client = &client.Client{
+			Dialer:       p.Dialer,
+			TLSConfig:    p.TLSConfig,
+			Timeout:      p.timeout(),
+			MaxRedirects: -1,
+		}
+	})
+	return p.client
+}
+
+func upstreamPath(target *url.URL, requestTarget string, stripPrefix string) (string, bool) {
+	if u, err := url.Parse(requestTarget); err == nil && u.IsAbs() { // absolute-form
+		requestTarget = u.RequestURI()
+	}
+	if !strings.HasPrefix(requestTarget, "/") {
+		return "", false
+	}
+	if rest, ok := strings.CutPrefix(requestTarget, stripPrefix); stripPrefix != "" && ok {
+		// only whole segments: "/api" strips "/api/items" and "/api?x", not "/apix"
+		if rest == "" || rest[0] == '/' || rest[0] == '?' || strings.HasSuffix(stripPrefix, "/") {
+			requestTarget = rest
+			if !strings.HasPrefix(requestTarget, "/") {
+				requestTarget = "/" + requestTarget
+			}
+		}
+	}
+	return strings.TrimSuffix(target.EscapedPath(), "/") + requestTarget, true
+}
+
+func upstreamRequest(target *url.URL, path string, req *request.Request) (*request.Request, error) {
+	up, err := client.NewRequest(req.RequestLine.Method, target.Scheme+"://"+target.Host+path, req.Body)
+	if err != nil {
+		return nil, err
+	}
+	h := withoutHopByHop(req.Headers)
+
+	origHost := req.Headers.Get("host")
+	if origHost != "" {
+		h.Set("x-forwarded-host", origHost)
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	h.Set("x-forwarded-proto", proto)
+	forwarded := "for=unknown"
+	if ip := clientIP(req.RemoteAddr); ip != "" {
+		h.Add("x-forwarded-for", ip)
+		if strings.Contains(ip, ":") {
+			ip = "[" + ip + "]"
+		}
+		forwarded = "for=" + forwardedValue(ip)
+	}
+	if origHost != "" {
+		forwarded += ";host=" + forwardedValue(origHost)
+	}
+	h.Add("forwarded", forwarded+";proto="+proto)
+	up.Headers = h
+	return up.WithContext(req.Context()), nil // the upstream call ends with the client's request
+}
+
+func gatewayError(w *response.Writer, err error) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		writeError(w, response.StatusGatewayTimeout, nil)
+		return
+	}
+	writeError(w, response.StatusBadGateway, nil)
+}
+
+func (p *ReverseProxy) Serve(w *response.Writer, req *request.Request) {
+	target, err := url.Parse(p.Upstream)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		writeError(w, response.StatusInternalServerError, nil)
+		return
+	}
+	path, ok := upstreamPath(target, req.RequestLine.RequestTarget, p.StripPrefix)
+	if !ok {
+		writeError(w, response.StatusBadRequest, nil)
+		return
+	}
+
+	up, err := upstreamRequest(target, path, req)
+	if err != nil {
+		writeError(w, response.StatusBadRequest, nil)
+		return
+	}
+	res, err := p.httpClient().Stream(up)
+	if err != nil {
+		gatewayError(w, err)
+		return
+	}
+	defer res.Close()
+	copyResponse(w, req, res, p.Digest)
+}
+
+// copyResponse streams res back to the client. Once it's called the response
+// is committed, errors past that point just cut the client off.
+func copyResponse(w *response.Writer, req *request.Request, res *client.Response, digest bool) {
+	h := withoutHopByHop(res.Headers)
+	w.WriteStatusLine(res.StatusLine.StatusCode)
+	w.WriteHeaders(h)
+
+	status := res.StatusLine.StatusCode
+	if status < response.StatusOK || status == response.StatusNoContent || status == response.StatusNotModified {
+		return
+	}
+	if req.RequestLine.Method == "HEAD" { // the upstream's Content-Length stays
+		return
+	}
+
+	// we reframe the body as chunked, so the upstream's trailers can come along
+	for _, name := range strings.Split(res.Headers.Get("trailer"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			w.AnnounceTrailers(name) // the ones we aren't allowed to send just get dropped
+		}
+	}
+	var dw *response.DigestWriter
+	var body io.Writer = w.ChunkedWriter()
+	if digest {
+		w.AnnounceTrailers("X-Content-SHA256", "X-Content-Length", "Content-Digest")
+		dw = response.NewDigestWriter(w)
+		body = dw
+	}
+	if err := w.Flush(); err != nil { // the head goes out right away
+		w.Abort()
+		return
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := res.Read(buf)
+		if n > 0 {
+			body.Write(buf[:n])
+			if w.Flush() != nil {
+				w.Abort()
+				return
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil { // the head is out already, all we can do is cut the client off
+			w.Abort()
+			return
+		}
+	}
+
+	for k, v := range res.Trailers {
+		w.WriteTrailers(headers.Headers{k: v})
+	}
+	if dw != nil {
+		dw.Close()
+	}
+}
@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rawUpstream answers every connection with reply, whatever it's asked.
+func rawUpstream(t *testing.T, reply string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := request.RequestFromReader(conn); err == nil {
+					conn.Write([]byte(reply))
+				}
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String()
+}
+
+func roundTrip(t *testing.T, p *ReverseProxy, raw string) string {
+	srv, err := server.Serve(0, p.Serve)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	_, port, _ := net.SplitHostPort(srv.Addr().String())
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	require.NoError(t, err)
+	defer conn.Close()
+	// the proxy keeps connections alive, ask for this one to end so it can be read to EOF
+	raw = strings.Replace(raw, "\r\n", "\r\nConnection: close\r\n", 1)
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+	res, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	return string(res)
+}
+
+func TestReverseProxy(t *testing.T) {
+	seen := make(chan *request.Request, 1)
+	upstream, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		seen <- req
+		w.WriteStatusLine(response.StatusCreated)
+		h := headers.NewHeaders()
+		h.Set("x-upstream", "yes")
+		w.WriteHeaders(h)
+		w.AnnounceTrailers("X-Checksum")
+		w.WriteBody([]byte("got " + string(req.Body)))
+		w.WriteTrailers(headers.Headers{"x-checksum": "abc"})
+	})
+	require.NoError(t, err)
+	defer upstream.Close()
+	p := &ReverseProxy{Upstream: "http://" + upstream.Addr().String() + "/v1", StripPrefix: "/api"}
+
+	// Test: Method, path, body and end-to-end headers make it, hop-by-hop ones don't
+	res := roundTrip(t, p, "POST /api/items?x=1 HTTP/1.1\r\n"+
+		"Host: localhost:1234\r\n"+
+		"Connection: keep-alive, X-Secret\r\n"+
+		"X-Secret: 1\r\n"+
+		"Keep-Alive: timeout=5\r\n"+
+		"X-Forwarded-For: 10.0.0.1\r\n"+
+		"Accept: text/plain\r\n"+
+		"Content-Length: 5\r\n\r\nhello")
+	req := <-seen
+	assert.Equal(t, "POST", req.RequestLine.Method)
+	assert.Equal(t, "/v1/items?x=1", req.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", string(req.Body))
+	assert.Equal(t, upstream.Addr().String(), req.Headers.Get("host"))
+	assert.Equal(t, "text/plain", req.Headers.Get("accept"))
+	assert.Empty(t, req.Headers.Get("x-secret"))
+	assert.Empty(t, req.Headers.Get("keep-alive"))
+	assert.Equal(t, "10.0.0.1, 127.0.0.1", req.Headers.Get("x-forwarded-for"))
+	assert.Equal(t, `for=127.0.0.1;host="localhost:1234";proto=http`, req.Headers.Get("forwarded"))
+	assert.Equal(t, "localhost:1234", req.Headers.Get("x-forwarded-host"))
+
+	// Test: Status, headers, body and trailers come back
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 201 Created\r\n"))
+	assert.Contains(t, res, "x-upstream: yes\r\n")
+	assert.Contains(t, res, "transfer-encoding: chunked\r\n")
+	assert.Contains(t, res, "got hello")
+	assert.True(t, strings.HasSuffix(res, "0\r\nx-checksum: abc\r\n\r\n"))
+
+	// Test: Digest trailers on top
+	p.Digest = true
+	res = roundTrip(t, p, "GET /api/ HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	<-seen
+	assert.Contains(t, res, "x-content-length: 4\r\n")
+	assert.Contains(t, res, "x-checksum: abc\r\n")
+
+	// Test: The prefix is only stripped on a segment boundary
+	for target, want := range map[string]string{"/api?x=1": "/v1/?x=1", "/api": "/v1/", "/apix/items": "/v1/apix/items"} {
+		roundTrip(t, p, "GET "+target+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		assert.Equal(t, want, (<-seen).RequestLine.RequestTarget, target)
+	}
+}
+
+func TestForwardedProto(t *testing.T) {
+	target, _ := url.Parse("http://backend")
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	require.NoError(t, err)
+	req.RemoteAddr = "10.0.0.1:5000"
+
+	// Test: Plain connections are http
+	up, err := upstreamRequest(target, "/", req)
+	require.NoError(t, err)
+	assert.Equal(t, "http", up.Headers.Get("x-forwarded-proto"))
+	assert.Equal(t, "for=10.0.0.1;host=example.com;proto=http", up.Headers.Get("forwarded"))
+
+	// Test: TLS ones are https, so the backend builds the right redirects
+	req.TLS = &tls.ConnectionState{}
+	up, err = upstreamRequest(target, "/", req)
+	require.NoError(t, err)
+	assert.Equal(t, "https", up.Headers.Get("x-forwarded-proto"))
+	assert.Equal(t, "for=10.0.0.1;host=example.com;proto=https", up.Headers.Get("forwarded"))
+}
+
+func TestReverseProxyKeepAlive(t *testing.T) {
+	p := &ReverseProxy{Upstream: rawUpstream(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")}
+	srv, err := server.Serve(0, p.Serve)
+	require.NoError(t, err)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: The upstream closing doesn't close the client's connection
+	for range 2 {
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+		res, err := client.ResponseFromReader(conn, "GET")
+		require.NoError(t, err)
+		assert.Equal(t, "ok", string(res.Body))
+		assert.Empty(t, res.Headers.Get("connection"))
+	}
+}
+
+func TestReverseProxyFraming(t *testing.T) {
+	// Test: Content-Length body gets streamed back chunked
+	p := &ReverseProxy{Upstream: rawUpstream(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nConnection: close\r\n\r\nhello")}
+	res := roundTrip(t, p, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"))
+	assert.NotContains(t, res, "content-length")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\n5\r\nhello\r\n0\r\n\r\n"))
+
+	// Test: HEAD keeps the upstream's length and sends no body
+	res = roundTrip(t, p, "HEAD / HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Contains(t, res, "content-length: 5\r\n")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\n"))
+
+	// Test: Interim responses are skipped, close-delimited body
+	p = &ReverseProxy{Upstream: rawUpstream(t, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\n\r\nuntil close")}
+	res = roundTrip(t, p, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, res, "B\r\nuntil close\r\n0\r\n\r\n")
+
+	// Test: Several Set-Cookie lines stay several lines
+	p = &ReverseProxy{Upstream: rawUpstream(t, "HTTP/1.1 200 OK\r\nSet-Cookie: a=1; Expires=Wed, 02 Jan 2030 03:04:05 GMT\r\nSet-Cookie: b=2\r\nContent-Length: 0\r\n\r\n")}
+	res = roundTrip(t, p, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Contains(t, res, "\r\nset-cookie: a=1; Expires=Wed, 02 Jan 2030 03:04:05 GMT\r\n")
+	assert.Contains(t, res, "\r\nset-cookie: b=2\r\n")
+
+	// Test: Upstream dies halfway, the client mustn't see a complete body
+	p = &ReverseProxy{Upstream: rawUpstream(t, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nshort")}
+	res = roundTrip(t, p, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"))
+	assert.NotContains(t, res, "0\r\n\r\n")
+}
+
+func TestReverseProxyErrors(t *testing.T) {
+	get := "GET / HTTP/1.1\r\nHost: x\r\n\r\n"
+
+	// Test: Connection refused
+	p := &ReverseProxy{Upstream: "http://127.0.0.1:1", Dialer: failingDialer{err: errors.New("connection refused")}}
+	assert.True(t, strings.HasPrefix(roundTrip(t, p, get), "HTTP/1.1 502 Bad Gateway\r\n"))
+
+	// Test: Dial timeout
+	p = &ReverseProxy{Upstream: "http://127.0.0.1:1", Dialer: failingDialer{err: timeoutError{}}}
+	assert.True(t, strings.HasPrefix(roundTrip(t, p, get), "HTTP/1.1 504 Gateway Timeout\r\n"))
+
+	// Test: Upstream never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	p = &ReverseProxy{Upstream: "http://" + l.Addr().String(), Timeout: 100 * time.Millisecond}
+	assert.True(t, strings.HasPrefix(roundTrip(t, p, get), "HTTP/1.1 504 Gateway Timeout\r\n"))
+
+	// Test: Garbage instead of a response
+	p = &ReverseProxy{Upstream: rawUpstream(t, "SSH-2.0-OpenSSH_9.6\r\n")}
+	assert.True(t, strings.HasPrefix(roundTrip(t, p, get), "HTTP/1.1 502 Bad Gateway\r\n"))
+
+	// Test: Bad upstream config
+	p = &ReverseProxy{Upstream: "ftp://example.com"}
+	assert.True(t, strings.HasPrefix(roundTrip(t, p, get), "HTTP/1.1 500 Internal Server Error\r\n"))
+}
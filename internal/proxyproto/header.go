@@ -0,0 +1,197 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var ERROR_MISSING_HEADER = errors.New("Connection didn't start with a PROXY protocol header")
+var ERROR_INVALID_HEADER = errors.New("Invalid PROXY protocol header")
+var ERROR_BAD_CHECKSUM = errors.New("PROXY protocol header checksum doesn't match")
+
+// v2 headers start with this, chosen so it can't be mistaken for anything
+// else that might show up on the wire.
+var signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The longest v1 line there can be, CRLF included.
+const maxV1Length = 107
+
+// TLV types from the spec, plus AWS's for the VPC endpoint ID.
+const (
+	TypeALPN      = 0x01
+	TypeAuthority = 0x02
+	TypeCRC32C    = 0x03
+	TypeNoop      = 0x04
+	TypeUniqueID  = 0x05
+	TypeSSL       = 0x20
+	TypeNetNS     = 0x30
+	TypeAWS       = 0xea // first value byte is the subtype, 0x01 for the VPC endpoint ID
+)
+
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header is what the proxy told us about the connection. Source and
+// Destination are nil when it didn't say (v1 UNKNOWN, v2 LOCAL or an
+// unsupported address family), the connection's own addresses apply then.
+type Header struct {
+	Version     int // 1 or 2
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []TLV // v2 only
+}
+
+// TLV returns the value of the first TLV of type t.
+func (h *Header) TLV(t byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ReadHeader reads a v1 or v2 header off r and nothing after it.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		return readV1(r)
+	case signature[0]:
+		return readV2(r)
+	}
+	return nil, ERROR_MISSING_HEADER
+}
+
+// readV1 reads "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxV1Length {
+			return nil, ERROR_INVALID_HEADER
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, ERROR_MISSING_HEADER
+	}
+	h := &Header{Version: 1}
+	if fields[1] == "UNKNOWN" {
+		return h, nil // whatever follows doesn't matter
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ERROR_INVALID_HEADER
+	}
+	src, err1 := parseV1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	dst, err2 := parseV1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err1 != nil || err2 != nil {
+		return nil, ERROR_INVALID_HEADER
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func parseV1Addr(ip, port string, v4 bool) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() != v4 || addr.Zone() != "" {
+		return nil, ERROR_INVALID_HEADER
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, ERROR_INVALID_HEADER
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+// readV2 reads the binary header: the signature, version and command, address
+// family and protocol, a length, then the addresses and TLVs.
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(fixed[:12], signature) {
+		return nil, ERROR_MISSING_HEADER
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, ERROR_INVALID_HEADER
+	}
+	command, family, proto := fixed[12]&0x0f, fixed[13]>>4, fixed[13]&0x0f
+	if command > 1 {
+		return nil, ERROR_INVALID_HEADER
+	}
+	rest := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2}
+	var addrLen int
+	switch family {
+	case 1:
+		addrLen = 12
+	case 2:
+		addrLen = 36
+	case 3:
+		addrLen = 216 // two unix socket paths, we don't use them
+	}
+	if len(rest) < addrLen {
+		return nil, ERROR_INVALID_HEADER
+	}
+	// LOCAL is the proxy talking for itself (health checks), and only TCP
+	// addresses make sense for us.
+	if command == 1 && proto == 1 && (family == 1 || family == 2) {
+		n := addrLen/2 - 2
+		src, _ := netip.AddrFromSlice(rest[:n])
+		dst, _ := netip.AddrFromSlice(rest[n : 2*n])
+		h.Source = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(rest[2*n:])))
+		h.Destination = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, binary.BigEndian.Uint16(rest[2*n+2:])))
+	}
+
+	for tlvs := rest[addrLen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, ERROR_INVALID_HEADER
+		}
+		n := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+n {
+			return nil, ERROR_INVALID_HEADER
+		}
+		h.TLVs = append(h.TLVs, TLV{Type: tlvs[0], Value: tlvs[3 : 3+n]})
+		if tlvs[0] == TypeCRC32C {
+			if n != 4 || !checksumOK(fixed, rest, len(rest)-len(tlvs)+3) {
+				return nil, ERROR_BAD_CHECKSUM
+			}
+		}
+		tlvs = tlvs[3+n:]
+	}
+	return h, nil
+}
+
+// checksumOK checks a CRC32C TLV whose value starts at rest[at], the checksum
+// covers the whole header with that value zeroed.
+func checksumOK(fixed, rest []byte, at int) bool {
+	want := binary.BigEndian.Uint32(rest[at:])
+	zeroed := append([]byte(nil), rest...)
+	copy(zeroed[at:at+4], []byte{0, 0, 0, 0})
+	table := crc32.MakeTable(crc32.Castagnoli)
+	return crc32.Update(crc32.Checksum(fixed, table), table, zeroed) == want
+}
@@ -0,0 +1,121 @@
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// How long a trusted peer gets to send the header.
+const DefaultTimeout = 5 * time.Second
+
+type Options struct {
+	Trusted []netip.Prefix // peers that must send a header, everyone else is read as is
+	Timeout time.Duration  // 0 means DefaultTimeout
+}
+
+// Listener accepts connections from load balancers that speak the PROXY
+// protocol (v1 and v2), their Conns report the client's address as the remote
+// one. Put it under a TLS listener, never above it, the header comes first.
+type Listener struct {
+	net.Listener
+	trusted []netip.Prefix
+	timeout time.Duration
+}
+
+func NewListener(l net.Listener, opts Options) *Listener {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Listener{Listener: l, trusted: opts.Trusted, timeout: timeout}
+}
+
+func (l *Listener) trusts(addr net.Addr) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	for _, p := range l.trusted {
+		if p.Contains(ap.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept doesn't read the header, that would hold up every other connection
+// behind a slow one. The first Read, RemoteAddr or LocalAddr does.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: c, trusted: l.trusts(c.RemoteAddr()), timeout: l.timeout}, nil
+}
+
+type Conn struct {
+	net.Conn
+	trusted bool
+	timeout time.Duration
+
+	once   sync.Once
+	reader *bufio.Reader // whatever came after the header, then the connection
+	header *Header
+	err    error
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		if !c.trusted {
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.reader = bufio.NewReader(c.Conn)
+		c.header, c.err = ReadHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+// Header returns what the proxy sent, nil for untrusted peers. The error is
+// also what every Read returns when the header was bad.
+func (c *Conn) Header() (*Header, error) {
+	c.readHeader()
+	return c.header, c.err
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.reader != nil {
+		return c.reader.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.readHeader(); c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if c.readHeader(); c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite half-closes the connection underneath when it can (TCP can),
+// and closes it otherwise.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
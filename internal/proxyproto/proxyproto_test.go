@@ -0,0 +1,174 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func read(raw string) (*Header, string, error) {
+	r := bufio.NewReader(strings.NewReader(raw))
+	h, err := ReadHeader(r)
+	rest, _ := io.ReadAll(r)
+	return h, string(rest), err
+}
+
+// v2 builds a v2 PROXY TCP header, with a correct CRC32C TLV when crc is set.
+func v2(src, dst string, crc bool, tlvs ...TLV) []byte {
+	s, d := netip.MustParseAddrPort(src), netip.MustParseAddrPort(dst)
+	fam := byte(0x11)
+	if s.Addr().Is6() {
+		fam = 0x21
+	}
+	body := append(s.Addr().AsSlice(), d.Addr().AsSlice()...)
+	body = binary.BigEndian.AppendUint16(body, s.Port())
+	body = binary.BigEndian.AppendUint16(body, d.Port())
+	for _, tlv := range tlvs {
+		body = append(body, tlv.Type)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(tlv.Value)))
+		body = append(body, tlv.Value...)
+	}
+	if crc {
+		body = append(body, TypeCRC32C, 0, 4, 0, 0, 0, 0)
+	}
+	header := append([]byte(nil), signature...)
+	header = append(header, 0x21, fam)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	header = append(header, body...)
+	if crc {
+		sum := crc32.Checksum(header, crc32.MakeTable(crc32.Castagnoli))
+		binary.BigEndian.PutUint32(header[len(header)-4:], sum)
+	}
+	return header
+}
+
+func TestV1(t *testing.T) {
+	// Test: TCP4, what comes after is left alone
+	h, rest, err := read("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, 1, h.Version)
+	assert.Equal(t, "192.0.2.1:56324", h.Source.String())
+	assert.Equal(t, "198.51.100.1:443", h.Destination.String())
+	assert.Equal(t, "GET / HTTP/1.1\r\n\r\n", rest)
+
+	// Test: TCP6
+	h, _, err = read("PROXY TCP6 2001:db8::1 2001:db8::2 1 2\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:1", h.Source.String())
+
+	// Test: UNKNOWN has no addresses
+	h, rest, err = read("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\nx")
+	require.NoError(t, err)
+	assert.Nil(t, h.Source)
+	assert.Equal(t, "x", rest)
+
+	// Test: Malformed lines
+	for _, raw := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 1 2\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 0443 443\r\n",
+		"PROXY UDP4 192.0.2.1 198.51.100.1 1 2\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n",
+	} {
+		_, _, err = read(raw)
+		assert.ErrorIs(t, err, ERROR_INVALID_HEADER, raw)
+	}
+
+	// Test: No header at all
+	_, _, err = read("GET / HTTP/1.1\r\n\r\n")
+	assert.ErrorIs(t, err, ERROR_MISSING_HEADER)
+}
+
+func TestV2(t *testing.T) {
+	// Test: TCP over IPv4 with TLVs and a checksum
+	raw := v2("192.0.2.1:56324", "198.51.100.1:443", true,
+		TLV{TypeAuthority, []byte("example.com")},
+		TLV{TypeAWS, []byte("\x01vpce-0123")})
+	h, rest, err := read(string(raw) + "GET")
+	require.NoError(t, err)
+	assert.Equal(t, 2, h.Version)
+	assert.Equal(t, "192.0.2.1:56324", h.Source.String())
+	assert.Equal(t, "198.51.100.1:443", h.Destination.String())
+	authority, ok := h.TLV(TypeAuthority)
+	assert.True(t, ok)
+	assert.Equal(t, "example.com", string(authority))
+	aws, _ := h.TLV(TypeAWS)
+	assert.Equal(t, "\x01vpce-0123", string(aws))
+	assert.Equal(t, "GET", rest)
+
+	// Test: IPv6
+	h, _, err = read(string(v2("[2001:db8::1]:1", "[2001:db8::2]:2", false)))
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:1", h.Source.String())
+
+	// Test: A flipped bit fails the checksum
+	raw[20] ^= 1
+	_, _, err = read(string(raw))
+	assert.ErrorIs(t, err, ERROR_BAD_CHECKSUM)
+
+	// Test: LOCAL keeps the connection's addresses
+	local := append(append([]byte(nil), signature...), 0x20, 0x00, 0, 0)
+	h, _, err = read(string(local))
+	require.NoError(t, err)
+	assert.Nil(t, h.Source)
+
+	// Test: Wrong version, truncated TLVs
+	_, _, err = read(string(append(append([]byte(nil), signature...), 0x11, 0x11, 0, 0)))
+	assert.ErrorIs(t, err, ERROR_INVALID_HEADER)
+	truncated := v2("192.0.2.1:1", "198.51.100.1:2", false, TLV{TypeNoop, []byte("abc")})
+	truncated[15] -= 1
+	_, _, err = read(string(truncated))
+	assert.ErrorIs(t, err, ERROR_INVALID_HEADER)
+}
+
+func TestListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer inner.Close()
+	accept := func(opts Options, send []byte) (net.Conn, string, error) {
+		l := NewListener(inner, opts)
+		client, err := net.Dial("tcp", inner.Addr().String())
+		require.NoError(t, err)
+		defer client.Close()
+		client.Write(send)
+		conn, err := l.Accept()
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		return conn, string(buf), err
+	}
+	trusted := Options{Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+
+	// Test: Trusted peers get their header read
+	conn, got, err := accept(trusted, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", got)
+	assert.Equal(t, "192.0.2.1:56324", conn.RemoteAddr().String())
+	assert.Equal(t, "198.51.100.1:443", conn.LocalAddr().String())
+
+	// Test: Untrusted peers are read as is
+	conn, got, err = accept(Options{}, append(v2("192.0.2.1:1", "198.51.100.1:2", false), "hello"...))
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n\r\n\x00", got)
+	assert.True(t, strings.HasPrefix(conn.RemoteAddr().String(), "127.0.0.1:"))
+
+	// Test: A trusted peer that doesn't send one can't send anything
+	_, _, err = accept(trusted, []byte("hello"))
+	assert.ErrorIs(t, err, ERROR_MISSING_HEADER)
+
+	// Test: Or takes too long about it
+	_, _, err = accept(Options{Trusted: trusted.Trusted, Timeout: 20 * time.Millisecond}, []byte("PROXY TCP4"))
+	var netErr net.Error
+	assert.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+}
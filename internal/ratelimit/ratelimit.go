@@ -0,0 +1,215 @@
+package ratelimit
+
+import (
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"math"
+	"strconv"
+	"time"
+)
+
+type Algorithm int
+
+const (
+	// TokenBucket lets a key burst up to Limit requests, then refills Limit
+	// tokens per Window at a steady rate.
+	TokenBucket Algorithm = iota
+	// SlidingWindow allows Limit requests in any Window, estimated from the
+	// counts of the current and previous fixed windows.
+	SlidingWindow
+)
+
+const (
+	DefaultLimit  = 60
+	DefaultWindow = time.Minute
+)
+
+// KeyFunc picks what requests are counted by, requests it returns "" for
+// aren't limited at all.
+type KeyFunc func(req *request.Request) string
+
+// ByClientIP counts per client, behind trusted proxies that's the address
+// they reported (see server.WithTrustedProxies).
+func ByClientIP(req *request.Request) string {
+	return req.ClientIP
+}
+
+// ByHeader counts by the value of a header, an API key say. Requests without
+// it are counted by client IP, or leaving it out would be a way around the
+// limit.
+func ByHeader(name string) KeyFunc {
+	return func(req *request.Request) string {
+		if v := req.Headers.Get(name); v != "" {
+			return "header:" + v
+		}
+		return ByClientIP(req)
+	}
+}
+
+type Options struct {
+	Algorithm Algorithm
+	Limit     int           // 0 means DefaultLimit
+	Window    time.Duration // 0 means DefaultWindow
+	Key       KeyFunc       // nil means ByClientIP
+	Store     Store         // nil means a MemoryStore of DefaultMaxKeys
+}
+
+// Result is what Allow decided, and what goes in the RateLimit-* headers.
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // until the quota is full again (token bucket) or the window ends (sliding window)
+	RetryAfter time.Duration // until a request would be allowed, 0 when this one was
+}
+
+type Limiter struct {
+	algorithm Algorithm
+	limit     int
+	window    time.Duration
+	key       KeyFunc
+	store     Store
+	now       func() time.Time
+}
+
+func New(opts Options) *Limiter {
+	l := &Limiter{
+		algorithm: opts.Algorithm,
+		limit:     opts.Limit,
+		window:    opts.Window,
+		key:       opts.Key,
+		store:     opts.Store,
+		now:       time.Now,
+	}
+	if l.limit <= 0 {
+		l.limit = DefaultLimit
+	}
+	if l.window <= 0 {
+		l.window = DefaultWindow
+	}
+	if l.key == nil {
+		l.key = ByClientIP
+	}
+	if l.store == nil {
+		// a key left alone for two windows is back to a full quota either way
+		l.store = NewMemoryStore(DefaultMaxKeys, 2*l.window)
+	}
+	return l
+}
+
+// Allow counts one request for key and tells whether it's within the limit.
+func (l *Limiter) Allow(key string) Result {
+	now := l.now()
+	var res Result
+	l.store.Update(key, now, func(s *State) {
+		if l.algorithm == SlidingWindow {
+			res = l.slidingWindow(s, now)
+		} else {
+			res = l.tokenBucket(s, now)
+		}
+	})
+	res.Limit = l.limit
+	return res
+}
+
+func (l *Limiter) tokenBucket(s *State, now time.Time) Result {
+	perSecond := float64(l.limit) / l.window.Seconds()
+	if s.Last.IsZero() {
+		s.Tokens = float64(l.limit)
+	} else {
+		s.Tokens = math.Min(float64(l.limit), s.Tokens+now.Sub(s.Last).Seconds()*perSecond)
+	}
+	s.Last = now
+
+	var res Result
+	if s.Tokens >= 1 {
+		s.Tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = secondsToDuration((1 - s.Tokens) / perSecond)
+	}
+	res.Remaining = int(s.Tokens)
+	res.Reset = secondsToDuration((float64(l.limit) - s.Tokens) / perSecond)
+	return res
+}
+
+func (l *Limiter) slidingWindow(s *State, now time.Time) Result {
+	start := now.Truncate(l.window)
+	if !start.Equal(s.Last) {
+		if start.Sub(s.Last) == l.window {
+			s.Prev = s.Count
+		} else {
+			s.Prev = 0 // a whole window went by without requests, or it's a new key
+		}
+		s.Count, s.Last = 0, start
+	}
+	elapsed := now.Sub(start)
+	// the previous window's requests count for the part of it that's still
+	// inside the sliding window
+	weight := 1 - elapsed.Seconds()/l.window.Seconds()
+	estimate := float64(s.Prev)*weight + float64(s.Count)
+
+	res := Result{Reset: l.window - elapsed}
+	if estimate+1 <= float64(l.limit) {
+		s.Count++
+		estimate++
+		res.Allowed = true
+	} else {
+		res.RetryAfter = l.slidingRetryAfter(s, elapsed)
+	}
+	res.Remaining = max(0, l.limit-int(math.Ceil(estimate)))
+	return res
+}
+
+// slidingRetryAfter works out when the previous window will have faded
+// enough for one more request, looking into the next window if this one won't
+// do.
+func (l *Limiter) slidingRetryAfter(s *State, elapsed time.Duration) time.Duration {
+	w := l.window.Seconds()
+	if s.Prev > 0 && s.Count+1 <= l.limit {
+		t := w*(1-float64(l.limit-s.Count-1)/float64(s.Prev)) - elapsed.Seconds()
+		if t < (l.window - elapsed).Seconds() {
+			return secondsToDuration(t)
+		}
+	}
+	t := (l.window - elapsed).Seconds()
+	if s.Count > 0 {
+		t += max(0, w*(1-float64(l.limit-1)/float64(s.Count)))
+	}
+	return secondsToDuration(t)
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(math.Ceil(s * float64(time.Second)))
+}
+
+// headerSeconds rounds up, rounding down would send clients back too early.
+func headerSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
+
+// Middleware answers 429 Too Many Requests once a key is over the limit, and
+// puts RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset and
+// RateLimit-Policy on every response.
+func (l *Limiter) Middleware(next server.Handler) server.Handler {
+	policy := strconv.Itoa(l.limit) + ";w=" + headerSeconds(l.window)
+	return func(w *response.Writer, req *request.Request) {
+		key := l.key(req)
+		if key == "" {
+			next(w, req)
+			return
+		}
+		res := l.Allow(key)
+		w.SetDefaultHeader("ratelimit-limit", strconv.Itoa(res.Limit))
+		w.SetDefaultHeader("ratelimit-remaining", strconv.Itoa(res.Remaining))
+		w.SetDefaultHeader("ratelimit-reset", headerSeconds(res.Reset))
+		w.SetDefaultHeader("ratelimit-policy", policy)
+		if !res.Allowed {
+			w.SetDefaultHeader("retry-after", headerSeconds(res.RetryAfter))
+			server.NewHandlerError(response.StatusTooManyRequests, "Too many requests, slow down").Respond(w)
+			return
+		}
+		next(w, req)
+	}
+}
@@ -0,0 +1,148 @@
+package ratelimit
+
+import (
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+func newClock() *clock                   { return &clock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)} }
+func newLimiter(opts Options, c *clock) *Limiter {
+	l := New(opts)
+	l.now = c.now
+	return l
+}
+
+func TestTokenBucket(t *testing.T) {
+	c := newClock()
+	l := newLimiter(Options{Limit: 3, Window: 3 * time.Second}, c)
+
+	// Test: A new key can burst up to the limit
+	for i := 2; i >= 0; i-- {
+		res := l.Allow("a")
+		assert.True(t, res.Allowed)
+		assert.Equal(t, i, res.Remaining)
+	}
+	res := l.Allow("a")
+	assert.False(t, res.Allowed)
+	assert.Equal(t, time.Second, res.RetryAfter)
+	assert.Equal(t, 3*time.Second, res.Reset)
+
+	// Test: Keys don't share a bucket
+	assert.True(t, l.Allow("b").Allowed)
+
+	// Test: Tokens come back at Limit per Window
+	c.advance(time.Second)
+	assert.True(t, l.Allow("a").Allowed)
+	assert.False(t, l.Allow("a").Allowed)
+	c.advance(time.Hour)
+	assert.Equal(t, 2, l.Allow("a").Remaining)
+}
+
+func TestSlidingWindow(t *testing.T) {
+	c := newClock()
+	l := newLimiter(Options{Algorithm: SlidingWindow, Limit: 4, Window: 10 * time.Second}, c)
+
+	// Test: Limit requests per window
+	for range 4 {
+		assert.True(t, l.Allow("a").Allowed)
+	}
+	res := l.Allow("a")
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+	assert.Equal(t, 10*time.Second, res.Reset)
+
+	// Test: The last window still counts for the part of it that overlaps
+	c.advance(12500 * time.Millisecond) // 25% into the next window, 3 of the 4 still count
+	res = l.Allow("a")
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+	res = l.Allow("a")
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 2500*time.Millisecond, res.RetryAfter) // halfway in, only 2 of the 4 count
+	c.advance(res.RetryAfter)
+	assert.True(t, l.Allow("a").Allowed)
+
+	// Test: A window without requests wipes the slate
+	c.advance(30 * time.Second)
+	assert.Equal(t, 3, l.Allow("a").Remaining)
+}
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Now()
+	touch := func(s *State) { s.Count++ }
+
+	// Test: Idle keys are forgotten
+	m := NewMemoryStore(0, time.Minute)
+	m.Update("a", now, touch)
+	m.Update("b", now.Add(30*time.Second), touch)
+	m.Update("c", now.Add(80*time.Second), touch)
+	assert.Equal(t, 2, m.Len())
+
+	// Test: Past maxKeys the least recently used goes
+	m = NewMemoryStore(2, time.Hour)
+	m.Update("a", now, touch)
+	m.Update("b", now, touch)
+	m.Update("a", now, touch)
+	m.Update("c", now, touch)
+	var count int
+	m.Update("a", now, func(s *State) { count = s.Count })
+	assert.Equal(t, 2, count)
+	m.Update("b", now, func(s *State) { count = s.Count })
+	assert.Equal(t, 0, count)
+}
+
+func TestMiddleware(t *testing.T) {
+	ok := func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		w.WriteBody([]byte("ok"))
+	}
+	l := New(Options{Limit: 2, Window: time.Minute, Key: ByHeader("x-api-key")})
+	srv, err := server.Serve(0, server.Chain(ok, l.Middleware))
+	require.NoError(t, err)
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Addr().String())
+	get := func(key string) *client.Response {
+		req, err := client.NewRequest("GET", "http://127.0.0.1:"+port+"/", nil)
+		require.NoError(t, err)
+		if key != "" {
+			req.Headers.Set("x-api-key", key)
+		}
+		res, err := (&client.Client{}).Do(req)
+		require.NoError(t, err)
+		return res
+	}
+
+	// Test: Responses carry the quota
+	res := get("k1")
+	assert.Equal(t, response.StatusOK, res.StatusLine.StatusCode)
+	assert.Equal(t, "2", res.Headers.Get("ratelimit-limit"))
+	assert.Equal(t, "1", res.Headers.Get("ratelimit-remaining"))
+	assert.Equal(t, "30", res.Headers.Get("ratelimit-reset"))
+	assert.Equal(t, "2;w=60", res.Headers.Get("ratelimit-policy"))
+
+	// Test: Over the limit is a 429 with Retry-After
+	get("k1")
+	res = get("k1")
+	assert.Equal(t, response.StatusTooManyRequests, res.StatusLine.StatusCode)
+	assert.Equal(t, "30", res.Headers.Get("retry-after"))
+	assert.Equal(t, "0", res.Headers.Get("ratelimit-remaining"))
+
+	// Test: Another key has its own quota, no key falls back to the client IP
+	assert.Equal(t, response.StatusOK, get("k2").StatusLine.StatusCode)
+	assert.Equal(t, response.StatusOK, get("").StatusLine.StatusCode)
+	assert.Equal(t, response.StatusOK, get("").StatusLine.StatusCode)
+	assert.Equal(t, response.StatusTooManyRequests, get("").StatusLine.StatusCode)
+}
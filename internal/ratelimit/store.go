@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const DefaultMaxKeys = 100_000
+
+// State is what the algorithms remember about a key, a new key starts out
+// with the zero State.
+type State struct {
+	Tokens float64   // token bucket
+	Last   time.Time // token bucket: last refill, sliding window: start of the current window
+	Count  int       // sliding window: requests in the current window
+	Prev   int       // sliding window: requests in the one before
+}
+
+// Store keeps a State per key. Update has to run fn and save its changes
+// without another Update for the same key getting in between, and may forget
+// keys that weren't updated for a while since they'd be back to full anyway.
+type Store interface {
+	Update(key string, now time.Time, fn func(s *State))
+}
+
+type memoryItem struct {
+	key   string
+	state State
+	seen  time.Time
+}
+
+// MemoryStore forgets keys idle for longer than idle, and the least recently
+// used ones past maxKeys.
+type MemoryStore struct {
+	mu      sync.Mutex
+	maxKeys int
+	idle    time.Duration
+	lru     *list.List // front is the most recently used
+	items   map[string]*list.Element
+}
+
+// NewMemoryStore takes 0 for maxKeys to mean DefaultMaxKeys. idle should be at
+// least as long as a key takes to get its full quota back, New takes care of
+// that for the store it makes.
+func NewMemoryStore(maxKeys int, idle time.Duration) *MemoryStore {
+	if maxKeys <= 0 {
+		maxKeys = DefaultMaxKeys
+	}
+	return &MemoryStore{
+		maxKeys: maxKeys,
+		idle:    idle,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+func (m *MemoryStore) Update(key string, now time.Time, fn func(s *State)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// the back is the least recently used, so idle keys are all there
+	for el := m.lru.Back(); el != nil && now.Sub(el.Value.(*memoryItem).seen) > m.idle; el = m.lru.Back() {
+		m.remove(el)
+	}
+
+	el, ok := m.items[key]
+	if !ok {
+		if m.lru.Len() >= m.maxKeys {
+			m.remove(m.lru.Back())
+		}
+		el = m.lru.PushFront(&memoryItem{key: key})
+		m.items[key] = el
+	}
+	item := el.Value.(*memoryItem)
+	fn(&item.state)
+	item.seen = now
+	m.lru.MoveToFront(el)
+}
+
+func (m *MemoryStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Len()
+}
+
+func (m *MemoryStore) remove(el *list.Element) {
+	m.lru.Remove(el)
+	delete(m.items, el.Value.(*memoryItem).key)
+}
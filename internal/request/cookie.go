@@ -0,0 +1,23 @@
+package request
+
+import (
+	"errors"
+	"httpfromtcp/internal/headers"
+)
+
+var ERROR_NO_COOKIE = errors.New("No such cookie")
+
+// Cookies parses the Cookie header, in the order the client sent them.
+func (r *Request) Cookies() []*headers.Cookie {
+	return headers.ParseCookies(r.Headers.Get("cookie"))
+}
+
+// Cookie returns the first cookie called name.
+func (r *Request) Cookie(name string) (*headers.Cookie, error) {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, ERROR_NO_COOKIE
+}
@@ -0,0 +1,22 @@
+package request
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookies(t *testing.T) {
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\nCookie: session=abc; theme=dark\r\n\r\n"))
+	require.NoError(t, err)
+
+	// Test: All of them, or one by name
+	assert.Len(t, r.Cookies(), 2)
+	c, err := r.Cookie("theme")
+	require.NoError(t, err)
+	assert.Equal(t, "dark", c.Value)
+	_, err = r.Cookie("nope")
+	assert.ErrorIs(t, err, ERROR_NO_COOKIE)
+}
@@ -0,0 +1,193 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var ERROR_MALFORMED_FORM = errors.New("Malformed form data")
+var ERROR_TOO_MANY_FORM_KEYS = errors.New("Too many form fields")
+var ERROR_FORM_TOO_LARGE = errors.New("Form body too large")
+var ERROR_MISSING_FORM_VALUE = errors.New("Missing form value")
+var ERROR_INVALID_FORM_VALUE = errors.New("Invalid form value")
+
+const (
+	DefaultMaxFormKeys  = 1000
+	DefaultMaxFormBytes = 10 << 20
+)
+
+type FormOptions struct {
+	MaxKeys  int // fields in the query and the body each, 0 means DefaultMaxFormKeys
+	MaxBytes int // of the body, 0 means DefaultMaxFormBytes
+}
+
+type Pair struct {
+	Key   string
+	Value string
+}
+
+// Values is a form as it came in: every field, repeats included, in order.
+type Values []Pair
+
+// Get returns the first value for key, "" if there's none.
+func (v Values) Get(key string) string {
+	for _, p := range v {
+		if p.Key == key {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+func (v Values) Has(key string) bool {
+	for _, p := range v {
+		if p.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// All returns every value for key, in order.
+func (v Values) All(key string) []string {
+	var values []string
+	for _, p := range v {
+		if p.Key == key {
+			values = append(values, p.Value)
+		}
+	}
+	return values
+}
+
+// Keys returns each key once, in the order they first showed up.
+func (v Values) Keys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, p := range v {
+		if !seen[p.Key] {
+			seen[p.Key] = true
+			keys = append(keys, p.Key)
+		}
+	}
+	return keys
+}
+
+// ParseQuery decodes "a=1&b=two+words&c=%2F", a "+" is a space. Fields
+// without "=" get an empty value, empty fields are skipped.
+func ParseQuery(query string, maxKeys int) (Values, error) {
+	values := Values{}
+	for field := range strings.SplitSeq(query, "&") {
+		if field == "" {
+			continue
+		}
+		if len(values) == maxKeys {
+			return nil, ERROR_TOO_MANY_FORM_KEYS
+		}
+		k, v, _ := strings.Cut(field, "=")
+		key, err1 := url.QueryUnescape(k)
+		value, err2 := url.QueryUnescape(v)
+		if err := errors.Join(err1, err2); err != nil {
+			return nil, fmt.Errorf("%w: %v", ERROR_MALFORMED_FORM, err)
+		}
+		values = append(values, Pair{key, value})
+	}
+	return values, nil
+}
+
+// ParseForm is ParseFormWith with the default limits.
+func (r *Request) ParseForm() error {
+	return r.ParseFormWith(FormOptions{})
+}
+
+// ParseFormWith fills in Query from the request target, PostForm from an
+// application/x-www-form-urlencoded body, and Form with both, the body's
+// fields first. Once it succeeded, calling it again does nothing.
+func (r *Request) ParseFormWith(opts FormOptions) error {
+	if r.Form != nil {
+		return nil
+	}
+	maxKeys, maxBytes := opts.MaxKeys, opts.MaxBytes
+	if maxKeys <= 0 {
+		maxKeys = DefaultMaxFormKeys
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxFormBytes
+	}
+
+	_, rawQuery, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	rawQuery, _, _ = strings.Cut(rawQuery, "#")
+	query, err := ParseQuery(rawQuery, maxKeys)
+	if err != nil {
+		return err
+	}
+
+	postForm := Values{}
+	mediaType, _, _ := mime.ParseMediaType(r.Headers.Get("content-type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		if len(r.Body) > maxBytes {
+			return ERROR_FORM_TOO_LARGE
+		}
+		if postForm, err = ParseQuery(string(r.Body), maxKeys); err != nil {
+			return err
+		}
+	}
+
+	r.Query, r.PostForm = query, postForm
+	r.Form = append(append(Values{}, postForm...), query...)
+	return nil
+}
+
+// FormValue returns the first value for key in Form, parsing the form first
+// if needed. Parse errors come out as "", call ParseForm to see them.
+func (r *Request) FormValue(key string) string {
+	r.ParseForm()
+	return r.Form.Get(key)
+}
+
+func (r *Request) formValue(key string) (string, error) {
+	if err := r.ParseForm(); err != nil {
+		return "", err
+	}
+	if !r.Form.Has(key) {
+		return "", fmt.Errorf("%w: %q", ERROR_MISSING_FORM_VALUE, key)
+	}
+	return r.Form.Get(key), nil
+}
+
+// FormInt returns the first value for key as an int.
+func (r *Request) FormInt(key string) (int, error) {
+	v, err := r.formValue(key)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q should be a whole number, got %q", ERROR_INVALID_FORM_VALUE, key, v)
+	}
+	return n, nil
+}
+
+// FormBool returns the first value for key as a bool. On top of what
+// strconv.ParseBool takes there's "on"/"off" (what a checked HTML checkbox
+// sends) and "yes"/"no".
+func (r *Request) FormBool(key string) (bool, error) {
+	v, err := r.formValue(key)
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "on", "yes":
+		return true, nil
+	case "off", "no":
+		return false, nil
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil {
+		return false, fmt.Errorf("%w: %q should be true or false, got %q", ERROR_INVALID_FORM_VALUE, key, v)
+	}
+	return b, nil
+}
@@ -0,0 +1,80 @@
+package request
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func formRequest(t *testing.T, target string, contentType string, body string) *Request {
+	raw := "POST " + target + " HTTP/1.1\r\nHost: x\r\n"
+	if contentType != "" {
+		raw += "Content-Type: " + contentType + "\r\n"
+	}
+	raw += "Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	r, err := RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	return r
+}
+
+func TestParseForm(t *testing.T) {
+	// Test: Query and body, repeats kept in order, the body first in Form
+	r := formRequest(t, "/search?q=go+lang&tag=a&tag=b%26c&empty=&flag#frag", "application/x-www-form-urlencoded; charset=utf-8", "name=J%C3%BCrgen&tag=z")
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, "go lang", r.Query.Get("q"))
+	assert.Equal(t, []string{"a", "b&c"}, r.Query.All("tag"))
+	assert.True(t, r.Query.Has("empty"))
+	assert.True(t, r.Query.Has("flag"))
+	assert.Equal(t, "Jürgen", r.PostForm.Get("name"))
+	assert.Equal(t, []string{"z", "a", "b&c"}, r.Form.All("tag"))
+	assert.Equal(t, []string{"name", "tag", "q", "empty", "flag"}, r.Form.Keys())
+	assert.Equal(t, "Jürgen", r.FormValue("name"))
+
+	// Test: Other bodies are left alone
+	r = formRequest(t, "/?a=1", "application/json", `{"a":2}`)
+	require.NoError(t, r.ParseForm())
+	assert.Empty(t, r.PostForm)
+	assert.Equal(t, "1", r.FormValue("a"))
+
+	// Test: Bad escapes
+	r = formRequest(t, "/?a=%zz", "", "")
+	assert.ErrorIs(t, r.ParseForm(), ERROR_MALFORMED_FORM)
+
+	// Test: Limits on fields and body size
+	r = formRequest(t, "/?a=1&b=2&c=3", "", "")
+	assert.ErrorIs(t, r.ParseFormWith(FormOptions{MaxKeys: 2}), ERROR_TOO_MANY_FORM_KEYS)
+	r = formRequest(t, "/", "application/x-www-form-urlencoded", "a=1234567890")
+	assert.ErrorIs(t, r.ParseFormWith(FormOptions{MaxBytes: 8}), ERROR_FORM_TOO_LARGE)
+}
+
+func TestFormTypes(t *testing.T) {
+	r := formRequest(t, "/?n=42&neg=-7&bad=4x&yes=on&no=false&maybe=perhaps", "", "")
+
+	// Test: Ints
+	n, err := r.FormInt("n")
+	require.NoError(t, err)
+	assert.Equal(t, 42, n)
+	n, err = r.FormInt("neg")
+	require.NoError(t, err)
+	assert.Equal(t, -7, n)
+	_, err = r.FormInt("bad")
+	assert.ErrorIs(t, err, ERROR_INVALID_FORM_VALUE)
+	assert.EqualError(t, err, `Invalid form value: "bad" should be a whole number, got "4x"`)
+
+	// Test: Bools, checkbox style included
+	b, err := r.FormBool("yes")
+	require.NoError(t, err)
+	assert.True(t, b)
+	b, err = r.FormBool("no")
+	require.NoError(t, err)
+	assert.False(t, b)
+	_, err = r.FormBool("maybe")
+	assert.ErrorIs(t, err, ERROR_INVALID_FORM_VALUE)
+
+	// Test: Missing fields say so
+	_, err = r.FormInt("nope")
+	assert.ErrorIs(t, err, ERROR_MISSING_FORM_VALUE)
+}
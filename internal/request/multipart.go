@@ -0,0 +1,356 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"httpfromtcp/internal/headers"
+	"io"
+	"mime"
+	"path"
+	"strings"
+)
+
+var ERROR_NOT_MULTIPART = errors.New("Content-Type isn't multipart with a boundary")
+var ERROR_MALFORMED_MULTIPART = errors.New("Malformed multipart body")
+var ERROR_TOO_MANY_PARTS = errors.New("Too many multipart parts")
+var ERROR_PART_TOO_LARGE = errors.New("Multipart part too large")
+
+const (
+	DefaultMaxMemory    = 10 << 20
+	DefaultMaxParts     = 1000
+	DefaultMaxPartBytes = 64 << 20
+)
+
+// Part headers bigger than this are someone messing with us.
+const maxPartHeaderBytes = 16 << 10
+
+// MultipartBoundary returns the boundary parameter of a multipart/* content
+// type.
+func MultipartBoundary(contentType string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return "", ERROR_NOT_MULTIPART
+	}
+	boundary := params["boundary"]
+	if boundary == "" || len(boundary) > 70 { // RFC 2046 5.1.1
+		return "", ERROR_NOT_MULTIPART
+	}
+	return boundary, nil
+}
+
+// MultipartReader goes through a multipart body one part at a time, without
+// holding more than a buffer's worth of it.
+type MultipartReader struct {
+	br       *bufio.Reader
+	boundary []byte // "--" + boundary
+	delim    []byte // "\r\n--" + boundary, what ends a part
+	part     *Part
+	started  bool
+	done     bool
+}
+
+func NewMultipartReader(r io.Reader, boundary string) *MultipartReader {
+	return &MultipartReader{
+		br:       bufio.NewReaderSize(r, 32<<10),
+		boundary: []byte("--" + boundary),
+		delim:    []byte("\r\n--" + boundary),
+	}
+}
+
+// MultipartReader reads the body as multipart, use it instead of
+// ParseMultipartForm to handle parts as they come. The request parser has
+// already read the whole body into r.Body, so this saves copying it, not
+// holding it.
+func (r *Request) MultipartReader() (*MultipartReader, error) {
+	boundary, err := MultipartBoundary(r.Headers.Get("content-type"))
+	if err != nil {
+		return nil, err
+	}
+	return NewMultipartReader(bytes.NewReader(r.Body), boundary), nil
+}
+
+// Part is one part of a multipart body, reading it gives its content. It's
+// good until the next call to NextPart.
+type Part struct {
+	Headers headers.Headers
+
+	mr          *MultipartReader
+	disposition map[string]string
+	done        bool
+}
+
+// NextPart skips whatever is left of the current part and returns the next
+// one, io.EOF after the last.
+func (mr *MultipartReader) NextPart() (*Part, error) {
+	if mr.done {
+		return nil, io.EOF
+	}
+	if mr.part != nil {
+		if _, err := io.Copy(io.Discard, mr.part); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		line, err := mr.readLine()
+		if err != nil {
+			return nil, err
+		}
+		line = bytes.TrimRight(line, " \t\r\n") // RFC 2046 allows whitespace after the boundary
+		if bytes.Equal(line, mr.boundary) {
+			break
+		}
+		if bytes.HasPrefix(line, mr.boundary) && bytes.Equal(line[len(mr.boundary):], []byte("--")) {
+			mr.done = true
+			return nil, io.EOF
+		}
+		// the preamble before the first boundary is ignored, after a part
+		// only the CRLF that belongs to the delimiter can come first
+		if mr.started && len(line) > 0 {
+			return nil, ERROR_MALFORMED_MULTIPART
+		}
+	}
+	mr.started = true
+
+	h := headers.NewHeaders()
+	for size := 0; ; {
+		line, err := mr.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if size += len(line); size > maxPartHeaderBytes {
+			return nil, ERROR_MALFORMED_MULTIPART
+		}
+		_, done, err := h.Parse(line)
+		if err != nil || (!done && !bytes.HasSuffix(line, CRFL)) {
+			return nil, ERROR_MALFORMED_MULTIPART
+		}
+		if done {
+			break
+		}
+	}
+	mr.part = &Part{Headers: h, mr: mr}
+	return mr.part, nil
+}
+
+// readLine reads up to and including a "\n", failing on lines longer than
+// the buffer.
+func (mr *MultipartReader) readLine() ([]byte, error) {
+	line, err := mr.br.ReadSlice('\n')
+	switch {
+	case errors.Is(err, bufio.ErrBufferFull):
+		return nil, ERROR_MALFORMED_MULTIPART
+	case errors.Is(err, io.EOF):
+		return nil, io.ErrUnexpectedEOF // there's always a close delimiter
+	}
+	return line, err
+}
+
+// Read stops right before the delimiter. Bytes that might be the start of
+// one are held back until there's enough to tell.
+func (p *Part) Read(b []byte) (int, error) {
+	if p.done {
+		return 0, io.EOF
+	}
+	br, delim := p.mr.br, p.mr.delim
+	for {
+		peek, _ := br.Peek(br.Buffered())
+		end := len(peek) - len(delim) + 1 // nothing before this can be a delimiter we haven't seen whole
+		for from := 0; ; {
+			i := bytes.Index(peek[from:], delim)
+			if i < 0 {
+				break
+			}
+			i += from
+			follows := delimiterFollows(peek[i+len(delim):])
+			if follows == isDelimiter && i == 0 {
+				p.done = true
+				return 0, io.EOF
+			}
+			if follows != notDelimiter {
+				end = i
+				break
+			}
+			from = i + 1 // just content that happens to look like one
+		}
+		if end > 0 {
+			n := copy(b, peek[:end])
+			br.Discard(n)
+			return n, nil
+		}
+		if _, err := br.Peek(len(peek) + 1); err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+}
+
+const (
+	notDelimiter = iota
+	isDelimiter
+	maybeDelimiter // can't tell yet
+)
+
+// delimiterFollows looks at what comes after "\r\n--boundary": only "--" or
+// optional whitespace and a CRLF make it a delimiter.
+func delimiterFollows(rest []byte) int {
+	if bytes.HasPrefix(rest, []byte("--")) {
+		return isDelimiter
+	}
+	rest = bytes.TrimLeft(rest, " \t")
+	switch {
+	case bytes.HasPrefix(rest, CRFL):
+		return isDelimiter
+	case len(rest) == 0, string(rest) == "\r", string(rest) == "-":
+		return maybeDelimiter
+	}
+	return notDelimiter
+}
+
+func (p *Part) parseDisposition() {
+	if p.disposition == nil {
+		_, params, _ := mime.ParseMediaType(p.Headers.Get("content-disposition"))
+		p.disposition = params
+		if p.disposition == nil {
+			p.disposition = map[string]string{}
+		}
+	}
+}
+
+// FormName is the name parameter of Content-Disposition: form-data.
+func (p *Part) FormName() string {
+	p.parseDisposition()
+	return p.disposition["name"]
+}
+
+// FileName is the filename parameter of Content-Disposition, with any
+// directories the client put in dropped. "" for parts that aren't files.
+func (p *Part) FileName() string {
+	p.parseDisposition()
+	name, ok := p.disposition["filename"]
+	if !ok {
+		return ""
+	}
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+type MultipartOptions struct {
+	MaxMemory    int64 // field values and files together, 0 means DefaultMaxMemory
+	MaxParts     int   // 0 means DefaultMaxParts
+	MaxPartBytes int64 // per part, 0 means DefaultMaxPartBytes
+}
+
+// FileHeader is an uploaded file.
+type FileHeader struct {
+	FormName string
+	Filename string
+	Headers  headers.Headers
+	Size     int64
+
+	content []byte
+}
+
+type readSeekNopCloser struct{ *bytes.Reader }
+
+func (readSeekNopCloser) Close() error { return nil }
+
+func (f *FileHeader) Open() (io.ReadSeekCloser, error) {
+	return readSeekNopCloser{bytes.NewReader(f.content)}, nil
+}
+
+// MultipartForm is a parsed multipart/form-data body. The field values also
+// end up in the request's PostForm and Form.
+type MultipartForm struct {
+	Values Values
+	Files  []*FileHeader // in the order they came
+}
+
+// File returns the first file uploaded as name, nil if there's none.
+func (f *MultipartForm) File(name string) *FileHeader {
+	for _, fh := range f.Files {
+		if fh.FormName == name {
+			return fh
+		}
+	}
+	return nil
+}
+
+// ParseMultipartForm reads a multipart/form-data body into MultipartForm.
+// Field values and files are all kept in memory and have to fit in
+// opts.MaxMemory together. Once it succeeded, calling it again does nothing.
+//
+// There are no temp files: the request parser has read the whole body into
+// r.Body already, so how big an upload can get is down to the server's body
+// limit (server.WithMaxBodyBytes).
+func (r *Request) ParseMultipartForm(opts MultipartOptions) error {
+	if r.MultipartForm != nil {
+		return nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+	if opts.MaxMemory <= 0 {
+		opts.MaxMemory = DefaultMaxMemory
+	}
+	if opts.MaxParts <= 0 {
+		opts.MaxParts = DefaultMaxParts
+	}
+	if opts.MaxPartBytes <= 0 {
+		opts.MaxPartBytes = DefaultMaxPartBytes
+	}
+
+	form := &MultipartForm{Values: Values{}}
+	memory := opts.MaxMemory
+	for parts := 0; ; parts++ {
+		p, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err == nil && parts == opts.MaxParts {
+			err = ERROR_TOO_MANY_PARTS
+		}
+		if err != nil {
+			return err
+		}
+
+		name, filename := p.FormName(), p.FileName()
+		if name == "" {
+			continue // not a form field
+		}
+		// one byte over the limit is enough to know it's too big
+		var buf bytes.Buffer
+		n, err := io.CopyN(&buf, p, min(memory, opts.MaxPartBytes)+1)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if n > opts.MaxPartBytes {
+			return ERROR_PART_TOO_LARGE
+		}
+		if n > memory {
+			return ERROR_FORM_TOO_LARGE
+		}
+		memory -= n
+
+		if filename == "" {
+			form.Values = append(form.Values, Pair{name, buf.String()})
+			continue
+		}
+		form.Files = append(form.Files, &FileHeader{FormName: name, Filename: filename, Headers: p.Headers, Size: n, content: buf.Bytes()})
+	}
+
+	r.MultipartForm = form
+	r.PostForm = append(r.PostForm, form.Values...)
+	r.Form = append(append(Values{}, r.PostForm...), r.Query...)
+	return nil
+}
@@ -0,0 +1,144 @@
+package request
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/response"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// formPart is one field of an upload, a file when filename is set.
+type formPart struct {
+	name, filename, content string
+}
+
+func multipartRequest(t *testing.T, parts ...formPart) *Request {
+	var body bytes.Buffer
+	mw := response.NewMultipartWriter(&body)
+	for _, p := range parts {
+		h := headers.NewHeaders()
+		disposition := `form-data; name="` + p.name + `"`
+		if p.filename != "" {
+			disposition += `; filename="` + p.filename + `"`
+			h.Set("content-type", "application/octet-stream")
+		}
+		h.Set("content-disposition", disposition)
+		w, err := mw.CreatePart(h)
+		require.NoError(t, err)
+		io.WriteString(w, p.content)
+	}
+	require.NoError(t, mw.Close())
+	raw := "POST /upload?source=test HTTP/1.1\r\nHost: x\r\nContent-Type: " + mw.ContentType("form-data") +
+		"\r\nContent-Length: " + strconv.Itoa(body.Len()) + "\r\n\r\n" + body.String()
+	r, err := RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	return r
+}
+
+func TestMultipartReader(t *testing.T) {
+	body := "preamble, ignored\r\n" +
+		"--xyz\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\none\r\n--xyz-not-quite\r\n" +
+		"--xyz  \r\nContent-Disposition: form-data; name=\"f\"; filename=\"C:\\\\Users\\\\me\\\\notes.txt\"\r\nContent-Type: text/plain\r\n\r\n\r\n\r\n" +
+		"--xyz--\r\nepilogue"
+
+	// Test: Parts come with their headers, content stops at the delimiter
+	mr := NewMultipartReader(iotestOneByte(body), "xyz")
+	p, err := mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "a", p.FormName())
+	assert.Equal(t, "", p.FileName())
+	content, err := io.ReadAll(p)
+	require.NoError(t, err)
+	assert.Equal(t, "one\r\n--xyz-not-quite", string(content))
+
+	// Test: Whitespace after the boundary, directories dropped from file names
+	p, err = mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "notes.txt", p.FileName())
+	assert.Equal(t, "text/plain", p.Headers.Get("content-type"))
+	content, _ = io.ReadAll(p)
+	assert.Equal(t, "\r\n", string(content))
+
+	// Test: EOF after the close delimiter
+	_, err = mr.NextPart()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: A body cut short
+	mr = NewMultipartReader(strings.NewReader("--xyz\r\n\r\nhalf a part"), "xyz")
+	p, err = mr.NextPart()
+	require.NoError(t, err)
+	_, err = io.ReadAll(p)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Boundaries from the content type
+	boundary, err := MultipartBoundary(`multipart/form-data; boundary="a b"`)
+	require.NoError(t, err)
+	assert.Equal(t, "a b", boundary)
+	_, err = MultipartBoundary("multipart/form-data")
+	assert.ErrorIs(t, err, ERROR_NOT_MULTIPART)
+	_, err = MultipartBoundary("text/plain; boundary=x")
+	assert.ErrorIs(t, err, ERROR_NOT_MULTIPART)
+}
+
+// iotestOneByte hands out s a byte per Read, like a slow client.
+func iotestOneByte(s string) io.Reader {
+	return &oneByteReader{s}
+}
+
+type oneByteReader struct{ s string }
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if r.s == "" {
+		return 0, io.EOF
+	}
+	p[0] = r.s[0]
+	r.s = r.s[1:]
+	return 1, nil
+}
+
+func TestParseMultipartForm(t *testing.T) {
+	big := strings.Repeat("x", 100)
+
+	// Test: Fields join the query in Form, files come with their headers
+	r := multipartRequest(t,
+		formPart{name: "title", content: "holiday"},
+		formPart{name: "small", filename: "a.txt", content: "tiny"},
+		formPart{name: "big", filename: "b.bin", content: big},
+		formPart{name: "title", content: "again"})
+	require.NoError(t, r.ParseMultipartForm(MultipartOptions{MaxMemory: 200}))
+	form := r.MultipartForm
+	assert.Equal(t, []string{"holiday", "again"}, form.Values.All("title"))
+	assert.Equal(t, []string{"title", "source"}, r.Form.Keys())
+	require.Len(t, form.Files, 2)
+	assert.Equal(t, "a.txt", form.File("small").Filename)
+	assert.Equal(t, "application/octet-stream", form.File("small").Headers.Get("content-type"))
+
+	for name, want := range map[string]string{"small": "tiny", "big": big} {
+		f, err := form.File(name).Open()
+		require.NoError(t, err)
+		got, _ := io.ReadAll(f)
+		f.Close()
+		assert.Equal(t, want, string(got))
+		assert.Equal(t, int64(len(want)), form.File(name).Size)
+	}
+
+	// Test: Limits on parts, part size and memory, files count towards it too
+	r = multipartRequest(t, formPart{name: "a"}, formPart{name: "b"}, formPart{name: "c"})
+	assert.ErrorIs(t, r.ParseMultipartForm(MultipartOptions{MaxParts: 2}), ERROR_TOO_MANY_PARTS)
+	r = multipartRequest(t, formPart{name: "f", filename: "f", content: big})
+	assert.ErrorIs(t, r.ParseMultipartForm(MultipartOptions{MaxPartBytes: 99}), ERROR_PART_TOO_LARGE)
+	r = multipartRequest(t, formPart{name: "text", content: big})
+	assert.ErrorIs(t, r.ParseMultipartForm(MultipartOptions{MaxMemory: 10}), ERROR_FORM_TOO_LARGE)
+	r = multipartRequest(t, formPart{name: "f", filename: "f", content: "tiny"}, formPart{name: "g", filename: "g", content: big})
+	assert.ErrorIs(t, r.ParseMultipartForm(MultipartOptions{MaxMemory: 50}), ERROR_FORM_TOO_LARGE)
+
+	// Test: Not multipart at all
+	r = formRequest(t, "/", "application/x-www-form-urlencoded", "a=1")
+	assert.ErrorIs(t, r.ParseMultipartForm(MultipartOptions{}), ERROR_NOT_MULTIPART)
+}
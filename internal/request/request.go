@@ -2,10 +2,14 @@ package request
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"httpfromtcp/internal/headers"
 	"io"
+	"net"
 	"strconv"
+	"strings"
 	"unicode"
 	"unicode/utf8"
 )
@@ -15,6 +19,12 @@ var ERROR_MALFORMED_HTTP_REQUEST error = errors.New("Malformed Http Request Erro
 var ERROR_MALFORMED_REQUEST_LINE error = errors.New("Malformed Request Line Error")
 var ERROR_READING_IN_DONE_STATE error = errors.New("Trying to read in a done state")
 var ERROR_UNDIFINIED_STATE error = errors.New("Undifiened state")
+var ERROR_INVALID_CONTENT_LENGTH error = errors.New("Invalid Content-Length")
+var ERROR_HEADERS_TOO_LARGE error = errors.New("Request header fields too large")
+var ERROR_BODY_TOO_LARGE error = errors.New("Request body too large")
+
+// MaxHeaderBytes caps the request line and headers together.
+const MaxHeaderBytes = 1 << 20
 
 type ParserState int
 
@@ -36,6 +46,41 @@ type Request struct {
 	State       ParserState
 	Headers     headers.Headers
 	Body        []byte
+
+	// filled in by the server
+	RemoteAddr string               // "ip:port" of the peer
+	LocalAddr  string               // "ip:port" the peer connected to
+	ClientIP   string               // RemoteAddr's IP, or the client's as a trusted proxy reported it
+	ConnID     uint64               // unique per server, shared by every request on a connection
+	RequestNum int                  // 1 for the first request on the connection, 2 for the next one...
+	TLS        *tls.ConnectionState // nil on plain connections
+
+	// filled in by ParseForm
+	Query    Values // from the request target
+	PostForm Values // from the body
+	Form     Values // both, the body's first
+
+	MultipartForm *MultipartForm // filled in by ParseMultipartForm
+
+	ctx     context.Context
+	session *Session
+}
+
+// Context is cancelled when the client goes away or the server shuts down,
+// for requests that came in through a server. It's never nil.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx,
+// headers and body are shared with r.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	c := *r
+	c.ctx = ctx
+	return &c
 }
 
 func newRequest() *Request {
@@ -60,6 +105,17 @@ func isAllUpper(str []byte) bool {
 	return true
 }
 
+// RFC 9112 3.2.3: CONNECT targets are just host:port, and the port is not
+// optional.
+func isAuthorityForm(target string) bool {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || host == "" || strings.ContainsAny(host, "/?#@") {
+		return false
+	}
+	p, err := strconv.Atoi(port)
+	return err == nil && p > 0 && p <= 65535
+}
+
 func ParseRequestLine(data []byte) (*RequestLine, int, error) {
 	splits := bytes.SplitN(data, CRFL, 2)
 	if len(splits) != 2 {
@@ -77,6 +133,9 @@ func ParseRequestLine(data []byte) (*RequestLine, int, error) {
 	if string(parts[2]) != "HTTP/1.1" {
 		return nil, 0, ERROR_MALFORMED_REQUEST_LINE
 	}
+	if string(parts[0]) == "CONNECT" && !isAuthorityForm(string(parts[1])) {
+		return nil, 0, ERROR_MALFORMED_REQUEST_LINE
+	}
 
 	return &RequestLine{
 		HttpVersion:   "1.1",
@@ -117,11 +176,8 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 			return 0, nil
 		}
 		length, err := strconv.Atoi(l)
-		if err != nil {
-			return 0, err
-		}
-		if length < 0 {
-			return 0, errors.New("invalid content-length")
+		if err != nil || length < 0 {
+			return 0, ERROR_INVALID_CONTENT_LENGTH
 		}
 
 		remaining := min(length-len(r.Body), len(data))
@@ -138,6 +194,15 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 	return 0, ERROR_UNDIFINIED_STATE
 }
 
+// contentLength is 0 when there's no Content-Length, or none that parses.
+func (r *Request) contentLength() int64 {
+	n, err := strconv.ParseInt(r.Headers.Get("content-length"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
 func (r *Request) parse(data []byte) (int, error) {
 	consumed := 0
 	for r.State != StateDone {
@@ -155,36 +220,100 @@ func (r *Request) parse(data []byte) (int, error) {
 	return consumed, nil
 }
 
-func RequestFromReader(reader io.Reader) (*Request, error) {
+// ConnReader reads requests off a connection one after the other. Whatever
+// it reads past the end of a request stays buffered for the next one, or for
+// whoever takes the connection over.
+type ConnReader struct {
+	reader      io.Reader
+	buf         []byte
+	readToIndex int
+	onHead      func()
+	maxBody     int64
+}
+
+func NewConnReader(reader io.Reader) *ConnReader {
+	return &ConnReader{
+		reader: reader,
+		buf:    make([]byte, 8),
+	}
+}
+
+// Buffered returns the bytes read from the connection that no request used.
+func (cr *ConnReader) Buffered() []byte {
+	return cr.buf[:cr.readToIndex]
+}
+
+// OnHead sets fn to be called each time Next has a request's line and
+// headers, before it reads the body.
+func (cr *ConnReader) OnHead(fn func()) {
+	cr.onHead = fn
+}
+
+// SetMaxBodyBytes makes Next turn down requests whose Content-Length is over
+// n before reading any of the body, 0 means no limit.
+func (cr *ConnReader) SetMaxBodyBytes(n int64) {
+	cr.maxBody = n
+}
+
+// Next returns io.EOF when the connection closes before a request starts,
+// ERROR_HEADERS_TOO_LARGE once the head goes past MaxHeaderBytes and
+// ERROR_BODY_TOO_LARGE for a body over the SetMaxBodyBytes limit.
+func (cr *ConnReader) Next() (*Request, error) {
 	rq := newRequest()
-	buf := make([]byte, 8)
-	readToIndex := 0
+	headBytes := 0
 
 	for rq.State != StateDone {
-		if readToIndex >= len(buf) {
-			nbuf := make([]byte, len(buf)*2)
-			copy(nbuf, buf)
-			buf = nbuf
+		if cr.readToIndex > 0 { // leftovers from last time might hold a whole request already
+			inHead := rq.State < StateBody
+			read, err := rq.parse(cr.buf[:cr.readToIndex])
+			if err != nil {
+				return nil, err
+			}
+			copy(cr.buf, cr.buf[read:cr.readToIndex])
+			cr.readToIndex -= read
+			if inHead {
+				headBytes += read
+				if rq.State >= StateBody {
+					if cr.maxBody > 0 && rq.contentLength() > cr.maxBody {
+						return nil, ERROR_BODY_TOO_LARGE
+					}
+					if cr.onHead != nil {
+						cr.onHead()
+					}
+				}
+			}
+			if rq.State == StateDone {
+				break
+			}
+		}
+
+		if rq.State < StateBody && headBytes+cr.readToIndex >= MaxHeaderBytes {
+			return nil, ERROR_HEADERS_TOO_LARGE
+		}
+		if cr.readToIndex >= len(cr.buf) {
+			nbuf := make([]byte, len(cr.buf)*2)
+			copy(nbuf, cr.buf)
+			cr.buf = nbuf
 		}
 
-		n, err := reader.Read(buf[readToIndex:])
-		readToIndex += n
+		n, err := cr.reader.Read(cr.buf[cr.readToIndex:])
+		cr.readToIndex += n
 		if err != nil {
 			if !errors.Is(err, io.EOF) {
 				return nil, err
 			}
 			if n == 0 {
+				if rq.State == StateInit && cr.readToIndex == 0 {
+					return nil, io.EOF
+				}
 				rq.State = StateDone
 				break
 			}
 		}
-
-		read, err := rq.parse(buf[:readToIndex])
-		if err != nil {
-			return nil, err
-		}
-		copy(buf, buf[read:readToIndex])
-		readToIndex -= read
 	}
 	return rq, nil
 }
+
+func RequestFromReader(reader io.Reader) (*Request, error) {
+	return NewConnReader(reader).Next()
+}
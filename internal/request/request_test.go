@@ -2,6 +2,7 @@ package request
 
 import (
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -332,3 +333,62 @@ func TestInvalidContentLength(t *testing.T) {
 	_, err = RequestFromReader(reader)
 	// Depends on your error handling - might error or treat as 0
 }
+
+func TestConnReader(t *testing.T) {
+	// Test: Two pipelined requests on one connection
+	cr := NewConnReader(&chunkReader{
+		data: "POST /a HTTP/1.1\r\n" +
+			"Content-Length: 3\r\n" +
+			"\r\n" +
+			"abc" +
+			"GET /b HTTP/1.1\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err := cr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/a", r.RequestLine.RequestTarget)
+	assert.Equal(t, "abc", string(r.Body))
+	r, err = cr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+
+	// Test: Nothing left means EOF, not an empty request
+	_, err = cr.Next()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: Bytes after the request stay buffered
+	cr = NewConnReader(&chunkReader{
+		data:            "GET /chat HTTP/1.1\r\nUpgrade: websocket\r\n\r\n\x81\x85frame",
+		numBytesPerRead: 64,
+	})
+	r, err = cr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/chat", r.RequestLine.RequestTarget)
+	assert.Equal(t, "\x81\x85frame", string(cr.Buffered()))
+}
+
+func TestConnectRequestLine(t *testing.T) {
+	// Test: Authority-form target
+	r, err := RequestFromReader(strings.NewReader("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "CONNECT", r.RequestLine.Method)
+	assert.Equal(t, "example.com:443", r.RequestLine.RequestTarget)
+
+	// Test: IPv6 literal
+	r, err = RequestFromReader(strings.NewReader("CONNECT [::1]:8443 HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "[::1]:8443", r.RequestLine.RequestTarget)
+
+	// Test: Missing port
+	_, err = RequestFromReader(strings.NewReader("CONNECT example.com HTTP/1.1\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_MALFORMED_REQUEST_LINE)
+
+	// Test: Origin-form is not allowed
+	_, err = RequestFromReader(strings.NewReader("CONNECT /index.html HTTP/1.1\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_MALFORMED_REQUEST_LINE)
+
+	// Test: Port out of range
+	_, err = RequestFromReader(strings.NewReader("CONNECT example.com:70000 HTTP/1.1\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_MALFORMED_REQUEST_LINE)
+}
@@ -0,0 +1,66 @@
+package request
+
+import "time"
+
+// Session is what the session middleware keeps for a client between
+// requests, see package session. Handlers get it from req.Session().
+type Session struct {
+	ID       string
+	Created  time.Time // absolute expiry counts from here
+	LastSeen time.Time // idle expiry counts from here
+	Values   map[string]string
+
+	changed     bool
+	regenerated bool
+	destroyed   bool
+}
+
+func (s *Session) Get(key string) string {
+	return s.Values[key]
+}
+
+func (s *Session) Set(key, value string) {
+	if s.Values == nil {
+		s.Values = map[string]string{}
+	}
+	s.Values[key] = value
+	s.changed = true
+}
+
+func (s *Session) Delete(key string) {
+	delete(s.Values, key)
+	s.changed = true
+}
+
+// Regenerate gives the session a new ID once the handler is done, values
+// kept. Call it on login, or an ID someone planted on the client before
+// (session fixation) would end up logged in too.
+func (s *Session) Regenerate() {
+	s.regenerated = true
+	s.changed = true
+}
+
+// Destroy drops the session and its cookie, on logout say.
+func (s *Session) Destroy() {
+	s.destroyed = true
+	s.changed = true
+}
+
+// Changed, Regenerated and Destroyed tell the middleware what the handler did.
+func (s *Session) Changed() bool     { return s.changed }
+func (s *Session) Regenerated() bool { return s.regenerated }
+func (s *Session) Destroyed() bool   { return s.destroyed }
+
+// Session is the client's session, nil unless the session middleware is in
+// front of the handler.
+func (r *Request) Session() *Session {
+	return r.session
+}
+
+// WithSession returns a shallow copy of r carrying s, for the session
+// middleware.
+func (r *Request) WithSession(s *Session) *Request {
+	c := *r
+	c.session = s
+	return &c
+}
@@ -0,0 +1,205 @@
+package response
+
+import (
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"io"
+	"strings"
+)
+
+type ChunkExtension struct {
+	Name  string
+	Value string // optional, sent as a token or a quoted-string
+}
+
+// RFC 9110 6.5.1: fields that frame, route, authenticate or describe the
+// content have to be known before the body, so they can't be trailers.
+var forbiddenTrailers = map[string]bool{
+	"transfer-encoding":   true,
+	"content-length":      true,
+	"trailer":             true,
+	"host":                true,
+	"te":                  true,
+	"cache-control":       true,
+	"expect":              true,
+	"max-forwards":        true,
+	"pragma":              true,
+	"range":               true,
+	"authorization":       true,
+	"proxy-authenticate":  true,
+	"proxy-authorization": true,
+	"www-authenticate":    true,
+	"set-cookie":          true,
+	"content-encoding":    true,
+	"content-type":        true,
+	"content-range":       true,
+	"age":                 true,
+	"expires":             true,
+	"date":                true,
+	"location":            true,
+	"retry-after":         true,
+	"vary":                true,
+}
+
+func isTchar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTchar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func formatExtensions(exts []ChunkExtension) (string, error) {
+	var sb strings.Builder
+	for _, ext := range exts {
+		if !isToken(ext.Name) {
+			return "", fmt.Errorf("invalid chunk extension name %q", ext.Name)
+		}
+		sb.WriteString(";" + ext.Name)
+		if ext.Value == "" {
+			continue
+		}
+		if isToken(ext.Value) {
+			sb.WriteString("=" + ext.Value)
+			continue
+		}
+		if strings.ContainsAny(ext.Value, "\r\n") {
+			return "", fmt.Errorf("invalid chunk extension value %q", ext.Value)
+		}
+		quoted := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(ext.Value)
+		sb.WriteString(`="` + quoted + `"`)
+	}
+	return sb.String(), nil
+}
+
+func (w *Writer) isChunked() bool {
+	codings := strings.Split(w.headers.Get("transfer-encoding"), ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
+
+func (w *Writer) startChunked() error {
+	if w.state != StateHeaders && w.state != StateBody {
+		return fmt.Errorf("You need to write headers first.")
+	}
+	if w.lastSent {
+		return fmt.Errorf("The chunked body is already done.")
+	}
+	if !w.isChunked() {
+		w.headers.Set("transfer-encoding", "chunked")
+	}
+	w.headers.Delete("content-length")
+	w.state = StateBody
+	return nil
+}
+
+func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	return w.WriteChunkedBodyWithExtensions(p)
+}
+
+func (w *Writer) WriteChunkedBodyWithExtensions(p []byte, exts ...ChunkExtension) (int, error) {
+	if err := w.startChunked(); err != nil {
+		return 0, err
+	}
+	if len(p) == 0 {
+		return 0, nil // a zero-length chunk would end the body, that's WriteChunkedBodyDone's job
+	}
+	ext, err := formatExtensions(exts)
+	if err != nil {
+		return 0, err
+	}
+
+	n, _ := fmt.Fprintf(w.body, "%X%s\r\n", len(p), ext) // what could go wrong ?
+	m, err := w.body.Write(p)
+	w.written += int64(m)
+	o, _ := w.body.Write([]byte("\r\n"))
+	return n + m + o, err
+}
+
+func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if err := w.startChunked(); err != nil {
+		return 0, err
+	}
+	w.lastSent = true
+	return w.body.Write([]byte("0\r\n"))
+}
+
+type chunkedWriter struct {
+	w *Writer
+}
+
+func (cw chunkedWriter) Write(p []byte) (int, error) {
+	if _, err := cw.w.WriteChunkedBody(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ChunkedWriter turns every Write into one chunk, so the body can be fed with
+// io.Copy and friends.
+func (w *Writer) ChunkedWriter() io.Writer {
+	return chunkedWriter{w: w}
+}
+
+// AnnounceTrailers lists the fields that will come after the body in the
+// Trailer header. Trailers only exist in chunked bodies, so this switches the
+// response to chunked too.
+func (w *Writer) AnnounceTrailers(names ...string) error {
+	if w.state != StateHeaders {
+		return fmt.Errorf("Trailers have to be announced after the headers and before the body.")
+	}
+	for _, name := range names {
+		if !isToken(name) {
+			return fmt.Errorf("invalid trailer name %q", name)
+		}
+		if forbiddenTrailers[strings.ToLower(name)] {
+			return fmt.Errorf("%s is not allowed in a trailer", name)
+		}
+		w.headers.Add("trailer", name)
+	}
+	w.headers.Set("transfer-encoding", "chunked")
+	w.headers.Delete("content-length")
+	return nil
+}
+
+func (w *Writer) announcedTrailers() map[string]bool {
+	announced := make(map[string]bool)
+	for _, p := range strings.Split(w.headers.Get("trailer"), ",") {
+		if name := strings.ToLower(strings.TrimSpace(p)); name != "" {
+			announced[name] = true
+		}
+	}
+	return announced
+}
+
+func (w *Writer) WriteTrailers(h headers.Headers) error {
+	if !w.isChunked() {
+		return fmt.Errorf("Trailers need a chunked body.")
+	}
+	if _, ok := w.headers["trailer"]; ok {
+		announced := w.announcedTrailers()
+		for k, v := range h {
+			k = strings.ToLower(k)
+			if !announced[k] {
+				return fmt.Errorf("trailer %s not announced in Trailer header", k)
+			}
+			if forbiddenTrailers[k] {
+				return fmt.Errorf("%s is not allowed in a trailer", k)
+			}
+			w.trailers.Set(k, v)
+		}
+		return nil
+	}
+	return fmt.Errorf("No trailers initilized !")
+}
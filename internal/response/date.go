@@ -0,0 +1,30 @@
+package response
+
+import (
+	"httpfromtcp/internal/headers"
+	"sync/atomic"
+	"time"
+)
+
+type cachedDate struct {
+	unix  int64
+	value string
+}
+
+var dateCache atomic.Pointer[cachedDate]
+
+// The Date header only has second precision, so there's no point formatting
+// it more than once per second.
+func currentDate() string {
+	now := time.Now()
+	if d := dateCache.Load(); d != nil && d.unix == now.Unix() {
+		return d.value
+	}
+
+	d := &cachedDate{
+		unix:  now.Unix(),
+		value: headers.FormatHTTPDate(now),
+	}
+	dateCache.Store(d)
+	return d.value
+}
@@ -0,0 +1,73 @@
+package response
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"httpfromtcp/internal/headers"
+	"strings"
+)
+
+// DigestWriter streams a chunked body while hashing and counting it, then
+// fills in whichever of these trailers were announced:
+//
+//	X-Content-SHA256  hex SHA-256 of the body
+//	X-Content-Length  number of body bytes
+//	Content-Digest    RFC 9530, sha-256 of the bytes on the wire
+//	Repr-Digest       RFC 9530, same thing as long as there's no Content-Encoding
+type DigestWriter struct {
+	w      *Writer
+	sha256 hash.Hash
+	n      int64
+}
+
+func NewDigestWriter(w *Writer) *DigestWriter {
+	return &DigestWriter{
+		w:      w,
+		sha256: sha256.New(),
+	}
+}
+
+func (d *DigestWriter) Write(p []byte) (int, error) {
+	if _, err := d.w.WriteChunkedBody(p); err != nil {
+		return 0, err
+	}
+	d.sha256.Write(p)
+	d.n += int64(len(p))
+	return len(p), nil
+}
+
+// Close ends the body and writes the trailers, so call it once the last byte
+// is in.
+func (d *DigestWriter) Close() error {
+	if _, err := d.w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+
+	sum := d.sha256.Sum(nil)
+	structured := "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+	announced := d.w.announcedTrailers()
+	trailers := headers.NewHeaders()
+
+	if announced["x-content-sha256"] {
+		trailers.Set("x-content-sha256", hex.EncodeToString(sum))
+	}
+	if announced["x-content-length"] {
+		trailers.Set("x-content-length", fmt.Sprintf("%d", d.n))
+	}
+	if announced["content-digest"] {
+		trailers.Set("content-digest", structured)
+	}
+	// the representation is the decoded data, which we never see when it's encoded
+	coding := strings.ToLower(d.w.headers.Get("content-encoding"))
+	if announced["repr-digest"] && (coding == "" || coding == "identity") {
+		trailers.Set("repr-digest", structured)
+	}
+
+	if len(trailers) == 0 {
+		return nil
+	}
+	return d.w.WriteTrailers(trailers)
+}
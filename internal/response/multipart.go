@@ -0,0 +1,78 @@
+package response
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"httpfromtcp/internal/headers"
+	"io"
+	"slices"
+)
+
+var ERROR_MULTIPART_CLOSED = errors.New("Multipart writer already closed")
+
+// MultipartWriter builds a multipart body (multipart/mixed, byteranges,
+// form-data...) on any writer, a ChunkedWriter to stream it or a buffer for
+// WriteBody.
+type MultipartWriter struct {
+	w        io.Writer
+	boundary string
+	parts    int
+	closed   bool
+}
+
+func NewMultipartWriter(w io.Writer) *MultipartWriter {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return &MultipartWriter{w: w, boundary: hex.EncodeToString(b)}
+}
+
+func (m *MultipartWriter) Boundary() string {
+	return m.boundary
+}
+
+// ContentType is the Content-Type to send with the body, subtype is "mixed",
+// "byteranges", "form-data" and so on.
+func (m *MultipartWriter) ContentType(subtype string) string {
+	return "multipart/" + subtype + "; boundary=" + m.boundary
+}
+
+// CreatePart starts a part with h as its headers, write its content to the
+// returned writer before the next CreatePart or Close.
+func (m *MultipartWriter) CreatePart(h headers.Headers) (io.Writer, error) {
+	if m.closed {
+		return nil, ERROR_MULTIPART_CLOSED
+	}
+	head := "--" + m.boundary + "\r\n"
+	if m.parts > 0 {
+		head = "\r\n" + head // the CRLF before a boundary belongs to the boundary
+	}
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		head += name + ": " + h[name] + "\r\n"
+	}
+	head += "\r\n"
+	if _, err := io.WriteString(m.w, head); err != nil {
+		return nil, err
+	}
+	m.parts++
+	return m.w, nil
+}
+
+// Close writes the close delimiter, the body is done after that.
+func (m *MultipartWriter) Close() error {
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	delim := "--" + m.boundary + "--\r\n"
+	if m.parts > 0 {
+		delim = "\r\n" + delim
+	}
+	_, err := io.WriteString(m.w, delim)
+	return err
+}
@@ -5,16 +5,57 @@ import (
 	"fmt"
 	"httpfromtcp/internal/headers"
 	"io"
-	"strings"
 )
 
 type StatusCode int
 type WriterState int
 
 const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+	StatusContinue                    StatusCode = 100
+	StatusSwitchingProtocols          StatusCode = 101
+	StatusOK                          StatusCode = 200
+	StatusCreated                     StatusCode = 201
+	StatusAccepted                    StatusCode = 202
+	StatusNonAuthoritativeInfo        StatusCode = 203
+	StatusNoContent                   StatusCode = 204
+	StatusResetContent                StatusCode = 205
+	StatusPartialContent              StatusCode = 206
+	StatusMultipleChoices             StatusCode = 300
+	StatusMovedPermanently            StatusCode = 301
+	StatusFound                       StatusCode = 302
+	StatusSeeOther                    StatusCode = 303
+	StatusNotModified                 StatusCode = 304
+	StatusTemporaryRedirect           StatusCode = 307
+	StatusPermanentRedirect           StatusCode = 308
+	StatusBadRequest                  StatusCode = 400
+	StatusUnauthorized                StatusCode = 401
+	StatusForbidden                   StatusCode = 403
+	StatusNotFound                    StatusCode = 404
+	StatusMethodNotAllowed            StatusCode = 405
+	StatusNotAcceptable               StatusCode = 406
+	StatusProxyAuthRequired           StatusCode = 407
+	StatusRequestTimeout              StatusCode = 408
+	StatusConflict                    StatusCode = 409
+	StatusGone                        StatusCode = 410
+	StatusLengthRequired              StatusCode = 411
+	StatusPreconditionFailed          StatusCode = 412
+	StatusContentTooLarge             StatusCode = 413
+	StatusURITooLong                  StatusCode = 414
+	StatusUnsupportedMediaType        StatusCode = 415
+	StatusRangeNotSatisfiable         StatusCode = 416
+	StatusExpectationFailed           StatusCode = 417
+	StatusMisdirectedRequest          StatusCode = 421
+	StatusUnprocessableContent        StatusCode = 422
+	StatusUpgradeRequired             StatusCode = 426
+	StatusPreconditionRequired        StatusCode = 428
+	StatusTooManyRequests             StatusCode = 429
+	StatusRequestHeaderFieldsTooLarge StatusCode = 431
+	StatusInternalServerError         StatusCode = 500
+	StatusNotImplemented              StatusCode = 501
+	StatusBadGateway                  StatusCode = 502
+	StatusServiceUnavailable          StatusCode = 503
+	StatusGatewayTimeout              StatusCode = 504
+	StatusHTTPVersionNotSupported     StatusCode = 505
 )
 
 const (
@@ -22,20 +63,77 @@ const (
 	StateStatusLine
 	StateHeaders
 	StateBody
+	StateDone
 )
 
+const DefaultServerName = "httpfromtcp"
+
 type Writer struct {
-	buf      *bytes.Buffer
-	body     *bytes.Buffer
-	state    WriterState
-	headers  headers.Headers
-	trailers headers.Headers
+	buf       *bytes.Buffer
+	body      *bytes.Buffer
+	state     WriterState
+	status    StatusCode
+	headers   headers.Headers
+	trailers  headers.Headers
+	omitBody  bool
+	server    string
+	lastSent  bool // the zero-length chunk went out
+	out       io.Writer
+	committed bool // the header section is written, no going back
+	hijacker  Hijacker
+	aborted   bool
+	written   int64 // body bytes the handler handed over, framing not included
+	defaults  headers.Headers
+	cookies   []string // Set-Cookie values, each goes on its own line
+	hooks     []func() // BeforeHead
 }
 
 var codeNames = map[StatusCode]string{
-	StatusOK:                  "OK",
-	StatusBadRequest:          "Bad Request",
-	StatusInternalServerError: "Internal Server Error",
+	StatusContinue:                    "Continue",
+	StatusSwitchingProtocols:          "Switching Protocols",
+	StatusOK:                          "OK",
+	StatusCreated:                     "Created",
+	StatusAccepted:                    "Accepted",
+	StatusNonAuthoritativeInfo:        "Non-Authoritative Information",
+	StatusNoContent:                   "No Content",
+	StatusResetContent:                "Reset Content",
+	StatusPartialContent:              "Partial Content",
+	StatusMultipleChoices:             "Multiple Choices",
+	StatusMovedPermanently:            "Moved Permanently",
+	StatusFound:                       "Found",
+	StatusSeeOther:                    "See Other",
+	StatusNotModified:                 "Not Modified",
+	StatusTemporaryRedirect:           "Temporary Redirect",
+	StatusPermanentRedirect:           "Permanent Redirect",
+	StatusBadRequest:                  "Bad Request",
+	StatusUnauthorized:                "Unauthorized",
+	StatusForbidden:                   "Forbidden",
+	StatusNotFound:                    "Not Found",
+	StatusMethodNotAllowed:            "Method Not Allowed",
+	StatusNotAcceptable:               "Not Acceptable",
+	StatusProxyAuthRequired:           "Proxy Authentication Required",
+	StatusRequestTimeout:              "Request Timeout",
+	StatusConflict:                    "Conflict",
+	StatusGone:                        "Gone",
+	StatusLengthRequired:              "Length Required",
+	StatusPreconditionFailed:          "Precondition Failed",
+	StatusContentTooLarge:             "Content Too Large",
+	StatusURITooLong:                  "URI Too Long",
+	StatusUnsupportedMediaType:        "Unsupported Media Type",
+	StatusRangeNotSatisfiable:         "Range Not Satisfiable",
+	StatusExpectationFailed:           "Expectation Failed",
+	StatusMisdirectedRequest:          "Misdirected Request",
+	StatusUnprocessableContent:        "Unprocessable Content",
+	StatusUpgradeRequired:             "Upgrade Required",
+	StatusPreconditionRequired:        "Precondition Required",
+	StatusTooManyRequests:             "Too Many Requests",
+	StatusRequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+	StatusInternalServerError:         "Internal Server Error",
+	StatusNotImplemented:              "Not Implemented",
+	StatusBadGateway:                  "Bad Gateway",
+	StatusServiceUnavailable:          "Service Unavailable",
+	StatusGatewayTimeout:              "Gateway Timeout",
+	StatusHTTPVersionNotSupported:     "HTTP Version Not Supported",
 }
 
 func (c StatusCode) String() string {
@@ -52,21 +150,64 @@ func NewWriter() *Writer {
 		state:    StateInit,
 		headers:  GetDefaultHeaders(0),
 		trailers: headers.NewHeaders(),
+		defaults: headers.NewHeaders(),
+		server:   DefaultServerName,
 	}
 }
 
+// SetServerName changes the Server header sent when the handler didn't set one.
+// An empty name leaves the header out.
+func (w *Writer) SetServerName(name string) {
+	w.server = name
+}
+
+// SetDefaultHeader adds a field to the response unless the handler sets it
+// itself, middleware uses it since the handler replaces the whole header map.
+func (w *Writer) SetDefaultHeader(name, value string) {
+	w.defaults.Set(name, value)
+}
+
+// SetCookie adds a Set-Cookie line of its own, it works before or after
+// WriteHeaders as long as the head hasn't gone out yet.
+func (w *Writer) SetCookie(c *headers.Cookie) error {
+	if w.committed {
+		return ERROR_ALREADY_COMMITTED
+	}
+	if err := c.Valid(); err != nil {
+		return err
+	}
+	w.cookies = append(w.cookies, c.String())
+	return nil
+}
+
+// BeforeHead runs fn right before the header section goes out, the last
+// chance for middleware to add cookies or defaults to a streamed response.
+func (w *Writer) BeforeHead(fn func()) {
+	w.hooks = append(w.hooks, fn)
+}
+
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	if w.committed {
+		return ERROR_ALREADY_COMMITTED
+	}
 	w.state = StateStatusLine
+	w.status = statusCode
 	_, err := fmt.Fprintf(w.buf, "HTTP/1.1 %d %s\r\n", statusCode, statusCode.String())
 	return err
 }
 
+// OmitBody makes the writer drop every body byte while still sending the
+// headers (Content-Length included). That's exactly what a HEAD response is.
+func (w *Writer) OmitBody() {
+	w.omitBody = true
+}
+
 func (w *Writer) DeleteHeader(fieldName string) {
 	w.headers.Delete(fieldName)
 }
 
 func (w *Writer) WriteHeaders(headers headers.Headers) error {
-	if w.state == StateBody {
+	if w.state == StateBody || w.committed {
 		return fmt.Errorf("You can only write headers once, when you write the status line.")
 	}
 	w.state = StateHeaders
@@ -79,58 +220,93 @@ func (w *Writer) WriteBody(p []byte) error {
 	if w.state != StateHeaders && w.state != StateBody {
 		return fmt.Errorf("You need to write headers first.")
 	}
+	if w.isChunked() {
+		_, err := w.WriteChunkedBody(p)
+		return err
+	}
 	w.state = StateBody
 
-	_, err := w.body.Write(p)
+	n, err := w.body.Write(p)
+	w.written += int64(n)
 	return err
 }
 
-func (w *Writer) Bytes() []byte {
-	body := w.body.Bytes()
-	w.headers.Set("content-length", fmt.Sprintf("%d", len(body)))
-	for k, v := range w.headers {
-		fmt.Fprintf(w.buf, "%s: %s\r\n", k, v)
+// Status is the code from WriteStatusLine, 0 if there wasn't one yet.
+func (w *Writer) Status() StatusCode {
+	return w.status
+}
+
+// BytesWritten counts the body bytes written so far, before any chunk framing.
+// A HEAD response counts what the handler wrote even though none of it is sent.
+func (w *Writer) BytesWritten() int64 {
+	return w.written
+}
+
+// writeHead puts the header section into buf, deciding on the framing fields
+// on the way.
+func (w *Writer) writeHead(contentLen int) {
+	hooks := w.hooks
+	w.hooks = nil
+	for _, fn := range hooks {
+		fn()
 	}
-	w.buf.Write([]byte("\r\n"))
-	w.buf.Write(body)
-	if w.headers.Get("transfer-encoding") == "chunked" && len(w.trailers) > 0 {
-		for k, v := range w.trailers {
-			fmt.Fprintf(w.buf, "%s: %s\r\n", k, v)
+	switch {
+	case w.isChunked() || w.bodyless(): // RFC 9110 8.6: never both, and none at all on a 204
+		w.headers.Delete("content-length")
+	case w.omitBody && contentLen == 0 && w.headers.Get("content-length") != "":
+		// a HEAD handler that knows the length without producing the body
+	default:
+		w.headers.Set("content-length", fmt.Sprintf("%d", contentLen))
+	}
+	if w.headers.Get("date") == "" {
+		w.headers.Set("date", currentDate())
+	}
+	if w.headers.Get("server") == "" && w.server != "" {
+		w.headers.Set("server", w.server)
+	}
+	for k, v := range w.defaults {
+		if w.headers.Get(k) == "" {
+			w.headers.Set(k, v)
 		}
-		w.buf.Write([]byte("\r\n"))
 	}
-
-	return w.buf.Bytes()
+	for _, c := range w.cookies {
+		w.headers.Add("set-cookie", c)
+	}
+	WriteHeaders(w.buf, w.headers)
+	w.buf.Write([]byte("\r\n"))
+	w.committed = true
 }
 
-func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
-	n, _ := fmt.Fprintf(w.body, "%X\r\n", len(p)) // what could go wrong ?
-	m, err := w.body.Write(p)
-	o, _ := w.body.Write([]byte("\r\n"))
-	return n + m + o, err
+// bodyless is true for the status codes that never carry a body, RFC 9110 6.4.1.
+func (w *Writer) bodyless() bool {
+	return w.status < StatusOK || w.status == StatusNoContent || w.status == StatusNotModified
 }
 
-func (w *Writer) WriteChunkedBodyDone() (int, error) {
-	return w.body.Write([]byte("0\r\n"))
+// writeTail ends a chunked body: last chunk, trailer section (which may be
+// empty) and the final CRLF.
+func (w *Writer) writeTail() {
+	if !w.isChunked() {
+		return
+	}
+	if !w.lastSent {
+		w.WriteChunkedBodyDone()
+	}
+	WriteHeaders(w.body, w.trailers)
+	w.body.Write([]byte("\r\n"))
 }
 
-func (w *Writer) WriteTrailers(h headers.Headers) error {
-	if val, ok := w.headers["trailer"]; ok {
-		parts := strings.Split(val, ",")
-		announced := make(map[string]bool)
-		for _, p := range parts {
-			announced[strings.ToLower(strings.TrimSpace(p))] = true
-		}
-
-		for k, v := range h {
-			if !announced[k] {
-				return fmt.Errorf("trailer %s not announced in Trailer header", k)
-			}
-			w.trailers.Set(k, v)
-		}
-		return nil
+func (w *Writer) Bytes() []byte {
+	if !w.omitBody {
+		w.writeTail()
 	}
-	return fmt.Errorf("No trailers initilized !")
+	body := w.body.Bytes()
+	w.writeHead(len(body))
+	if w.omitBody {
+		return w.buf.Bytes()
+	}
+	w.buf.Write(body)
+
+	return w.buf.Bytes()
 }
 
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
@@ -144,15 +320,19 @@ func GetDefaultHeaders(contentLen int) headers.Headers {
 	h.Set("content-length", fmt.Sprintf("%d", contentLen))
 	h.Set("connection", "close")
 	h.Set("content-type", "text/plain")
+	h.Set("date", currentDate())
 
 	return h
 }
 
+// WriteHeaders writes a field line per value, Set-Cookie can have several.
 func WriteHeaders(w io.Writer, headers headers.Headers) error {
-	for k, v := range headers {
-		_, err := fmt.Fprintf(w, "%s: %s\r\n", k, v)
-		if err != nil {
-			return err
+	for k := range headers {
+		for _, v := range headers.Values(k) {
+			_, err := fmt.Fprintf(w, "%s: %s\r\n", k, v)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
@@ -0,0 +1,301 @@
+package response
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func splitResponse(t *testing.T, res []byte) (string, string) {
+	head, body, ok := strings.Cut(string(res), "\r\n\r\n")
+	require.True(t, ok)
+	return head + "\r\n", body
+}
+
+func TestFixedLengthBody(t *testing.T) {
+	// Test: Content-Length is computed from the body
+	w := NewWriter()
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	w.WriteBody([]byte("hello "))
+	w.WriteBody([]byte("world"))
+	head, body := splitResponse(t, w.Bytes())
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, head, "content-length: 11\r\n")
+	assert.Contains(t, head, "date: ")
+	assert.Contains(t, head, "server: httpfromtcp\r\n")
+	assert.Equal(t, "hello world", body)
+
+	// Test: HEAD keeps the length but drops the bytes
+	w = NewWriter()
+	w.OmitBody()
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	w.WriteBody([]byte("hello"))
+	head, body = splitResponse(t, w.Bytes())
+	assert.Contains(t, head, "content-length: 5\r\n")
+	assert.Empty(t, body)
+
+	// Test: Server header can be turned off
+	w = NewWriter()
+	w.SetServerName("")
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	head, _ = splitResponse(t, w.Bytes())
+	assert.NotContains(t, head, "server:")
+
+	// Test: Default headers fill in what the handler left out
+	w = NewWriter()
+	w.SetDefaultHeader("x-request-id", "abc")
+	w.SetDefaultHeader("content-type", "text/html")
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	head, _ = splitResponse(t, w.Bytes())
+	assert.Contains(t, head, "x-request-id: abc\r\n")
+	assert.Contains(t, head, "content-type: text/plain\r\n")
+}
+
+func TestChunkedBody(t *testing.T) {
+	// Test: Chunks, empty writes and the terminator
+	w := NewWriter()
+	w.WriteStatusLine(StatusOK)
+	h := GetDefaultHeaders(0)
+	h.Set("transfer-encoding", "chunked")
+	w.WriteHeaders(h)
+	w.WriteChunkedBody([]byte("hello"))
+	w.WriteChunkedBody(nil)
+	w.WriteChunkedBody([]byte(" world!!!!!!"))
+	w.WriteChunkedBodyDone()
+	head, body := splitResponse(t, w.Bytes())
+	assert.NotContains(t, head, "content-length")
+	assert.Equal(t, "5\r\nhello\r\nC\r\n world!!!!!!\r\n0\r\n\r\n", body)
+
+	// Test: Forgetting the terminator still produces a valid body
+	w = NewWriter()
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	io.Copy(w.ChunkedWriter(), strings.NewReader("abc"))
+	head, body = splitResponse(t, w.Bytes())
+	assert.Contains(t, head, "transfer-encoding: chunked\r\n")
+	assert.NotContains(t, head, "content-length")
+	assert.Equal(t, "3\r\nabc\r\n0\r\n\r\n", body)
+
+	// Test: WriteBody turns into chunks once the body is chunked
+	w = NewWriter()
+	w.WriteStatusLine(StatusOK)
+	h = headers.NewHeaders()
+	h.Set("transfer-encoding", "gzip, chunked")
+	w.WriteHeaders(h)
+	w.WriteBody([]byte("xy"))
+	_, body = splitResponse(t, w.Bytes())
+	assert.Equal(t, "2\r\nxy\r\n0\r\n\r\n", body)
+
+	// Test: BytesWritten counts the payload, not the chunk framing
+	assert.Equal(t, int64(2), w.BytesWritten())
+	assert.Equal(t, StatusOK, w.Status())
+
+	// Test: No writes after the last chunk
+	w = NewWriter()
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	w.WriteChunkedBodyDone()
+	_, err := w.WriteChunkedBody([]byte("late"))
+	require.Error(t, err)
+}
+
+func TestChunkExtensions(t *testing.T) {
+	w := NewWriter()
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+
+	// Test: Token, quoted-string and bare extensions
+	_, err := w.WriteChunkedBodyWithExtensions([]byte("abc"),
+		ChunkExtension{Name: "sig", Value: "abc123"},
+		ChunkExtension{Name: "note", Value: `say "hi"`},
+		ChunkExtension{Name: "last"},
+	)
+	require.NoError(t, err)
+
+	// Test: Invalid extension name
+	_, err = w.WriteChunkedBodyWithExtensions([]byte("abc"), ChunkExtension{Name: "bad name"})
+	require.Error(t, err)
+
+	_, body := splitResponse(t, w.Bytes())
+	assert.Equal(t, "3;sig=abc123;note=\"say \\\"hi\\\"\";last\r\nabc\r\n0\r\n\r\n", body)
+}
+
+func TestTrailers(t *testing.T) {
+	// Test: Announced trailers end up after the last chunk
+	w := NewWriter()
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	require.NoError(t, w.AnnounceTrailers("X-Checksum"))
+	w.WriteChunkedBody([]byte("data"))
+	w.WriteChunkedBodyDone()
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "1234")
+	require.NoError(t, w.WriteTrailers(trailers))
+	head, body := splitResponse(t, w.Bytes())
+	assert.Contains(t, head, "trailer: X-Checksum\r\n")
+	assert.Contains(t, head, "transfer-encoding: chunked\r\n")
+	assert.NotContains(t, head, "content-length")
+	assert.Equal(t, "4\r\ndata\r\n0\r\nx-checksum: 1234\r\n\r\n", body)
+
+	// Test: Unannounced trailer
+	trailers = headers.NewHeaders()
+	trailers.Set("X-Other", "1")
+	require.Error(t, w.WriteTrailers(trailers))
+
+	// Test: Framing fields can't be trailers
+	w = NewWriter()
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	require.Error(t, w.AnnounceTrailers("Content-Length"))
+
+	// Test: Trailers need a chunked body
+	w = NewWriter()
+	w.WriteStatusLine(StatusOK)
+	h := GetDefaultHeaders(0)
+	h.Set("trailer", "X-Checksum")
+	w.WriteHeaders(h)
+	trailers = headers.NewHeaders()
+	trailers.Set("X-Checksum", "1234")
+	require.Error(t, w.WriteTrailers(trailers))
+}
+
+func TestDigestWriter(t *testing.T) {
+	// Test: Announced trailers are filled in after streaming
+	w := NewWriter()
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	require.NoError(t, w.AnnounceTrailers("X-Content-SHA256", "X-Content-Length", "Content-Digest", "Repr-Digest"))
+	d := NewDigestWriter(w)
+	io.CopyBuffer(d, io.LimitReader(strings.NewReader("hello world"), 100), make([]byte, 4))
+	require.NoError(t, d.Close())
+	_, body := splitResponse(t, w.Bytes())
+	assert.True(t, strings.HasPrefix(body, "4\r\nhell\r\n4\r\no wo\r\n3\r\nrld\r\n0\r\n"))
+	assert.Contains(t, body, "x-content-sha256: b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9\r\n")
+	assert.Contains(t, body, "x-content-length: 11\r\n")
+	assert.Contains(t, body, "content-digest: sha-256=:uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=:\r\n")
+	assert.Contains(t, body, "repr-digest: sha-256=:uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=:\r\n")
+	assert.True(t, strings.HasSuffix(body, "\r\n\r\n"))
+
+	// Test: Only announced trailers are sent, and no Repr-Digest for encoded content
+	w = NewWriter()
+	w.WriteStatusLine(StatusOK)
+	h := GetDefaultHeaders(0)
+	h.Set("content-encoding", "gzip")
+	w.WriteHeaders(h)
+	require.NoError(t, w.AnnounceTrailers("X-Content-Length", "Repr-Digest"))
+	d = NewDigestWriter(w)
+	d.Write([]byte("abc"))
+	require.NoError(t, d.Close())
+	_, body = splitResponse(t, w.Bytes())
+	assert.Equal(t, "3\r\nabc\r\n0\r\nx-content-length: 3\r\n\r\n", body)
+}
+
+func TestStreamingWriter(t *testing.T) {
+	// Test: Nothing goes out before a flush, and an unflushed response is sent as-is
+	out := &bytes.Buffer{}
+	w := NewStreamingWriter(out)
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	w.WriteBody([]byte("hello"))
+	assert.Equal(t, 0, out.Len())
+	require.NoError(t, w.Finish())
+	head, body := splitResponse(t, out.Bytes())
+	assert.Contains(t, head, "content-length: 5\r\n")
+	assert.Equal(t, "hello", body)
+
+	// Test: Flushing commits the headers and switches to chunked
+	out = &bytes.Buffer{}
+	w = NewStreamingWriter(out)
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	w.WriteBody([]byte("hello"))
+	require.NoError(t, w.Flush())
+	head, body = splitResponse(t, out.Bytes())
+	assert.Contains(t, head, "transfer-encoding: chunked\r\n")
+	assert.NotContains(t, head, "content-length")
+	assert.Equal(t, "5\r\nhello\r\n", body)
+
+	// Test: Headers can't change once they're out
+	require.Error(t, w.WriteHeaders(GetDefaultHeaders(0)))
+
+	// Test: Later writes stream as chunks, Finish ends the body once
+	w.WriteBody([]byte("!"))
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Finish())
+	_, body = splitResponse(t, out.Bytes())
+	assert.Equal(t, "5\r\nhello\r\n1\r\n!\r\n0\r\n\r\n", body)
+
+	// Test: Abort leaves the body unterminated
+	out.Reset()
+	w = NewStreamingWriter(out)
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	w.WriteBody([]byte("half"))
+	require.NoError(t, w.Flush())
+	w.Abort()
+	require.NoError(t, w.Finish())
+	assert.True(t, w.Aborted())
+	_, body = splitResponse(t, out.Bytes())
+	assert.Equal(t, "4\r\nhalf\r\n", body)
+
+	// Test: Flush needs an output
+	w = NewWriter()
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	require.ErrorIs(t, w.Flush(), ERROR_NOT_STREAMING)
+}
+
+func TestMultipartWriter(t *testing.T) {
+	var body bytes.Buffer
+	m := NewMultipartWriter(&body)
+	b := m.Boundary()
+
+	// Test: Parts with their headers, then the close delimiter
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	h.Set("Content-Range", "bytes 0-4/10")
+	part, err := m.CreatePart(h)
+	require.NoError(t, err)
+	io.WriteString(part, "hello")
+	part, err = m.CreatePart(headers.NewHeaders())
+	require.NoError(t, err)
+	io.WriteString(part, "world")
+	require.NoError(t, m.Close())
+	assert.Equal(t, "--"+b+"\r\ncontent-range: bytes 0-4/10\r\ncontent-type: text/plain\r\n\r\nhello"+
+		"\r\n--"+b+"\r\n\r\nworld"+
+		"\r\n--"+b+"--\r\n", body.String())
+	assert.Equal(t, "multipart/byteranges; boundary="+b, m.ContentType("byteranges"))
+
+	// Test: Nothing after Close
+	_, err = m.CreatePart(h)
+	assert.ErrorIs(t, err, ERROR_MULTIPART_CLOSED)
+	assert.NotEqual(t, b, NewMultipartWriter(&body).Boundary())
+}
+
+func TestSetCookie(t *testing.T) {
+	w := NewWriter()
+
+	// Test: Each cookie gets its own line, before or after WriteHeaders
+	require.NoError(t, w.SetCookie(&headers.Cookie{Name: "a", Value: "1", Path: "/"}))
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	require.NoError(t, w.SetCookie(&headers.Cookie{Name: "b", Value: "2", HttpOnly: true}))
+	assert.ErrorIs(t, w.SetCookie(&headers.Cookie{Name: "c", SameSite: headers.SameSiteNone}), headers.ERROR_INVALID_COOKIE)
+	w.WriteBody([]byte("ok"))
+	head, _ := splitResponse(t, w.Bytes())
+	assert.Contains(t, head, "\r\nset-cookie: a=1; Path=/\r\n")
+	assert.Contains(t, head, "\r\nset-cookie: b=2; HttpOnly\r\n")
+
+	// Test: Too late once the head is out
+	assert.ErrorIs(t, w.SetCookie(&headers.Cookie{Name: "d"}), ERROR_ALREADY_COMMITTED)
+}
@@ -0,0 +1,134 @@
+package response
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+var ERROR_NOT_STREAMING = errors.New("Writer isn't connected to an output")
+var ERROR_ALREADY_COMMITTED = errors.New("Response headers were already sent")
+var ERROR_NOT_HIJACKABLE = errors.New("Writer isn't backed by a connection")
+
+// NewStreamingWriter works like NewWriter, except the response can be pushed
+// to out with Flush while the handler is still running. Until then everything
+// stays buffered, so handlers that never flush don't notice a difference.
+func NewStreamingWriter(out io.Writer) *Writer {
+	w := NewWriter()
+	w.out = out
+	return w
+}
+
+// Flush sends everything written so far. The first flush commits the status
+// line and headers, and since the final length isn't known yet the body goes
+// chunked from then on.
+func (w *Writer) Flush() error {
+	if w.out == nil {
+		return ERROR_NOT_STREAMING
+	}
+	if !w.committed {
+		if w.state != StateHeaders && w.state != StateBody {
+			return errors.New("You need to write headers first.")
+		}
+		if !w.isChunked() && !w.bodyless() {
+			pending := bytes.Clone(w.body.Bytes())
+			w.body.Reset()
+			w.headers.Set("transfer-encoding", "chunked")
+			if _, err := w.WriteChunkedBody(pending); err != nil {
+				return err
+			}
+		}
+		w.writeHead(0)
+	}
+
+	if w.omitBody {
+		w.body.Reset()
+	}
+	if _, err := w.out.Write(w.buf.Bytes()); err != nil {
+		return err
+	}
+	w.buf.Reset()
+	_, err := w.out.Write(w.body.Bytes())
+	w.body.Reset()
+	return err
+}
+
+// Finish sends whatever is left of the response, the server calls it once the
+// handler returns.
+func (w *Writer) Finish() error {
+	if w.out == nil {
+		return ERROR_NOT_STREAMING
+	}
+	if w.state == StateDone {
+		return nil
+	}
+	if !w.committed {
+		p := w.Bytes()
+		w.state = StateDone
+		_, err := w.out.Write(p)
+		return err
+	}
+	if !w.omitBody {
+		w.writeTail()
+	}
+	w.state = StateDone
+	return w.Flush()
+}
+
+// Abort gives up on the response, nothing else gets written. Once the head is
+// out that's the only honest way to fail halfway: finishing the body would tell
+// the client it got all of it. The connection has to be closed afterwards.
+func (w *Writer) Abort() {
+	w.aborted = true
+	w.state = StateDone
+}
+
+func (w *Writer) Aborted() bool {
+	return w.aborted
+}
+
+// Closing is true when the response ends the connection, because its headers
+// say so or because it was aborted.
+func (w *Writer) Closing() bool {
+	if w.aborted {
+		return true
+	}
+	for _, t := range strings.Split(w.headers.Get("connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(t), "close") {
+			return true
+		}
+	}
+	return false
+}
+
+// Hijacker is whatever owns the connection under a writer, the server in
+// practice.
+type Hijacker interface {
+	Hijack() (net.Conn, []byte, error)
+}
+
+func (w *Writer) SetHijacker(h Hijacker) {
+	w.hijacker = h
+}
+
+// Hijack hands the raw connection over to the handler, for protocols that
+// stop speaking HTTP halfway through. Along with it come the bytes the request
+// parser already read past the request, they belong to the new protocol. From
+// here on the connection is the caller's to close, neither the writer nor the
+// server touch it again.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if w.hijacker == nil {
+		return nil, nil, ERROR_NOT_HIJACKABLE
+	}
+	if w.committed {
+		return nil, nil, ERROR_ALREADY_COMMITTED
+	}
+	conn, buffered, err := w.hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.state = StateDone
+	return conn, buffered, nil
+}
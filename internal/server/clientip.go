@@ -0,0 +1,79 @@
+package server
+
+import (
+	"httpfromtcp/internal/headers"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+func (s *Server) isTrusted(ip netip.Addr) bool {
+	for _, p := range s.trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor lists the addresses the proxies reported, the client's first.
+// Forwarded (RFC 7239) wins over X-Forwarded-For when both are there.
+func forwardedFor(h headers.Headers) []string {
+	var hops []string
+	if f := h.Get("forwarded"); f != "" {
+		for _, elem := range strings.Split(f, ",") {
+			node := "" // an element without for= still takes its place in the chain
+			for _, pair := range strings.Split(elem, ";") {
+				k, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(k, "for") {
+					node = strings.Trim(v, `"`)
+				}
+			}
+			hops = append(hops, node)
+		}
+		return hops
+	}
+	for _, hop := range strings.Split(h.Get("x-forwarded-for"), ",") {
+		if hop = strings.TrimSpace(hop); hop != "" {
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseNode takes "192.0.2.1", "192.0.2.1:80", "2001:db8::1" or
+// "[2001:db8::1]:80".
+func parseNode(node string) (netip.Addr, bool) {
+	if ap, err := netip.ParseAddrPort(node); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(node, "["), "]"))
+	return ip.Unmap(), err == nil
+}
+
+// clientIP walks the forwarding chain from the right, past every trusted
+// proxy, and stops at the first address it can't vouch for. Anything left of
+// that could have been made up by the client.
+func (s *Server) clientIP(remoteAddr string, h headers.Headers) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip, ok := parseNode(host)
+	if !ok || !s.isTrusted(ip) {
+		return host
+	}
+
+	hops := forwardedFor(h)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseNode(hops[i])
+		if !ok {
+			break // "unknown", an obfuscated name or junk, the chain ends here
+		}
+		ip = hop
+		if !s.isTrusted(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
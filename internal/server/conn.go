@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"httpfromtcp/internal/request"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// conn is the server's side of one client connection.
+type conn struct {
+	id       uint64
+	rwc      net.Conn
+	reader   *request.ConnReader
+	hijacked bool
+
+	// while a handler runs, a background read notices the client leaving
+	bgDone     chan struct{} // closed once the background read returns, nil when none runs
+	bgStopping atomic.Bool
+	bgRead     []byte // what it got if the client sent more, the next request reads it first
+}
+
+func newConn(rwc net.Conn, id uint64) *conn {
+	c := &conn{id: id, rwc: rwc}
+	c.reader = request.NewConnReader(c)
+	return c
+}
+
+// Read hands out what the background read took before reading the connection.
+func (c *conn) Read(p []byte) (int, error) {
+	if len(c.bgRead) > 0 {
+		n := copy(p, c.bgRead)
+		c.bgRead = c.bgRead[n:]
+		return n, nil
+	}
+	return c.rwc.Read(p)
+}
+
+// startBackgroundRead calls cancel when the client closes the connection or
+// it breaks. A client that sends more instead is still there, so that just
+// ends the watch and the byte is kept for Hijack.
+func (c *conn) startBackgroundRead(cancel context.CancelFunc) {
+	c.bgDone = make(chan struct{})
+	c.bgStopping.Store(false)
+	go func() {
+		defer close(c.bgDone)
+		buf := make([]byte, 1)
+		n, _ := c.rwc.Read(buf)
+		c.bgRead = append(c.bgRead, buf[:n]...) // a pipelined request may not have used the last one yet
+		if n == 0 && !c.bgStopping.Load() {
+			cancel()
+		}
+	}()
+}
+
+func (c *conn) stopBackgroundRead() {
+	if c.bgDone == nil {
+		return
+	}
+	c.bgStopping.Store(true)
+	c.rwc.SetReadDeadline(time.Unix(1, 0)) // wakes the read up
+	<-c.bgDone
+	c.rwc.SetReadDeadline(time.Time{})
+	c.bgDone = nil
+}
+
+func (c *conn) Hijack() (net.Conn, []byte, error) {
+	c.stopBackgroundRead()
+	c.hijacked = true
+	buffered := append([]byte(nil), c.reader.Buffered()...)
+	buffered = append(buffered, c.bgRead...)
+	return c.rwc, buffered, nil
+}
+
+func (c *conn) close() {
+	if !c.hijacked {
+		c.rwc.Close()
+	}
+}
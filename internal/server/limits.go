@@ -0,0 +1,151 @@
+package server
+
+import (
+	"httpfromtcp/internal/response"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Retry-After on 503s when WithRejectWhenFull didn't say.
+const DefaultRetryAfter = time.Second
+
+// How long a rejected client gets to take its 503.
+const rejectTimeout = time.Second
+
+// WithMaxConns caps how many connections are handled at once, 0 means no cap.
+// Past it the server stops accepting, so new connections wait in the
+// listener's backlog, unless WithRejectWhenFull says otherwise. Hijacked
+// connections stop counting once their handler returns.
+func WithMaxConns(n int) Option {
+	return func(s *Server) {
+		s.maxConns = n
+	}
+}
+
+// WithMaxConnsPerIP caps the connections a single peer address can have open,
+// 0 means no cap. The backlog is shared by everyone, so connections past this
+// one always get a 503.
+func WithMaxConnsPerIP(n int) Option {
+	return func(s *Server) {
+		s.maxPerIP = n
+	}
+}
+
+// WithRejectWhenFull answers connections past WithMaxConns with a 503 and a
+// Retry-After of retryAfter (rounded up to seconds, 0 means DefaultRetryAfter)
+// instead of letting them wait.
+func WithRejectWhenFull(retryAfter time.Duration) Option {
+	return func(s *Server) {
+		s.rejectWhenFull = true
+		s.retryAfter = retryAfter
+	}
+}
+
+// WithWorkers handles connections on a fixed pool of n goroutines instead of
+// one goroutine each, which also caps connections at n.
+func WithWorkers(n int) Option {
+	return func(s *Server) {
+		s.workers = n
+	}
+}
+
+// limiter counts connections, overall and by peer IP.
+type limiter struct {
+	slots    chan struct{} // nil when there's no overall cap
+	maxPerIP int
+
+	mu   sync.Mutex
+	byIP map[string]int
+}
+
+func newLimiter(maxConns, maxPerIP int) *limiter {
+	l := &limiter{maxPerIP: maxPerIP, byIP: make(map[string]int)}
+	if maxConns > 0 {
+		l.slots = make(chan struct{}, maxConns)
+	}
+	return l
+}
+
+// acquire takes an overall slot, waiting for one if wait is set. done gives
+// up the wait.
+func (l *limiter) acquire(wait bool, done <-chan struct{}) bool {
+	if l.slots == nil {
+		return true
+	}
+	if !wait {
+		select {
+		case l.slots <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (l *limiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (l *limiter) acquireIP(ip string) bool {
+	if l.maxPerIP <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.byIP[ip] >= l.maxPerIP {
+		return false
+	}
+	l.byIP[ip]++
+	return true
+}
+
+func (l *limiter) releaseIP(ip string) {
+	if l.maxPerIP <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.byIP[ip]--; l.byIP[ip] <= 0 {
+		delete(l.byIP, ip)
+	}
+}
+
+func peerIP(rwc net.Conn) string {
+	host, _, err := net.SplitHostPort(rwc.RemoteAddr().String())
+	if err != nil {
+		return rwc.RemoteAddr().String()
+	}
+	return host
+}
+
+// reject tells the client to come back later and hangs up, without reading
+// what it sent.
+func (s *Server) reject(rwc net.Conn) {
+	s.observer.ConnRejected()
+	defer rwc.Close()
+	rwc.SetDeadline(time.Now().Add(rejectTimeout))
+
+	retryAfter := s.retryAfter
+	if retryAfter <= 0 {
+		retryAfter = DefaultRetryAfter
+	}
+	message := "Too many connections, try again later"
+	h := response.GetDefaultHeaders(len(message))
+	h.Set("retry-after", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	writer := response.NewStreamingWriter(rwc)
+	writer.SetServerName(s.serverName)
+	writer.WriteStatusLine(response.StatusServiceUnavailable)
+	writer.WriteHeaders(h)
+	writer.WriteBody([]byte(message))
+	writer.Finish()
+}
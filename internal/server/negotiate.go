@@ -0,0 +1,19 @@
+package server
+
+import (
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+)
+
+// Negotiate picks the media type out of offers that the request's Accept
+// header likes best, offers go in order of preference. When none of them is
+// acceptable it returns a 406 listing what there is, ready to Respond with.
+// Responses that depend on it should say so with Vary: Accept.
+func Negotiate(req *request.Request, offers ...string) (string, *HandlerError) {
+	if offer, ok := headers.NegotiateMediaType(req.Headers.Get("accept"), offers...); ok {
+		return offer, nil
+	}
+	return "", NewHandlerError(response.StatusNotAcceptable, "Not acceptable, available: "+strings.Join(offers, ", "))
+}
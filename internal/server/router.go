@@ -0,0 +1,127 @@
+package server
+
+import (
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"slices"
+	"strings"
+)
+
+type Router struct {
+	routes   map[string]map[string]Handler // pattern -> method -> handler
+	patterns []string
+}
+
+func NewRouter() *Router {
+	return &Router{
+		routes: make(map[string]map[string]Handler),
+	}
+}
+
+func (rt *Router) Handle(method string, pattern string, handler Handler) {
+	methods, ok := rt.routes[pattern]
+	if !ok {
+		methods = make(map[string]Handler)
+		rt.routes[pattern] = methods
+		rt.patterns = append(rt.patterns, pattern)
+	}
+	methods[method] = handler
+}
+
+// Exact patterns win, otherwise a pattern ending in "/" matches everything
+// below it and the longest one takes the request.
+func (rt *Router) match(path string) (string, bool) {
+	if _, ok := rt.routes[path]; ok {
+		return path, true
+	}
+
+	best := ""
+	for _, p := range rt.patterns {
+		if strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) && len(p) > len(best) {
+			best = p
+		}
+	}
+	return best, best != ""
+}
+
+func allowed(methods map[string]Handler) string {
+	seen := map[string]bool{"OPTIONS": true}
+	for m := range methods {
+		seen[m] = true
+		if m == "GET" {
+			seen["HEAD"] = true // HEAD falls back to GET, so it's allowed too
+		}
+	}
+
+	allow := make([]string, 0, len(seen))
+	for m := range seen {
+		allow = append(allow, m)
+	}
+	slices.Sort(allow)
+	return strings.Join(allow, ", ")
+}
+
+func writeAllow(w *response.Writer, code response.StatusCode, allow string) {
+	w.WriteStatusLine(code)
+	h := response.GetDefaultHeaders(0)
+	h.Set("allow", allow)
+	w.WriteHeaders(h)
+	if code != response.StatusNoContent {
+		w.WriteBody([]byte(code.String()))
+	}
+}
+
+// Route names the pattern req would be handled by, "" when nothing matches.
+// Unlike the path it's safe to use as a metrics label.
+func (rt *Router) Route(req *request.Request) string {
+	if req.RequestLine.Method == "OPTIONS" && req.RequestLine.RequestTarget == "*" {
+		return "*"
+	}
+	path, _, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+	pattern, _ := rt.match(path)
+	return pattern
+}
+
+func (rt *Router) Serve(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+	target := req.RequestLine.RequestTarget
+
+	if method == "OPTIONS" && target == "*" { // asks about the server as a whole
+		all := make(map[string]Handler)
+		for _, methods := range rt.routes {
+			for m, h := range methods {
+				all[m] = h
+			}
+		}
+		writeAllow(w, response.StatusNoContent, allowed(all))
+		return
+	}
+
+	path, _, _ := strings.Cut(target, "?")
+	pattern, ok := rt.match(path)
+	if !ok {
+		w.WriteStatusLine(response.StatusNotFound)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		w.WriteBody([]byte(response.StatusNotFound.String()))
+		return
+	}
+
+	methods := rt.routes[pattern]
+	if h, ok := methods[method]; ok {
+		h(w, req)
+		return
+	}
+
+	switch method {
+	case "HEAD":
+		if h, ok := methods["GET"]; ok {
+			h(w, req) // the server drops the body, headers stay as GET would send them
+			return
+		}
+	case "OPTIONS":
+		writeAllow(w, response.StatusNoContent, allowed(methods))
+		return
+	}
+
+	writeAllow(w, response.StatusMethodNotAllowed, allowed(methods))
+}
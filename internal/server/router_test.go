@@ -0,0 +1,89 @@
+package server
+
+import (
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serveRaw(t *testing.T, h Handler, raw string) string {
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	w := response.NewWriter()
+	if req.RequestLine.Method == "HEAD" {
+		w.OmitBody()
+	}
+	h(w, req)
+	return string(w.Bytes())
+}
+
+func hello(w *response.Writer, req *request.Request) {
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.GetDefaultHeaders(0))
+	w.WriteBody([]byte("hello"))
+}
+
+func TestRouter(t *testing.T) {
+	router := NewRouter()
+	router.Handle("GET", "/hello", hello)
+	router.Handle("POST", "/submit", hello)
+	router.Handle("GET", "/static/", hello)
+
+	// Test: Exact match
+	res := serveRaw(t, router.Serve, "GET /hello?x=1 HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nhello"))
+
+	// Test: Prefix match
+	res = serveRaw(t, router.Serve, "GET /static/css/site.css HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"))
+
+	// Test: Unknown path
+	res = serveRaw(t, router.Serve, "GET /nope HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Wrong method
+	res = serveRaw(t, router.Serve, "DELETE /hello HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, res, "allow: GET, HEAD, OPTIONS\r\n")
+
+	// Test: Route names the pattern, not the path
+	route := func(target string) string {
+		return router.Route(&request.Request{RequestLine: request.RequestLine{Method: "GET", RequestTarget: target}})
+	}
+	assert.Equal(t, "/static/", route("/static/css/site.css?v=2"))
+	assert.Equal(t, "/hello", route("/hello"))
+	assert.Equal(t, "", route("/nope"))
+}
+
+func TestRouterHeadAndOptions(t *testing.T) {
+	router := NewRouter()
+	router.Handle("GET", "/hello", hello)
+	router.Handle("POST", "/submit", hello)
+
+	// Test: HEAD runs the GET handler but keeps only the headers
+	res := serveRaw(t, router.Serve, "HEAD /hello HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, res, "content-length: 5\r\n")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\n"))
+
+	// Test: HEAD on a route without GET
+	res = serveRaw(t, router.Serve, "HEAD /submit HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\n"))
+
+	// Test: OPTIONS on a path
+	res = serveRaw(t, router.Serve, "OPTIONS /submit HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 204 No Content\r\n"))
+	assert.Contains(t, res, "allow: OPTIONS, POST\r\n")
+	assert.NotContains(t, res, "content-length")
+
+	// Test: OPTIONS * covers every route
+	res = serveRaw(t, router.Serve, "OPTIONS * HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 204 No Content\r\n"))
+	assert.Contains(t, res, "allow: GET, HEAD, OPTIONS, POST\r\n")
+}
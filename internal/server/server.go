@@ -1,12 +1,22 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/proxyproto"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
 	"io"
+	"log/slog"
 	"net"
+	"net/netip"
+	"strings"
 	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type ServerState = int
@@ -18,6 +28,17 @@ const (
 
 type Handler func(w *response.Writer, req *request.Request)
 
+// Middleware wraps a handler to do something before and/or after it.
+type Middleware func(next Handler) Handler
+
+// Chain wraps h in mws, the first one ends up outermost so it runs first.
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
 type HandlerError struct {
 	code    response.StatusCode
 	message string
@@ -31,64 +52,428 @@ func NewHandlerError(code response.StatusCode, message string) *HandlerError {
 }
 
 type Server struct {
-	listener net.Listener
-	closed   atomic.Bool
-	handler  Handler
+	listener   net.Listener
+	closed     atomic.Bool
+	handler    Handler
+	serverName string
+	observer   Observer
+	ctx        context.Context // parent of every request's context, cancelled by Close
+	cancel     context.CancelFunc
+	connIDs    atomic.Uint64
+	idle       time.Duration
+	readHeader time.Duration
+	maxBody    int64
+	tlsConfig  *tls.Config
+	trusted    []netip.Prefix
+	proxyProto *proxyproto.Options
+	errorLog   *slog.Logger
+	done       chan struct{} // closed once listen returns
+	err        error         // why it returned, nil after Close
+
+	maxConns       int
+	maxPerIP       int
+	rejectWhenFull bool
+	retryAfter     time.Duration
+	workers        int
+	limiter        *limiter
+	work           chan net.Conn // feeds the workers, nil without a pool
+}
+
+// How long a kept-alive connection may sit between requests.
+const DefaultIdleTimeout = 60 * time.Second
+
+// Request bodies are read into memory whole, this is how big they can get.
+const DefaultMaxBodyBytes = 32 << 20
+
+// Observer hears about what happens to connections before any handler sees
+// them, metrics.ServerMetrics is one. Calls come from many goroutines at once.
+type Observer interface {
+	ConnAccepted()
+	ConnRejected()
+	ConnClosed()
+	ParseError(kind string)     // kind is one of the ParseError* constants
+	AcceptError(temporary bool) // the listener failed, temporary errors are retried
+}
+
+const (
+	ParseErrorRequestLine   = "request_line"
+	ParseErrorHeader        = "header"
+	ParseErrorContentLength = "content_length"
+	ParseErrorProxyHeader   = "proxy_header"
+	ParseErrorTimeout       = "timeout"
+	ParseErrorIO            = "io"
+)
+
+type nopObserver struct{}
+
+func (nopObserver) ConnAccepted()     {}
+func (nopObserver) ConnRejected()     {}
+func (nopObserver) ConnClosed()       {}
+func (nopObserver) ParseError(string) {}
+func (nopObserver) AcceptError(bool)  {}
+
+type Option func(*Server)
+
+// WithServerName sets the Server header sent on every response, an empty name
+// turns it off.
+func WithServerName(name string) Option {
+	return func(s *Server) {
+		s.serverName = name
+	}
+}
+
+// WithIdleTimeout sets how long a connection is kept open waiting for the next
+// request, 0 means DefaultIdleTimeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idle = d
+	}
+}
+
+// WithReadHeaderTimeout sets how long a new connection has to send its first
+// request line and headers, the TLS handshake included. 0 means the idle
+// timeout.
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.readHeader = d
+	}
+}
+
+// WithMaxBodyBytes sets how big a request body can be, bigger ones get a 413
+// before any of the body is read. 0 means DefaultMaxBodyBytes.
+func WithMaxBodyBytes(n int64) Option {
+	return func(s *Server) {
+		s.maxBody = n
+	}
+}
+
+// WithTLSConfig serves HTTPS, config needs at least one certificate.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
+
+// WithTrustedProxies makes the server believe X-Forwarded-For and Forwarded
+// when they come from these networks, see Request.ClientIP.
+func WithTrustedProxies(prefixes ...netip.Prefix) Option {
+	return func(s *Server) {
+		s.trusted = prefixes
+	}
+}
+
+// WithProxyProtocol reads a PROXY protocol header off connections from
+// opts.Trusted, RemoteAddr and LocalAddr are then the ones the proxy reported.
+func WithProxyProtocol(opts proxyproto.Options) Option {
+	return func(s *Server) {
+		s.proxyProto = &opts
+	}
+}
+
+// WithErrorLog sets where accept errors go, nil means slog.Default().
+func WithErrorLog(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.errorLog = logger
+	}
+}
+
+func WithObserver(o Observer) Option {
+	return func(s *Server) {
+		s.observer = o
+	}
+}
+
+func (h *HandlerError) Respond(w *response.Writer) {
+	w.WriteStatusLine(h.code)
+	w.WriteHeaders(response.GetDefaultHeaders(len(h.message)))
+	w.WriteBody([]byte(h.message))
 }
 
 func (h *HandlerError) Write(w io.Writer) error {
-	response.WriteStatusLine(w, h.code)
-	response.WriteHeaders(w, response.GetDefaultHeaders(len(h.message)))
-	_, err := fmt.Fprintf(w, "\r\n%s", h.message)
+	writer := response.NewWriter()
+	h.Respond(writer)
+	_, err := w.Write(writer.Bytes())
 	return err
 }
 
-func Serve(port int, handler Handler) (*Server, error) {
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, err
 	}
+	return serveListener(listener, handler, opts...), nil
+}
 
+func serveListener(listener net.Listener, handler Handler, opts ...Option) *Server {
 	server := &Server{
-		listener: listener,
-		handler:  handler,
+		listener:   listener,
+		handler:    handler,
+		serverName: response.DefaultServerName,
+		observer:   nopObserver{},
+	}
+	server.ctx, server.cancel = context.WithCancel(context.Background())
+	server.done = make(chan struct{})
+	for _, opt := range opts {
+		opt(server)
+	}
+	if server.errorLog == nil {
+		server.errorLog = slog.Default()
+	}
+	if server.idle <= 0 {
+		server.idle = DefaultIdleTimeout
+	}
+	if server.readHeader <= 0 {
+		server.readHeader = server.idle
+	}
+	if server.maxBody <= 0 {
+		server.maxBody = DefaultMaxBodyBytes
+	}
+	maxConns := server.maxConns
+	if server.workers > 0 && (maxConns <= 0 || maxConns > server.workers) {
+		maxConns = server.workers // a connection waiting for a worker would be stuck anyway
+	}
+	server.limiter = newLimiter(maxConns, server.maxPerIP)
+	if server.workers > 0 {
+		server.work = make(chan net.Conn)
+		for range server.workers {
+			go func() {
+				for conn := range server.work {
+					server.handle(conn)
+				}
+			}()
+		}
+	}
+	if server.proxyProto != nil {
+		server.listener = proxyproto.NewListener(server.listener, *server.proxyProto)
+	}
+	if server.tlsConfig != nil {
+		server.listener = tls.NewListener(server.listener, server.tlsConfig) // the PROXY header comes before the handshake
 	}
 	go server.listen()
 
-	return server, nil
+	return server
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
 }
 
+// Close stops accepting connections and cancels the context of every request
+// still being handled.
 func (s *Server) Close() error {
 	s.closed.Store(true)
+	s.cancel()
 	return s.listener.Close()
 }
 
+// Wait blocks until the server stops accepting connections, from Close or
+// because the listener broke, and returns Err.
+func (s *Server) Wait() error {
+	<-s.done
+	return s.err
+}
+
+// Err is the error that stopped the server, nil while it runs or after Close.
+func (s *Server) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Accept backs off from minAcceptDelay up to maxAcceptDelay while it keeps
+// failing, the same as net/http.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// isTemporary tells accept errors that go away by themselves (out of file
+// descriptors or memory, a client that gave up during the handshake) from a
+// listener that's broken for good.
+func isTemporary(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EINTR, syscall.EAGAIN} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return isTimeout(err)
+}
+
 func (s *Server) listen() {
+	defer close(s.done)
+	if s.work != nil {
+		defer close(s.work)
+	}
+	wait := !s.rejectWhenFull
+	var delay time.Duration
 	for {
+		// when full, waiting clients stay in the backlog until a slot frees up
+		if wait && !s.limiter.acquire(true, s.ctx.Done()) {
+			return
+		}
 		conn, err := s.listener.Accept()
 		if err != nil {
+			if wait {
+				s.limiter.release()
+			}
 			if s.closed.Load() {
 				return
 			}
+			temporary := isTemporary(err)
+			s.observer.AcceptError(temporary)
+			if !temporary {
+				s.errorLog.Error("httpfromtcp: accept failed, server stopped", "addr", s.listener.Addr().String(), "error", err)
+				s.err = err
+				s.Close()
+				return
+			}
+			delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+			s.errorLog.Warn("httpfromtcp: accept failed, retrying", "error", err, "delay", delay)
+			select {
+			case <-time.After(delay):
+			case <-s.ctx.Done():
+			}
+			continue
+		}
+		delay = 0
+		if !wait && !s.limiter.acquire(false, nil) {
+			go s.reject(conn) // a TLS handshake could take a while, not on this goroutine
 			continue
 		}
 
-		go s.handle(conn)
+		if s.work != nil {
+			s.work <- conn
+		} else {
+			go s.handle(conn)
+		}
 	}
 }
 
-func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+func (s *Server) newWriter(c *conn) *response.Writer {
+	writer := response.NewStreamingWriter(c.rwc)
+	writer.SetServerName(s.serverName)
+	writer.SetHijacker(c)
+	return writer
+}
 
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		e := NewHandlerError(response.StatusBadRequest, err.Error()) // the error text we defined in request package
-		e.Write(conn)
+func parseErrorKind(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, request.ERROR_MALFORMED_REQUEST_LINE):
+		return ParseErrorRequestLine
+	case errors.Is(err, headers.ERROR_INVALID_FIELD_LINE), errors.Is(err, headers.ERROR_DUPLUCATED_FIELD_LINE), errors.Is(err, request.ERROR_HEADERS_TOO_LARGE):
+		return ParseErrorHeader
+	case errors.Is(err, request.ERROR_INVALID_CONTENT_LENGTH), errors.Is(err, request.ERROR_BODY_TOO_LARGE):
+		return ParseErrorContentLength
+	case errors.Is(err, proxyproto.ERROR_MISSING_HEADER), errors.Is(err, proxyproto.ERROR_INVALID_HEADER), errors.Is(err, proxyproto.ERROR_BAD_CHECKSUM):
+		return ParseErrorProxyHeader
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ParseErrorTimeout
+	}
+	return ParseErrorIO
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func hasToken(value string, token string) bool {
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// handle serves requests on a connection one after the other, until one side
+// says close or the connection sits idle for too long.
+func (s *Server) handle(rwc net.Conn) {
+	defer s.limiter.release()
+	ip := peerIP(rwc) // with a PROXY header this reads it, not worth holding up the accept loop
+	if !s.limiter.acquireIP(ip) {
+		s.reject(rwc)
 		return
 	}
+	defer s.limiter.releaseIP(ip)
+	s.observer.ConnAccepted()
+	defer s.observer.ConnClosed()
+	c := newConn(rwc, s.connIDs.Add(1))
+	defer c.close()
+	c.reader.OnHead(func() { rwc.SetReadDeadline(time.Time{}) }) // bodies can take their time
+	c.reader.SetMaxBodyBytes(s.maxBody)
 
-	writer := response.NewWriter()
+	for num := 1; ; num++ {
+		timeout := s.idle
+		if num == 1 {
+			timeout = s.readHeader
+		}
+		rwc.SetReadDeadline(time.Now().Add(timeout))
+		req, err := c.reader.Next()
+		rwc.SetReadDeadline(time.Time{})
+		if err != nil {
+			if errors.Is(err, io.EOF) || (num > 1 && isTimeout(err)) {
+				return // closed or gave up before sending anything
+			}
+			s.observer.ParseError(parseErrorKind(err))
+			if isTimeout(err) {
+				return // too slow to be worth an answer
+			}
+			code := response.StatusBadRequest
+			switch {
+			case errors.Is(err, request.ERROR_HEADERS_TOO_LARGE):
+				code = response.StatusRequestHeaderFieldsTooLarge
+			case errors.Is(err, request.ERROR_BODY_TOO_LARGE):
+				code = response.StatusContentTooLarge
+			}
+			e := NewHandlerError(code, err.Error()) // the error text we defined in request package
+			writer := s.newWriter(c)
+			e.Respond(writer)
+			writer.Finish()
+			return
+		}
+		if !s.serve(c, req, num) {
+			return
+		}
+	}
+}
+
+// serve runs the handler for one request and tells whether the connection can
+// take another one.
+func (s *Server) serve(c *conn, req *request.Request, num int) bool {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	req = req.WithContext(ctx)
+	req.RemoteAddr = c.rwc.RemoteAddr().String()
+	req.LocalAddr = c.rwc.LocalAddr().String()
+	req.ClientIP = s.clientIP(req.RemoteAddr, req.Headers)
+	req.ConnID = c.id
+	req.RequestNum = num
+	if tc, ok := c.rwc.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		req.TLS = &state
+	}
+
+	writer := s.newWriter(c)
+	if req.RequestLine.Method == "HEAD" {
+		writer.OmitBody()
+	}
+	// no keep-alive for HTTP/1.0 and for bodies the parser can't frame
+	closing := req.RequestLine.HttpVersion != "1.1" || hasToken(req.Headers.Get("connection"), "close") || req.Headers.Get("transfer-encoding") != ""
+	if closing {
+		writer.SetDefaultHeader("connection", "close")
+	}
+
+	c.startBackgroundRead(cancel)
 	s.handler(writer, req)
-	p := writer.Bytes()
-	conn.Write(p)
+	c.stopBackgroundRead()
+	if c.hijacked {
+		return false
+	}
+	err := writer.Finish()
+	return err == nil && !closing && !writer.Closing() && !s.closed.Load()
 }
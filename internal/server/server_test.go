@@ -0,0 +1,485 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/proxyproto"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, handler Handler, opts ...Option) *Server {
+	srv, err := Serve(0, handler, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+func dial(t *testing.T, srv *Server) net.Conn {
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestHijack(t *testing.T) {
+	srv := startServer(t, func(w *response.Writer, req *request.Request) {
+		conn, buffered, err := w.Hijack()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("hijacked:"))
+		conn.Write(buffered)
+		// the handler returns but the connection lives on
+		go func() {
+			defer conn.Close()
+			more := make([]byte, 4)
+			io.ReadFull(conn, more)
+			conn.Write(more)
+		}()
+	})
+	conn := dial(t, srv)
+
+	// Test: Bytes sent right after the request come back with the connection
+	_, err := conn.Write([]byte("GET /tunnel HTTP/1.1\r\n\r\nEXTRA"))
+	require.NoError(t, err)
+	got := make([]byte, len("hijacked:EXTRA"))
+	_, err = io.ReadFull(conn, got)
+	require.NoError(t, err)
+	assert.Equal(t, "hijacked:EXTRA", string(got))
+
+	// Test: The server doesn't close a hijacked connection
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	rest, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(rest))
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				order = append(order, name)
+				next(w, req)
+			}
+		}
+	}
+	h := Chain(func(w *response.Writer, req *request.Request) {
+		order = append(order, "handler")
+	}, mark("outer"), mark("inner"))
+
+	// Test: The first middleware ends up outermost
+	h(response.NewWriter(), &request.Request{})
+	assert.Equal(t, []string{"outer", "inner", "handler"}, order)
+}
+
+func TestRequestContext(t *testing.T) {
+	started := make(chan struct{}, 1)
+	cancelled := make(chan error, 1)
+	srv := startServer(t, func(w *response.Writer, req *request.Request) {
+		started <- struct{}{}
+		<-req.Context().Done()
+		cancelled <- req.Context().Err()
+	})
+
+	// Test: Closing the connection cancels the handler's context
+	conn := dial(t, srv)
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	<-started
+	conn.Close()
+	select {
+	case err := <-cancelled:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("context wasn't cancelled")
+	}
+
+	// Test: So does shutting the server down
+	conn = dial(t, srv)
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	<-started
+	srv.Close()
+	select {
+	case err := <-cancelled:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("context wasn't cancelled")
+	}
+
+	// Test: A request outside a server still has a context
+	assert.NotNil(t, (&request.Request{}).Context())
+}
+
+// whoami answers with what the server told the handler about the connection.
+func whoami(w *response.Writer, req *request.Request) {
+	w.WriteStatusLine(response.StatusOK)
+	h := headers.NewHeaders() // no "connection: close", unlike the defaults
+	h.Set("content-type", "text/plain")
+	w.WriteHeaders(h)
+	tlsVersion := ""
+	if req.TLS != nil {
+		tlsVersion = tls.VersionName(req.TLS.Version)
+	}
+	w.WriteBody([]byte(fmt.Sprintf("%d %d %s %s %s", req.ConnID, req.RequestNum, req.LocalAddr, req.ClientIP, tlsVersion)))
+}
+
+func TestKeepAlive(t *testing.T) {
+	srv := startServer(t, whoami, WithIdleTimeout(100*time.Millisecond))
+	_, port, _ := net.SplitHostPort(srv.Addr().String())
+	base := "http://127.0.0.1:" + port
+	c := &client.Client{}
+
+	// Test: Requests on one connection share its ID and count up
+	res, err := c.Get(base)
+	require.NoError(t, err)
+	first := strings.Fields(string(res.Body))
+	res, err = c.Get(base)
+	require.NoError(t, err)
+	second := strings.Fields(string(res.Body))
+	assert.Equal(t, first[0], second[0])
+	assert.Equal(t, []string{"1", "2"}, []string{first[1], second[1]})
+	assert.Equal(t, "127.0.0.1:"+port, first[2])
+	assert.Equal(t, "127.0.0.1", first[3])
+
+	// Test: Pipelined requests are answered in order
+	conn := dial(t, srv)
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	all, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(all), "HTTP/1.1 200 OK"))
+	assert.Contains(t, string(all), "connection: close\r\n")
+
+	// Test: An idle connection gets closed
+	conn = dial(t, srv)
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	start := time.Now()
+	io.ReadAll(conn)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Test: A response saying close ends the connection too
+	srv = startServer(t, hello)
+	conn = dial(t, srv)
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	all, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(all), "HTTP/1.1 200 OK")
+}
+
+func TestSlowClients(t *testing.T) {
+	srv := startServer(t, whoami, WithReadHeaderTimeout(100*time.Millisecond))
+
+	// Test: A client that connects and sends nothing is hung up on
+	conn := dial(t, srv)
+	start := time.Now()
+	all, _ := io.ReadAll(conn)
+	assert.Empty(t, all)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Test: So is one that never finishes the TLS handshake
+	config := &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}}
+	tlsSrv := startServer(t, whoami, WithTLSConfig(config), WithReadHeaderTimeout(100*time.Millisecond))
+	conn = dial(t, tlsSrv)
+	start = time.Now()
+	io.ReadAll(conn)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Test: Headers that never end get a 431 instead of an ever bigger buffer
+	conn = dial(t, srv)
+	go func() {
+		conn.Write([]byte("GET / HTTP/1.1\r\nX-Big: "))
+		conn.Write([]byte(strings.Repeat("a", request.MaxHeaderBytes)))
+	}()
+	all, _ = io.ReadAll(conn)
+	assert.True(t, strings.HasPrefix(string(all), "HTTP/1.1 431 Request Header Fields Too Large\r\n"), string(all))
+
+	// Test: The timeout is for the head, a slow body still gets through
+	conn = dial(t, srv)
+	conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 2\r\nConnection: close\r\n\r\na"))
+	time.Sleep(200 * time.Millisecond)
+	conn.Write([]byte("b"))
+	all, _ = io.ReadAll(conn)
+	assert.Contains(t, string(all), "HTTP/1.1 200 OK")
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	srv := startServer(t, whoami, WithMaxBodyBytes(10))
+
+	// Test: A body over the limit gets a 413 before it's sent
+	conn := dial(t, srv)
+	conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 11\r\n\r\n"))
+	all, _ := io.ReadAll(conn)
+	assert.True(t, strings.HasPrefix(string(all), "HTTP/1.1 413 Content Too Large\r\n"), string(all))
+
+	// Test: Up to the limit is fine
+	conn = dial(t, srv)
+	conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 10\r\nConnection: close\r\n\r\n0123456789"))
+	all, _ = io.ReadAll(conn)
+	assert.Contains(t, string(all), "HTTP/1.1 200 OK")
+}
+
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLS(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}}
+	srv := startServer(t, whoami, WithTLSConfig(config))
+	_, port, _ := net.SplitHostPort(srv.Addr().String())
+
+	// Test: Handlers see the TLS state
+	c := &client.Client{TLSConfig: &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13}}
+	res, err := c.Get("https://127.0.0.1:" + port)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(res.Body), " TLS 1.3"), string(res.Body))
+
+	// Test: Plain connections don't
+	srv = startServer(t, whoami)
+	_, port, _ = net.SplitHostPort(srv.Addr().String())
+	res, err = c.Get("http://127.0.0.1:" + port)
+	require.NoError(t, err)
+	assert.Len(t, strings.Fields(string(res.Body)), 4)
+}
+
+func TestClientIP(t *testing.T) {
+	s := &Server{trusted: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("::1/128")}}
+	cases := []struct {
+		name    string
+		remote  string
+		headers headers.Headers
+		want    string
+	}{
+		{"untrusted peer is the client", "203.0.113.5:4000", headers.Headers{"x-forwarded-for": "1.2.3.4"}, "203.0.113.5"},
+		{"trusted peer, single hop", "10.0.0.1:4000", headers.Headers{"x-forwarded-for": "1.2.3.4"}, "1.2.3.4"},
+		{"spoofed entries left of the real client are ignored", "10.0.0.1:4000", headers.Headers{"x-forwarded-for": "6.6.6.6, 1.2.3.4, 10.0.0.2"}, "1.2.3.4"},
+		{"trusted peer without headers", "10.0.0.1:4000", headers.Headers{}, "10.0.0.1"},
+		{"Forwarded wins", "10.0.0.1:4000", headers.Headers{"forwarded": `for="[2001:db8::1]:80";proto=https, for=10.0.0.9`, "x-forwarded-for": "1.2.3.4"}, "2001:db8::1"},
+		{"unknown stops the walk", "10.0.0.1:4000", headers.Headers{"forwarded": "for=1.2.3.4, for=unknown"}, "10.0.0.1"},
+		{"IPv6 peer", "[::1]:4000", headers.Headers{"x-forwarded-for": "1.2.3.4"}, "1.2.3.4"},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.want, s.clientIP(tc.remote, tc.headers), tc.name)
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	srv := startServer(t, whoami, WithProxyProtocol(proxyproto.Options{
+		Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")},
+	}))
+
+	// Test: Handlers see the addresses from the header
+	conn := dial(t, srv)
+	conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	all, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(all), " 198.51.100.1:443 192.0.2.1 ")
+
+	// Test: A trusted peer without a header gets a 400
+	conn = dial(t, srv)
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	all, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(all), "HTTP/1.1 400 Bad Request")
+}
+
+func TestConnLimits(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan struct{}, 10)
+	block := func(w *response.Writer, req *request.Request) {
+		entered <- struct{}{}
+		<-release
+		hello(w, req)
+	}
+	send := func(srv *Server) net.Conn {
+		conn := dial(t, srv)
+		conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		return conn
+	}
+	answered := func(conn net.Conn, within time.Duration) string {
+		conn.SetReadDeadline(time.Now().Add(within))
+		all, _ := io.ReadAll(conn)
+		return string(all)
+	}
+
+	// Test: Past the limit, connections wait their turn
+	srv := startServer(t, block, WithMaxConns(1))
+	first := send(srv)
+	<-entered
+	second := send(srv)
+	assert.Empty(t, answered(second, 100*time.Millisecond))
+	release <- struct{}{}
+	assert.Contains(t, answered(first, time.Second), "200 OK")
+	<-entered
+	release <- struct{}{}
+	assert.Contains(t, answered(second, time.Second), "200 OK")
+
+	// Test: Or get turned away right away
+	srv = startServer(t, block, WithMaxConns(1), WithRejectWhenFull(1500*time.Millisecond))
+	first = send(srv)
+	<-entered
+	out := answered(dial(t, srv), time.Second)
+	assert.Contains(t, out, "HTTP/1.1 503 Service Unavailable")
+	assert.Contains(t, out, "retry-after: 2\r\n")
+	release <- struct{}{}
+	answered(first, time.Second)
+
+	// Test: One address can't take every connection
+	srv = startServer(t, block, WithMaxConnsPerIP(1))
+	first = send(srv)
+	<-entered
+	assert.Contains(t, answered(dial(t, srv), time.Second), "retry-after: 1\r\n")
+	release <- struct{}{}
+	answered(first, time.Second)
+
+	// Test: A worker pool never runs more handlers than it has workers
+	srv = startServer(t, block, WithWorkers(2))
+	conns := []net.Conn{send(srv), send(srv), send(srv)}
+	<-entered
+	<-entered
+	select {
+	case <-entered:
+		t.Fatal("third connection was handled without a free worker")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	for _, conn := range conns {
+		assert.Contains(t, answered(conn, time.Second), "200 OK")
+	}
+}
+
+// flakyListener fails Accept with each of errs in turn, then like its
+// embedded listener. Look at calls only once the server stopped.
+type flakyListener struct {
+	net.Listener
+	errs  []error
+	calls []time.Time
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.calls = append(l.calls, time.Now())
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		return nil, err
+	}
+	return l.Listener.Accept()
+}
+
+// acceptObserver counts accept errors and rejections.
+type acceptObserver struct {
+	nopObserver
+	mu                        sync.Mutex
+	temporary, fatal, rejects int
+}
+
+func (o *acceptObserver) AcceptError(temporary bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if temporary {
+		o.temporary++
+	} else {
+		o.fatal++
+	}
+}
+
+func (o *acceptObserver) ConnRejected() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.rejects++
+}
+
+func TestAcceptErrors(t *testing.T) {
+	var logs strings.Builder
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	emfile := &net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+
+	// Test: Temporary errors are retried with a growing delay
+	l := &flakyListener{Listener: inner, errs: []error{emfile, emfile, emfile}}
+	observer := &acceptObserver{}
+	srv := serveListener(l, hello, WithErrorLog(logger), WithObserver(observer))
+	conn := dial(t, srv)
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	all, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(all), "200 OK")
+	assert.NoError(t, srv.Err())
+
+	// Test: Close stops it without an error
+	srv.Close()
+	assert.NoError(t, srv.Wait())
+	require.GreaterOrEqual(t, len(l.calls), 4)
+	assert.GreaterOrEqual(t, l.calls[1].Sub(l.calls[0]), 5*time.Millisecond)
+	assert.GreaterOrEqual(t, l.calls[3].Sub(l.calls[2]), 20*time.Millisecond)
+	assert.Equal(t, 3, strings.Count(logs.String(), "accept failed, retrying"))
+
+	// Test: Observers hear about accept errors, not about rejected connections
+	assert.Equal(t, 3, observer.temporary)
+	assert.Zero(t, observer.rejects)
+
+	// Test: Anything else stops the server and comes out of Wait
+	broken := errors.New("listener fell over")
+	inner, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv = serveListener(&flakyListener{Listener: inner, errs: []error{broken}}, hello, WithErrorLog(logger), WithObserver(observer))
+	assert.ErrorIs(t, srv.Wait(), broken)
+	assert.Equal(t, 1, observer.fatal)
+	assert.Zero(t, observer.rejects)
+	assert.ErrorIs(t, srv.Err(), broken)
+	assert.Contains(t, logs.String(), "accept failed, server stopped")
+	_, err = net.Dial("tcp", inner.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestNegotiate(t *testing.T) {
+	req := &request.Request{Headers: headers.Headers{"accept": "application/json;q=0.9, text/html"}}
+
+	// Test: The client's favourite among the offers
+	offer, herr := Negotiate(req, "application/json", "text/html")
+	assert.Nil(t, herr)
+	assert.Equal(t, "text/html", offer)
+
+	// Test: Nothing acceptable is a 406 saying what there is
+	req.Headers.Set("accept", "image/png")
+	_, herr = Negotiate(req, "application/json", "text/html")
+	require.NotNil(t, herr)
+	w := response.NewWriter()
+	herr.Respond(w)
+	res := string(w.Bytes())
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 406 Not Acceptable\r\n"))
+	assert.True(t, strings.HasSuffix(res, "Not acceptable, available: application/json, text/html"))
+}
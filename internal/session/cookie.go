@@ -0,0 +1,149 @@
+package session
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"httpfromtcp/internal/request"
+	"time"
+)
+
+var ERROR_WEAK_KEY = errors.New("Cookie store keys need to be at least 32 bytes")
+var ERROR_SESSION_TOO_LARGE = errors.New("Session too large for a cookie")
+
+// Browsers keep 4096 bytes per cookie, name and attributes included.
+const maxCookieValue = 3800
+
+// CookieStore keeps the whole session in the cookie, nothing on the server.
+// It's signed with HMAC-SHA256 so the client can read but not change it, or
+// encrypted with AES-GCM so it can do neither.
+//
+// The first key signs or encrypts, the others are only tried on the way in:
+// to rotate, put the new key first and drop the old one once its cookies have
+// expired.
+//
+// A session can't be revoked before it expires, Delete has nothing to
+// delete. Destroy still drops it from the client.
+type CookieStore struct {
+	encrypt bool
+	keys    [][]byte // derived from the ones given, one per purpose
+}
+
+func NewSignedCookieStore(keys ...[]byte) (*CookieStore, error) {
+	return newCookieStore(false, keys)
+}
+
+func NewEncryptedCookieStore(keys ...[]byte) (*CookieStore, error) {
+	return newCookieStore(true, keys)
+}
+
+func newCookieStore(encrypt bool, keys [][]byte) (*CookieStore, error) {
+	if len(keys) == 0 {
+		return nil, ERROR_WEAK_KEY
+	}
+	c := &CookieStore{encrypt: encrypt}
+	purpose := []byte("httpfromtcp session signing")
+	if encrypt {
+		purpose = []byte("httpfromtcp session encryption")
+	}
+	for _, key := range keys {
+		if len(key) < 32 {
+			return nil, ERROR_WEAK_KEY
+		}
+		// the same secret in both kinds of store doesn't give the same key
+		mac := hmac.New(sha256.New, key)
+		mac.Write(purpose)
+		c.keys = append(c.keys, mac.Sum(nil))
+	}
+	return c, nil
+}
+
+func (c *CookieStore) Load(cookie string, now time.Time) (*request.Session, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cookie)
+	if err != nil {
+		return nil, nil
+	}
+	for _, key := range c.keys {
+		var payload []byte
+		if c.encrypt {
+			payload = open(key, b)
+		} else {
+			payload = verify(key, b)
+		}
+		if payload != nil {
+			return decode(payload)
+		}
+	}
+	return nil, nil // signed with a key we don't have (any more)
+}
+
+func (c *CookieStore) Save(s *request.Session, expires time.Time) (string, error) {
+	payload, err := encode(s)
+	if err != nil {
+		return "", err
+	}
+	var b []byte
+	if c.encrypt {
+		b = seal(c.keys[0], payload)
+	} else {
+		b = sign(c.keys[0], payload)
+	}
+	value := base64.RawURLEncoding.EncodeToString(b)
+	if len(value) > maxCookieValue {
+		return "", ERROR_SESSION_TOO_LARGE
+	}
+	return value, nil
+}
+
+func (c *CookieStore) Delete(id string) error {
+	return nil
+}
+
+// sign appends the MAC to the payload.
+func sign(key, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return mac.Sum(bytes.Clone(payload))
+}
+
+func verify(key, b []byte) []byte {
+	if len(b) < sha256.Size {
+		return nil
+	}
+	payload := b[:len(b)-sha256.Size]
+	if !hmac.Equal(sign(key, payload), b) {
+		return nil
+	}
+	return payload
+}
+
+func newGCM(key []byte) cipher.AEAD {
+	block, _ := aes.NewCipher(key) // 32 bytes, AES-256
+	gcm, _ := cipher.NewGCM(block)
+	return gcm
+}
+
+// seal is nonce + ciphertext, a random nonce per cookie.
+func seal(key, payload []byte) []byte {
+	gcm := newGCM(key)
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	return gcm.Seal(nonce, nonce, payload, nil)
+}
+
+func open(key, b []byte) []byte {
+	gcm := newGCM(key)
+	if len(b) < gcm.NonceSize() {
+		return nil
+	}
+	payload, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil
+	}
+	return payload
+}
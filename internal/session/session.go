@@ -0,0 +1,171 @@
+package session
+
+import (
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"log/slog"
+	"time"
+)
+
+const (
+	DefaultCookieName  = "session"
+	DefaultIdleTimeout = 30 * time.Minute
+	DefaultMaxLifetime = 12 * time.Hour
+)
+
+type Options struct {
+	Store       Store            // nil means a MemoryStore
+	CookieName  string           // "" means DefaultCookieName
+	Path        string           // "" means "/"
+	Domain      string           // "" means only the host that set it
+	Secure      bool             // only send the cookie over HTTPS, you want this outside of development
+	SameSite    headers.SameSite // SameSiteDefault means SameSiteLax
+	IdleTimeout time.Duration    // since the last request, 0 means DefaultIdleTimeout
+	MaxLifetime time.Duration    // since the session started, however busy, 0 means DefaultMaxLifetime
+	ErrorLog    *slog.Logger     // store errors, nil means slog.Default()
+}
+
+// Manager loads the client's session before the handler runs and saves it
+// (and sends the cookie) before the response goes out. The cookie is always
+// HttpOnly.
+type Manager struct {
+	opts Options
+	now  func() time.Time
+}
+
+func New(opts Options) *Manager {
+	if opts.Store == nil {
+		opts.Store = NewMemoryStore()
+	}
+	if opts.CookieName == "" {
+		opts.CookieName = DefaultCookieName
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	if opts.SameSite == headers.SameSiteDefault {
+		opts.SameSite = headers.SameSiteLax
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = DefaultIdleTimeout
+	}
+	if opts.MaxLifetime <= 0 {
+		opts.MaxLifetime = DefaultMaxLifetime
+	}
+	if opts.ErrorLog == nil {
+		opts.ErrorLog = slog.Default()
+	}
+	return &Manager{opts: opts, now: time.Now}
+}
+
+// Middleware puts the session on the request, see req.Session(). A new
+// session is only stored once something is set in it, so clients that never
+// log in don't cost anything. Changes made after a streamed response's head
+// went out are lost.
+func (m *Manager) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		now := m.now()
+		s, hadCookie := m.load(req, now)
+		existing := s != nil
+		if s == nil {
+			s = &request.Session{ID: newID(), Created: now}
+		}
+		s.LastSeen = now
+
+		saved := false
+		save := func() {
+			if !saved {
+				saved = true
+				m.save(w, s, existing, hadCookie, now)
+			}
+		}
+		w.BeforeHead(save)
+		next(w, req.WithSession(s))
+		save()
+	}
+}
+
+// load returns the session the cookie points to if it's still good, and
+// whether there was a cookie at all.
+func (m *Manager) load(req *request.Request, now time.Time) (*request.Session, bool) {
+	c, err := req.Cookie(m.opts.CookieName)
+	if err != nil {
+		return nil, false
+	}
+	s, err := m.opts.Store.Load(c.Value, now)
+	if err != nil {
+		m.opts.ErrorLog.Warn("httpfromtcp: loading session failed", "error", err)
+		return nil, true
+	}
+	if s == nil {
+		return nil, true
+	}
+	if now.Sub(s.LastSeen) >= m.opts.IdleTimeout || now.Sub(s.Created) >= m.opts.MaxLifetime {
+		m.delete(s.ID)
+		return nil, true
+	}
+	return s, true
+}
+
+func (m *Manager) save(w *response.Writer, s *request.Session, existing, hadCookie bool, now time.Time) {
+	switch {
+	case s.Destroyed():
+		if existing {
+			m.delete(s.ID)
+		}
+		if hadCookie {
+			m.setCookie(w, "", -1)
+		}
+		return
+	case !existing && !s.Changed():
+		if hadCookie { // expired or made up, don't have it sent again
+			m.setCookie(w, "", -1)
+		}
+		return
+	case s.Regenerated():
+		if existing {
+			m.delete(s.ID)
+		}
+		s.ID = newID()
+	}
+
+	expires := s.LastSeen.Add(m.opts.IdleTimeout)
+	if end := s.Created.Add(m.opts.MaxLifetime); end.Before(expires) {
+		expires = end
+	}
+	value, err := m.opts.Store.Save(s, expires)
+	if err != nil {
+		m.opts.ErrorLog.Error("httpfromtcp: saving session failed", "error", err)
+		return
+	}
+	// Max-Age rather than Expires, the client's clock doesn't matter then
+	m.setCookie(w, value, int((expires.Sub(now)+time.Second-1)/time.Second))
+}
+
+func (m *Manager) delete(id string) {
+	if err := m.opts.Store.Delete(id); err != nil {
+		m.opts.ErrorLog.Warn("httpfromtcp: deleting session failed", "error", err)
+	}
+}
+
+// setCookie sends the session cookie, a negative maxAge removes it.
+func (m *Manager) setCookie(w *response.Writer, value string, maxAge int) {
+	err := w.SetCookie(&headers.Cookie{
+		Name:     m.opts.CookieName,
+		Value:    value,
+		Domain:   m.opts.Domain,
+		Path:     m.opts.Path,
+		MaxAge:   maxAge,
+		Secure:   m.opts.Secure,
+		HttpOnly: true,
+		SameSite: m.opts.SameSite,
+	})
+	if err != nil {
+		m.opts.ErrorLog.Error("httpfromtcp: setting session cookie failed", "error", err)
+		return
+	}
+	// a shared cache must never hand someone else's session cookie out
+	w.SetDefaultHeader("cache-control", "private")
+}
@@ -0,0 +1,159 @@
+package session
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// browser sends the cookie it got last, like a browser would.
+type browser struct {
+	t      *testing.T
+	h      server.Handler
+	cookie string
+}
+
+// get runs the handler and returns the raw response.
+func (b *browser) get() string {
+	raw := "GET / HTTP/1.1\r\nHost: x\r\n"
+	if b.cookie != "" {
+		raw += "Cookie: " + b.cookie + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(b.t, err)
+	var out bytes.Buffer
+	w := response.NewStreamingWriter(&out)
+	b.h(w, req)
+	require.NoError(b.t, w.Finish())
+	res := out.String()
+	for _, line := range strings.Split(res, "\r\n") {
+		if v, ok := strings.CutPrefix(line, "set-cookie: "); ok {
+			b.cookie, _, _ = strings.Cut(v, ";")
+			if strings.Contains(v, "Max-Age=0") {
+				b.cookie = ""
+			}
+		}
+	}
+	return res
+}
+
+func newManager(opts Options, c *clock) *Manager {
+	m := New(opts)
+	m.now = c.now
+	return m
+}
+
+func TestMiddleware(t *testing.T) {
+	c := &clock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	store := NewMemoryStore()
+	m := newManager(Options{Store: store}, c)
+	var got string
+	var action func(s *request.Session)
+	app := func(w *response.Writer, req *request.Request) {
+		got = req.Session().Get("user")
+		if action != nil {
+			action(req.Session())
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		w.WriteBody([]byte("ok"))
+	}
+	b := &browser{t: t, h: m.Middleware(app)}
+
+	// Test: No cookie until something is stored
+	res := b.get()
+	assert.NotContains(t, res, "set-cookie")
+	assert.Equal(t, 0, store.Len())
+
+	// Test: Storing something sends a cookie, which brings the session back
+	action = func(s *request.Session) { s.Set("user", "ada") }
+	res = b.get()
+	assert.Contains(t, res, "; Path=/; Max-Age=1800; HttpOnly; SameSite=Lax\r\n")
+	assert.Contains(t, res, "cache-control: private\r\n")
+	first := b.cookie
+	action = nil
+	b.get()
+	assert.Equal(t, "ada", got)
+	assert.Equal(t, first, b.cookie)
+
+	// Test: Regenerating changes the ID, the old one is gone
+	action = func(s *request.Session) { s.Regenerate() }
+	b.get()
+	assert.NotEqual(t, first, b.cookie)
+	assert.Equal(t, 1, store.Len())
+	action = nil
+	b.get()
+	assert.Equal(t, "ada", got)
+	stolen := &browser{t: t, h: b.h, cookie: first}
+	stolen.get()
+	assert.Equal(t, "", got)
+
+	// Test: Idle for too long
+	c.advance(DefaultIdleTimeout)
+	res = b.get()
+	assert.Equal(t, "", got)
+	assert.Contains(t, res, "Max-Age=0")
+
+	// Test: Busy, but past the absolute expiry, Max-Age counts down to it
+	action = func(s *request.Session) { s.Set("user", "ada") }
+	b.get()
+	action = nil
+	for range 35 {
+		c.advance(20 * time.Minute)
+		res = b.get()
+		assert.Equal(t, "ada", got)
+	}
+	assert.Contains(t, res, "Max-Age=1200;")
+	c.advance(19 * time.Minute)
+	res = b.get()
+	assert.Contains(t, res, "Max-Age=60;")
+	c.advance(time.Minute)
+	b.get()
+	assert.Equal(t, "", got)
+
+	// Test: Destroy drops the session and the cookie
+	action = func(s *request.Session) { s.Set("user", "ada") }
+	b.get()
+	action = func(s *request.Session) { s.Destroy() }
+	res = b.get()
+	assert.Contains(t, res, "Max-Age=0")
+	assert.Equal(t, 0, store.Len())
+
+	// Test: A made up cookie gets no session and is removed
+	b.cookie = "session=nope"
+	action = nil
+	res = b.get()
+	assert.Equal(t, "", got)
+	assert.Contains(t, res, "Max-Age=0")
+}
+
+func TestStreamedResponse(t *testing.T) {
+	m := New(Options{})
+	app := func(w *response.Writer, req *request.Request) {
+		req.Session().Set("seen", "yes")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(headers.Headers{"content-type": "text/plain"})
+		w.WriteBody([]byte("first"))
+		w.Flush()
+		w.WriteBody([]byte("second"))
+	}
+	b := &browser{t: t, h: m.Middleware(app)}
+
+	// Test: The cookie makes it into a head flushed by the handler
+	res := b.get()
+	assert.Contains(t, res, "transfer-encoding: chunked")
+	assert.Contains(t, res, "set-cookie: session=")
+}
@@ -0,0 +1,236 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"httpfromtcp/internal/request"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ERROR_INVALID_SESSION = errors.New("Invalid session")
+
+// Store keeps sessions between requests. Save returns what goes in the
+// cookie and Load gets the session back from it, nil when there's none (or
+// it expired). Delete forgets the session with that ID.
+type Store interface {
+	Load(cookie string, now time.Time) (*request.Session, error)
+	Save(s *request.Session, expires time.Time) (string, error)
+	Delete(id string) error
+}
+
+// How often the server side stores look for expired sessions to drop.
+const sweepEvery = time.Minute
+
+// newID is 256 random bits, base64url so it's cookie and file name safe.
+func newID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func isID(s string) bool {
+	if len(s) != 43 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// record is a session as the file and cookie stores write it down.
+type record struct {
+	ID       string            `json:"id"`
+	Created  int64             `json:"c"`
+	LastSeen int64             `json:"l"`
+	Values   map[string]string `json:"v,omitempty"`
+}
+
+func encode(s *request.Session) ([]byte, error) {
+	return json.Marshal(record{ID: s.ID, Created: s.Created.Unix(), LastSeen: s.LastSeen.Unix(), Values: s.Values})
+}
+
+func decode(b []byte) (*request.Session, error) {
+	var r record
+	if err := json.Unmarshal(b, &r); err != nil || !isID(r.ID) {
+		return nil, ERROR_INVALID_SESSION
+	}
+	return &request.Session{ID: r.ID, Created: time.Unix(r.Created, 0), LastSeen: time.Unix(r.LastSeen, 0), Values: r.Values}, nil
+}
+
+type memoryItem struct {
+	session request.Session
+	expires time.Time
+}
+
+// MemoryStore keeps sessions in the process, they're gone on a restart.
+type MemoryStore struct {
+	mu        sync.Mutex
+	items     map[string]memoryItem
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{items: make(map[string]memoryItem)}
+}
+
+// Sessions are copied in and out, two requests on the same session don't
+// share one.
+func copySession(s *request.Session) request.Session {
+	return request.Session{ID: s.ID, Created: s.Created, LastSeen: s.LastSeen, Values: maps.Clone(s.Values)}
+}
+
+func (m *MemoryStore) Load(cookie string, now time.Time) (*request.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.items[cookie]
+	if !ok || !now.Before(item.expires) {
+		return nil, nil
+	}
+	s := copySession(&item.session)
+	return &s, nil
+}
+
+func (m *MemoryStore) Save(s *request.Session, expires time.Time) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s.LastSeen.Sub(m.lastSweep) >= sweepEvery {
+		m.lastSweep = s.LastSeen
+		for id, item := range m.items {
+			if !s.LastSeen.Before(item.expires) {
+				delete(m.items, id)
+			}
+		}
+	}
+	m.items[s.ID] = memoryItem{session: copySession(s), expires: expires}
+	return s.ID, nil
+}
+
+func (m *MemoryStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.items, id)
+	return nil
+}
+
+func (m *MemoryStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.items)
+}
+
+// FileStore keeps a JSON file per session in a directory, so sessions live
+// through restarts and can be shared by processes on the same machine. A
+// file's modification time is when it expires.
+type FileStore struct {
+	dir       string
+	mu        sync.Mutex // sweeps
+	lastSweep time.Time
+}
+
+// NewFileStore creates dir if it isn't there yet, only the owner can read it.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (f *FileStore) path(id string) string {
+	return filepath.Join(f.dir, id+".json")
+}
+
+func (f *FileStore) Load(cookie string, now time.Time) (*request.Session, error) {
+	if !isID(cookie) { // it ends up in a path
+		return nil, nil
+	}
+	path := f.path(cookie)
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(info.ModTime()) {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := decode(b)
+	if err != nil || s.ID != cookie {
+		return nil, ERROR_INVALID_SESSION
+	}
+	return s, nil
+}
+
+func (f *FileStore) Save(s *request.Session, expires time.Time) (string, error) {
+	f.sweep(s.LastSeen)
+	b, err := encode(s)
+	if err != nil {
+		return "", err
+	}
+	// a temp file renamed into place, so a Load never sees half a session
+	tmp, err := os.CreateTemp(f.dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), expires, expires)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path(s.ID))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return s.ID, nil
+}
+
+func (f *FileStore) Delete(id string) error {
+	if !isID(id) {
+		return nil
+	}
+	err := os.Remove(f.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// sweep removes expired session files, at most once every sweepEvery.
+func (f *FileStore) sweep(now time.Time) {
+	f.mu.Lock()
+	if now.Sub(f.lastSweep) < sweepEvery {
+		f.mu.Unlock()
+		return
+	}
+	f.lastSweep = now
+	f.mu.Unlock()
+
+	entries, _ := os.ReadDir(f.dir)
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		if info, err := e.Info(); err == nil && !now.Before(info.ModTime()) {
+			os.Remove(filepath.Join(f.dir, e.Name()))
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package session
+
+import (
+	"bytes"
+	"encoding/base64"
+	"httpfromtcp/internal/request"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStores(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	fileStore, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+	signed, err := NewSignedCookieStore(bytes.Repeat([]byte("k"), 32))
+	require.NoError(t, err)
+	encrypted, err := NewEncryptedCookieStore(bytes.Repeat([]byte("k"), 32))
+	require.NoError(t, err)
+
+	for name, store := range map[string]Store{"memory": NewMemoryStore(), "file": fileStore, "signed": signed, "encrypted": encrypted} {
+		s := &request.Session{ID: newID(), Created: now, LastSeen: now.Add(time.Minute), Values: map[string]string{"user": "ada"}}
+
+		// Test: What's saved loads again
+		cookie, err := store.Save(s, now.Add(time.Hour))
+		require.NoError(t, err, name)
+		loaded, err := store.Load(cookie, now)
+		require.NoError(t, err, name)
+		require.NotNil(t, loaded, name)
+		assert.Equal(t, s.ID, loaded.ID, name)
+		assert.Equal(t, "ada", loaded.Get("user"), name)
+		assert.True(t, s.LastSeen.Equal(loaded.LastSeen), name)
+
+		// Test: Changes to a loaded session aren't in the store until saved
+		loaded.Set("user", "eve")
+		again, _ := store.Load(cookie, now)
+		assert.Equal(t, "ada", again.Get("user"), name)
+
+		// Test: Cookies nobody handed out load nothing
+		for _, bogus := range []string{"", "nope", "../../etc/passwd", newID()} {
+			loaded, _ = store.Load(bogus, now)
+			assert.Nil(t, loaded, name)
+		}
+	}
+
+	// Test: Server side stores forget sessions once they expire or are deleted
+	for name, store := range map[string]Store{"memory": NewMemoryStore(), "file": fileStore} {
+		s := &request.Session{ID: newID(), Created: now, LastSeen: now}
+		cookie, _ := store.Save(s, now.Add(time.Hour))
+		loaded, _ := store.Load(cookie, now.Add(time.Hour))
+		assert.Nil(t, loaded, name)
+		cookie, _ = store.Save(s, now.Add(2*time.Hour))
+		require.NoError(t, store.Delete(s.ID))
+		loaded, _ = store.Load(cookie, now)
+		assert.Nil(t, loaded, name)
+	}
+
+	// Test: Expired session files get swept
+	dir := t.TempDir()
+	fileStore, _ = NewFileStore(dir)
+	fileStore.Save(&request.Session{ID: newID(), Created: now, LastSeen: now}, now.Add(time.Minute))
+	fileStore.Save(&request.Session{ID: newID(), Created: now, LastSeen: now.Add(time.Hour)}, now.Add(2*time.Hour))
+	files, _ := os.ReadDir(dir)
+	assert.Len(t, files, 1)
+}
+
+func TestCookieStore(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte("o"), 32), bytes.Repeat([]byte("n"), 32)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &request.Session{ID: newID(), Created: now, LastSeen: now, Values: map[string]string{"role": "admin"}}
+
+	// Test: Signed cookies can be read but not changed
+	signed, _ := NewSignedCookieStore(oldKey)
+	cookie, err := signed.Save(s, now.Add(time.Hour))
+	require.NoError(t, err)
+	raw, _ := base64.RawURLEncoding.DecodeString(cookie)
+	assert.Contains(t, string(raw), `"role":"admin"`)
+	tampered := base64.RawURLEncoding.EncodeToString(bytes.Replace(raw, []byte("admin"), []byte("owner"), 1))
+	loaded, _ := signed.Load(tampered, now)
+	assert.Nil(t, loaded)
+
+	// Test: Encrypted cookies can't even be read
+	encrypted, _ := NewEncryptedCookieStore(oldKey)
+	cookie, err = encrypted.Save(s, now.Add(time.Hour))
+	require.NoError(t, err)
+	raw, _ = base64.RawURLEncoding.DecodeString(cookie)
+	assert.NotContains(t, string(raw), "admin")
+	raw[len(raw)-1] ^= 1
+	loaded, _ = encrypted.Load(base64.RawURLEncoding.EncodeToString(raw), now)
+	assert.Nil(t, loaded)
+
+	// Test: Rotation, the old key still opens cookies and the new one makes them
+	rotated, _ := NewEncryptedCookieStore(newKey, oldKey)
+	loaded, _ = rotated.Load(cookie, now)
+	require.NotNil(t, loaded)
+	assert.Equal(t, "admin", loaded.Get("role"))
+	fresh, _ := rotated.Save(s, now.Add(time.Hour))
+	newOnly, _ := NewEncryptedCookieStore(newKey)
+	loaded, _ = newOnly.Load(fresh, now)
+	assert.NotNil(t, loaded)
+	loaded, _ = newOnly.Load(cookie, now)
+	assert.Nil(t, loaded)
+
+	// Test: A signing key doesn't open encrypted cookies
+	loaded, _ = signed.Load(cookie, now)
+	assert.Nil(t, loaded)
+
+	// Test: Short keys and sessions too big for a cookie
+	_, err = NewSignedCookieStore([]byte("secret"))
+	assert.ErrorIs(t, err, ERROR_WEAK_KEY)
+	_, err = NewEncryptedCookieStore()
+	assert.ErrorIs(t, err, ERROR_WEAK_KEY)
+	s.Set("blob", string(bytes.Repeat([]byte("x"), 4000)))
+	_, err = signed.Save(s, now.Add(time.Hour))
+	assert.ErrorIs(t, err, ERROR_SESSION_TOO_LARGE)
+}
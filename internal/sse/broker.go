@@ -0,0 +1,144 @@
+package sse
+
+import (
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How many events a subscriber may fall behind before it's dropped. A dropped
+// client reconnects with Last-Event-ID and catches up from the history.
+const subscriberBuffer = 64
+
+// Broker fans every published event out to all subscribers and keeps the last
+// few around so reconnecting clients can resume where they left off.
+type Broker struct {
+	mu          sync.Mutex
+	subs        map[chan Event]struct{}
+	history     []Event
+	historySize int
+	nextID      uint64
+	heartbeat   time.Duration
+	closed      bool
+}
+
+func NewBroker(historySize int, heartbeat time.Duration) *Broker {
+	return &Broker{
+		subs:        make(map[chan Event]struct{}),
+		historySize: historySize,
+		heartbeat:   heartbeat,
+	}
+}
+
+// Publish sends ev to every subscriber, giving it the next sequence number as
+// id if it doesn't have one.
+func (b *Broker) Publish(ev Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	if ev.ID == "" {
+		ev.ID = strconv.FormatUint(b.nextID, 10)
+	}
+	if b.historySize > 0 {
+		b.history = append(b.history, ev)
+		if len(b.history) > b.historySize {
+			b.history = b.history[len(b.history)-b.historySize:]
+		}
+	}
+
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default: // too slow, let it reconnect and resume
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	return ev
+}
+
+func (b *Broker) replay(lastEventID string) []Event {
+	if lastEventID == "" {
+		return nil
+	}
+	for i, ev := range b.history {
+		if ev.ID == lastEventID {
+			return b.history[i+1:]
+		}
+	}
+	return b.history // fell out of the history, send everything we still have
+}
+
+// Subscribe returns a channel with every event after lastEventID. The channel
+// is closed when the broker closes or the subscriber falls too far behind.
+func (b *Broker) Subscribe(lastEventID string) (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	missed := b.replay(lastEventID)
+	ch := make(chan Event, len(missed)+subscriberBuffer)
+	for _, ev := range missed {
+		ch <- ev
+	}
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subs[ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// Serve is a server.Handler that streams the broker's events to the client
+// until it goes away.
+func (b *Broker) Serve(w *response.Writer, req *request.Request) {
+	stream, err := NewStream(w, req)
+	if err != nil {
+		return
+	}
+	events, unsubscribe := b.Subscribe(stream.LastEventID())
+	defer unsubscribe()
+
+	var heartbeat <-chan time.Time
+	if b.heartbeat > 0 {
+		ticker := time.NewTicker(b.heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok || stream.Send(ev) != nil {
+				return
+			}
+		case <-heartbeat:
+			if stream.Comment("heartbeat") != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return // the client left, no need to wait for a write to fail
+		}
+	}
+}
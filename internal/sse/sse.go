@@ -0,0 +1,140 @@
+package sse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ERROR_INVALID_FIELD = errors.New("Event id and name can't contain line breaks")
+
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	Retry time.Duration // tells the client how long to wait before reconnecting
+}
+
+// Any of CRLF, CR or LF ends a line in an event stream, so they all have to
+// become separate data fields.
+var lineBreaks = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+func (e Event) encode() ([]byte, error) {
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return nil, ERROR_INVALID_FIELD
+	}
+
+	var buf bytes.Buffer
+	if e.ID != "" {
+		fmt.Fprintf(&buf, "id: %s\n", e.ID)
+	}
+	if e.Event != "" {
+		fmt.Fprintf(&buf, "event: %s\n", e.Event)
+	}
+	if e.Data != "" || e.Event != "" { // no data means the client never dispatches it
+		for _, line := range strings.Split(lineBreaks.Replace(e.Data), "\n") {
+			fmt.Fprintf(&buf, "data: %s\n", line)
+		}
+	}
+	if e.Retry > 0 {
+		fmt.Fprintf(&buf, "retry: %d\n", e.Retry.Milliseconds())
+	}
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
+
+type Stream struct {
+	mu          sync.Mutex
+	w           *response.Writer
+	lastEventID string
+	err         error // first write error, the client is gone after that
+}
+
+// NewStream answers the request with an event stream. The writer has to be a
+// streaming one, which is what the server hands to handlers.
+func NewStream(w *response.Writer, req *request.Request) (*Stream, error) {
+	w.WriteStatusLine(response.StatusOK)
+	h := headers.NewHeaders()
+	h.Set("content-type", "text/event-stream")
+	h.Set("cache-control", "no-cache")
+	w.WriteHeaders(h)
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	return &Stream{
+		w:           w,
+		lastEventID: req.Headers.Get("last-event-id"),
+	}, nil
+}
+
+// LastEventID is the id the client saw last before reconnecting, empty on a
+// fresh connection.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+func (s *Stream) write(p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	if err := s.w.WriteBody(p); err != nil {
+		s.err = err
+		return err
+	}
+	s.err = s.w.Flush()
+	return s.err
+}
+
+func (s *Stream) Send(ev Event) error {
+	p, err := ev.encode()
+	if err != nil {
+		return err
+	}
+	return s.write(p)
+}
+
+// Comment writes a line the client ignores, handy to keep idle connections
+// (and the proxies in between) from timing out.
+func (s *Stream) Comment(text string) error {
+	var buf bytes.Buffer
+	for _, line := range strings.Split(lineBreaks.Replace(text), "\n") {
+		fmt.Fprintf(&buf, ": %s\n", line)
+	}
+	buf.WriteString("\n")
+	return s.write(buf.Bytes())
+}
+
+// Heartbeat sends a comment every interval until stop is called or a write
+// fails.
+func (s *Stream) Heartbeat(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if s.Comment("heartbeat") != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
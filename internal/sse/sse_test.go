@@ -0,0 +1,97 @@
+package sse
+
+import (
+	"bytes"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventEncoding(t *testing.T) {
+	// Test: All fields
+	p, err := Event{ID: "7", Event: "update", Data: "hello", Retry: 3 * time.Second}.encode()
+	require.NoError(t, err)
+	assert.Equal(t, "id: 7\nevent: update\ndata: hello\nretry: 3000\n\n", string(p))
+
+	// Test: Every kind of line break becomes its own data field
+	p, err = Event{Data: "one\ntwo\r\nthree\rfour"}.encode()
+	require.NoError(t, err)
+	assert.Equal(t, "data: one\ndata: two\ndata: three\ndata: four\n\n", string(p))
+
+	// Test: Line breaks can't sneak into the id or name
+	_, err = Event{ID: "1\ndata: evil", Data: "x"}.encode()
+	require.ErrorIs(t, err, ERROR_INVALID_FIELD)
+	_, err = Event{Event: "a\rb", Data: "x"}.encode()
+	require.ErrorIs(t, err, ERROR_INVALID_FIELD)
+}
+
+func newRequest(t *testing.T, raw string) *request.Request {
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	return req
+}
+
+func TestStream(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := response.NewStreamingWriter(out)
+	req := newRequest(t, "GET /events HTTP/1.1\r\nLast-Event-ID: 41\r\n\r\n")
+
+	// Test: Headers go out right away
+	stream, err := NewStream(w, req)
+	require.NoError(t, err)
+	assert.Equal(t, "41", stream.LastEventID())
+	head, _, ok := strings.Cut(out.String(), "\r\n\r\n")
+	require.True(t, ok)
+	head += "\r\n"
+	assert.Contains(t, head, "content-type: text/event-stream\r\n")
+	assert.Contains(t, head, "transfer-encoding: chunked\r\n")
+
+	// Test: Each event and comment is flushed as its own chunk
+	out.Reset()
+	require.NoError(t, stream.Send(Event{ID: "42", Data: "hi"}))
+	assert.Equal(t, "11\r\nid: 42\ndata: hi\n\n\r\n", out.String())
+	out.Reset()
+	require.NoError(t, stream.Comment("ping"))
+	assert.Equal(t, "8\r\n: ping\n\n\r\n", out.String())
+}
+
+func TestBroker(t *testing.T) {
+	b := NewBroker(3, 0)
+
+	// Test: Fan-out to every subscriber
+	first, unsubscribe := b.Subscribe("")
+	second, _ := b.Subscribe("")
+	b.Publish(Event{Data: "a"})
+	assert.Equal(t, Event{ID: "1", Data: "a"}, <-first)
+	assert.Equal(t, Event{ID: "1", Data: "a"}, <-second)
+
+	// Test: Unsubscribing closes the channel
+	unsubscribe()
+	_, ok := <-first
+	assert.False(t, ok)
+
+	// Test: Resuming replays what came after the last seen id
+	b.Publish(Event{Data: "b"})
+	b.Publish(Event{Data: "c"})
+	resumed, _ := b.Subscribe("2")
+	assert.Equal(t, "c", (<-resumed).Data)
+
+	// Test: An id that fell out of the history replays everything we kept
+	b.Publish(Event{Data: "d"})
+	resumed, _ = b.Subscribe("1")
+	assert.Equal(t, "b", (<-resumed).Data)
+	assert.Equal(t, "c", (<-resumed).Data)
+	assert.Equal(t, "d", (<-resumed).Data)
+
+	// Test: Closing the broker ends every subscription
+	b.Close()
+	for range second {
+	}
+	_, ok = <-resumed
+	assert.False(t, ok)
+}
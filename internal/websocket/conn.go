@@ -0,0 +1,382 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var ERROR_CLOSED = errors.New("WebSocket connection closed")
+
+type MessageType int
+
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+const (
+	opContinuation byte = 0x0
+	opText         byte = 0x1
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xA
+)
+
+type CloseCode int
+
+const (
+	CloseNormal          CloseCode = 1000
+	CloseGoingAway       CloseCode = 1001
+	CloseProtocolError   CloseCode = 1002
+	CloseUnsupportedData CloseCode = 1003
+	CloseNoStatus        CloseCode = 1005 // never on the wire, means the close frame was empty
+	CloseAbnormal        CloseCode = 1006 // never on the wire either
+	CloseInvalidPayload  CloseCode = 1007
+	ClosePolicyViolation CloseCode = 1008
+	CloseMessageTooBig   CloseCode = 1009
+	CloseMandatoryExt    CloseCode = 1010
+	CloseInternalError   CloseCode = 1011
+)
+
+// How long Close waits for the peer to answer our close frame.
+const closeHandshakeDeadline = 5 * time.Second
+
+// CloseError is what ReadMessage returns once the connection is closing,
+// either because the peer sent a close frame or because we failed it.
+type CloseError struct {
+	Code   CloseCode
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// RFC 6455 7.4: the codes an endpoint may actually put in a close frame.
+func validCloseCode(code CloseCode) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+type frame struct {
+	fin     bool
+	rsv1    bool
+	opcode  byte
+	payload []byte
+}
+
+type Conn struct {
+	conn         net.Conn
+	br           *bufio.Reader
+	subprotocol  string
+	compress     bool
+	maxSize      int64
+	fragmentSize int
+
+	wmu       sync.Mutex // pongs and close frames come from the reader, everything else from the app
+	closeSent bool
+}
+
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) writeFrame(f frame) error {
+	hdr := make([]byte, 0, 10)
+	b0 := f.opcode
+	if f.fin {
+		b0 |= 0x80
+	}
+	if f.rsv1 {
+		b0 |= 0x40
+	}
+	hdr = append(hdr, b0)
+
+	// server frames are never masked
+	n := len(f.payload)
+	switch {
+	case n <= 125:
+		hdr = append(hdr, byte(n))
+	case n <= 0xFFFF:
+		hdr = append(hdr, 126)
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr = append(hdr, 127)
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+
+	_, err := c.conn.Write(append(hdr, f.payload...))
+	return err
+}
+
+func (c *Conn) writeControl(opcode byte, payload []byte) error {
+	if len(payload) > 125 {
+		return errors.New("Control frame payload too long")
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ERROR_CLOSED
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+	return c.writeFrame(frame{fin: true, opcode: opcode, payload: payload})
+}
+
+func closePayload(code CloseCode, reason string) []byte {
+	if code == CloseNoStatus {
+		return nil
+	}
+	p := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return append(p, reason...)
+}
+
+func (c *Conn) WriteMessage(t MessageType, data []byte) error {
+	if t != TextMessage && t != BinaryMessage {
+		return errors.New("Unknown message type")
+	}
+	if t == TextMessage && !utf8.Valid(data) {
+		return errors.New("Text messages must be valid UTF-8")
+	}
+
+	rsv1 := false
+	if c.compress {
+		compressed, err := deflate(data)
+		if err != nil {
+			return err
+		}
+		data = compressed
+		rsv1 = true
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ERROR_CLOSED
+	}
+
+	size := c.fragmentSize
+	if size <= 0 {
+		size = len(data)
+	}
+	opcode := byte(t)
+	for {
+		chunk := data[:min(size, len(data))]
+		data = data[len(chunk):]
+		f := frame{fin: len(data) == 0, rsv1: rsv1, opcode: opcode, payload: chunk}
+		if err := c.writeFrame(f); err != nil {
+			return err
+		}
+		if f.fin {
+			return nil
+		}
+		opcode, rsv1 = opContinuation, false // RSV1 only goes on the first frame
+	}
+}
+
+func (c *Conn) Ping(data []byte) error {
+	return c.writeControl(opPing, data)
+}
+
+// WriteClose starts the closing handshake without waiting for the answer, the
+// goroutine sitting in ReadMessage gets it and shuts the connection down.
+func (c *Conn) WriteClose(code CloseCode, reason string) error {
+	return c.writeControl(opClose, closePayload(code, reason))
+}
+
+// Close runs the whole closing handshake: send our close frame, wait a bit
+// for the peer's, then drop the TCP connection. It reads from the connection,
+// so don't call it while another goroutine is in ReadMessage, use WriteClose
+// there instead.
+func (c *Conn) Close(code CloseCode, reason string) error {
+	if err := c.WriteClose(code, reason); err != nil && !errors.Is(err, ERROR_CLOSED) {
+		c.conn.Close()
+		return err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(closeHandshakeDeadline))
+	for {
+		f, err := c.readFrame()
+		if err != nil || f.opcode == opClose {
+			break
+		}
+	}
+	return c.conn.Close()
+}
+
+// fail closes the connection because the peer broke the protocol.
+func (c *Conn) fail(code CloseCode, reason string) error {
+	c.writeControl(opClose, closePayload(code, reason))
+	c.conn.Close()
+	return &CloseError{Code: code, Reason: reason}
+}
+
+func (c *Conn) readFrame() (frame, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return frame{}, err
+	}
+
+	f := frame{
+		fin:    hdr[0]&0x80 != 0,
+		rsv1:   hdr[0]&0x40 != 0,
+		opcode: hdr[0] & 0x0F,
+	}
+	masked := hdr[1]&0x80 != 0
+	length := uint64(hdr[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return frame{}, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return frame{}, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return frame{}, c.fail(CloseProtocolError, "invalid frame length")
+		}
+	}
+
+	if !masked { // RFC 6455 5.1: clients always mask
+		return frame{}, c.fail(CloseProtocolError, "unmasked client frame")
+	}
+	if hdr[0]&0x30 != 0 || (f.rsv1 && !c.compress) {
+		return frame{}, c.fail(CloseProtocolError, "reserved bits set")
+	}
+	if f.opcode >= opClose {
+		if !f.fin || length > 125 {
+			return frame{}, c.fail(CloseProtocolError, "invalid control frame")
+		}
+		if f.rsv1 {
+			return frame{}, c.fail(CloseProtocolError, "compressed control frame")
+		}
+	}
+	if length > uint64(c.maxSize) {
+		return frame{}, c.fail(CloseMessageTooBig, "message too big")
+	}
+
+	var key [4]byte
+	if _, err := io.ReadFull(c.br, key[:]); err != nil {
+		return frame{}, err
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, f.payload); err != nil {
+		return frame{}, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= key[i%4]
+	}
+	return f, nil
+}
+
+func (c *Conn) handleClose(payload []byte) error {
+	code := CloseNoStatus
+	reason := ""
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, "invalid close frame")
+	case len(payload) >= 2:
+		code = CloseCode(binary.BigEndian.Uint16(payload))
+		reason = string(payload[2:])
+		if !validCloseCode(code) {
+			return c.fail(CloseProtocolError, "invalid close code")
+		}
+		if !utf8.ValidString(reason) {
+			return c.fail(CloseInvalidPayload, "invalid close reason")
+		}
+	}
+
+	c.writeControl(opClose, closePayload(code, "")) // echo it back, does nothing if we started the close
+	c.conn.Close()
+	return &CloseError{Code: code, Reason: reason}
+}
+
+// ReadMessage blocks until a whole message is in, putting fragments back
+// together and answering pings on the way. Once the connection closes it
+// returns a *CloseError.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	var msgType MessageType
+	var compressed bool
+	var buf []byte
+	started := false
+
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case opPing:
+			c.writeControl(opPong, f.payload)
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(f.payload)
+		case opText, opBinary:
+			if started {
+				return 0, nil, c.fail(CloseProtocolError, "expected a continuation frame")
+			}
+			started = true
+			msgType = MessageType(f.opcode)
+			compressed = f.rsv1
+		case opContinuation:
+			if !started {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+			if f.rsv1 {
+				return 0, nil, c.fail(CloseProtocolError, "reserved bits set")
+			}
+		default:
+			return 0, nil, c.fail(CloseProtocolError, "unknown opcode")
+		}
+
+		if int64(len(buf)+len(f.payload)) > c.maxSize {
+			return 0, nil, c.fail(CloseMessageTooBig, "message too big")
+		}
+		buf = append(buf, f.payload...)
+		if !f.fin {
+			continue
+		}
+
+		if compressed {
+			buf, err = inflate(buf, c.maxSize)
+			if errors.Is(err, errInflatedTooBig) {
+				return 0, nil, c.fail(CloseMessageTooBig, "message too big")
+			}
+			if err != nil {
+				return 0, nil, c.fail(CloseInvalidPayload, "invalid compressed data")
+			}
+		}
+		if msgType == TextMessage && !utf8.Valid(buf) {
+			return 0, nil, c.fail(CloseInvalidPayload, "invalid UTF-8 in text message")
+		}
+		return msgType, buf, nil
+	}
+}
@@ -0,0 +1,91 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var errInflatedTooBig = errors.New("inflated message too big")
+
+// RFC 7692 7.2.1: a sync flush ends with an empty stored block, senders strip
+// those four bytes and receivers put them back.
+var flushTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// flushTail plus a final empty stored block, so the reader ends cleanly
+// instead of waiting for more.
+var inflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// We always ask for no context takeover in both directions, every message
+// is compressed on its own. It costs some ratio but keeps no state between
+// messages. compress/flate can't shrink its window either, so an offer that
+// wants server_max_window_bits below 15 gets turned down.
+func negotiateDeflate(header string) (string, bool) {
+	for _, offer := range strings.Split(header, ",") {
+		params := strings.Split(offer, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+
+		ok := true
+		seen := make(map[string]bool)
+		for _, p := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(p), "=")
+			name = strings.TrimSpace(name)
+			value = strings.Trim(strings.TrimSpace(value), `"`)
+			if seen[name] {
+				ok = false
+				break
+			}
+			seen[name] = true
+
+			switch name {
+			case "server_no_context_takeover", "client_no_context_takeover":
+				ok = ok && value == ""
+			case "server_max_window_bits":
+				ok = ok && value == "15"
+			case "client_max_window_bits":
+				bits, err := strconv.Atoi(value)
+				ok = ok && (value == "" || (err == nil && bits >= 8 && bits <= 15))
+			default:
+				ok = false
+			}
+		}
+		if ok {
+			return "permessage-deflate; server_no_context_takeover; client_no_context_takeover", true
+		}
+	}
+	return "", false
+}
+
+func deflate(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(p); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), flushTail), nil
+}
+
+func inflate(p []byte, limit int64) ([]byte, error) {
+	fr := flate.NewReader(io.MultiReader(bytes.NewReader(p), bytes.NewReader(inflateTail)))
+	defer fr.Close()
+
+	out, err := io.ReadAll(io.LimitReader(fr, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, errInflatedTooBig
+	}
+	return out, nil
+}
@@ -0,0 +1,157 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net/url"
+	"strings"
+)
+
+var ERROR_BAD_HANDSHAKE = errors.New("Bad WebSocket handshake")
+var ERROR_ORIGIN_NOT_ALLOWED = errors.New("WebSocket origin not allowed")
+
+const DefaultMaxMessageSize = 16 << 20
+
+// RFC 6455 1.3, every server uses this same GUID to prove it read the key.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+type Options struct {
+	Subprotocols      []string // in no particular order, the client's preference wins
+	EnableCompression bool     // permessage-deflate, RFC 7692
+	MaxMessageSize    int64    // 0 means DefaultMaxMessageSize
+	FragmentSize      int      // split outgoing messages into frames this big, 0 means never
+	// CheckOrigin says whether a page from the request's Origin may connect.
+	// Browsers send cookies along with the handshake whatever site the page
+	// is on, so nil only lets in requests without an Origin (not from a
+	// browser) and ones whose Origin host is the Host they were sent to.
+	CheckOrigin func(req *request.Request) bool
+}
+
+// sameOrigin is what CheckOrigin does when it's nil.
+func sameOrigin(req *request.Request) bool {
+	origin := req.Headers.Get("origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Headers.Get("host"))
+}
+
+func hasToken(value string, token string) bool {
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func reject(w *response.Writer, code response.StatusCode, extra headers.Headers, err error) error {
+	w.WriteStatusLine(code)
+	hs := response.GetDefaultHeaders(0)
+	for k, v := range extra {
+		hs.Set(k, v)
+	}
+	w.WriteHeaders(hs)
+	w.WriteBody([]byte(err.Error()))
+	return err
+}
+
+func pickSubprotocol(offered string, supported []string) string {
+	for _, p := range strings.Split(offered, ",") {
+		p = strings.TrimSpace(p)
+		for _, s := range supported {
+			if p == s {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// Upgrade runs the opening handshake from inside a server.Handler and takes
+// the connection over. When the request isn't a valid upgrade it answers with
+// an error response and returns the error, the handler should just return.
+func Upgrade(w *response.Writer, req *request.Request, opts *Options) (*Conn, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	if req.RequestLine.Method != "GET" {
+		return nil, reject(w, response.StatusMethodNotAllowed, headers.Headers{"allow": "GET"}, ERROR_BAD_HANDSHAKE)
+	}
+	if !hasToken(req.Headers.Get("connection"), "upgrade") || !hasToken(req.Headers.Get("upgrade"), "websocket") {
+		return nil, reject(w, response.StatusBadRequest, nil, ERROR_BAD_HANDSHAKE)
+	}
+	if req.Headers.Get("sec-websocket-version") != "13" {
+		return nil, reject(w, response.StatusUpgradeRequired, headers.Headers{"sec-websocket-version": "13"}, ERROR_BAD_HANDSHAKE)
+	}
+	key := req.Headers.Get("sec-websocket-key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, reject(w, response.StatusBadRequest, nil, ERROR_BAD_HANDSHAKE)
+	}
+	checkOrigin := opts.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		return nil, reject(w, response.StatusForbidden, nil, ERROR_ORIGIN_NOT_ALLOWED)
+	}
+
+	h := headers.NewHeaders()
+	h.Set("upgrade", "websocket")
+	h.Set("connection", "Upgrade")
+	h.Set("sec-websocket-accept", acceptKey(key))
+	subprotocol := pickSubprotocol(req.Headers.Get("sec-websocket-protocol"), opts.Subprotocols)
+	if subprotocol != "" {
+		h.Set("sec-websocket-protocol", subprotocol)
+	}
+	compress := false
+	if opts.EnableCompression {
+		if ext, ok := negotiateDeflate(req.Headers.Get("sec-websocket-extensions")); ok {
+			h.Set("sec-websocket-extensions", ext)
+			compress = true
+		}
+	}
+
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriter(conn)
+	response.WriteStatusLine(bw, response.StatusSwitchingProtocols)
+	response.WriteHeaders(bw, h)
+	bw.WriteString("\r\n")
+	if err := bw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	maxSize := opts.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	return &Conn{
+		conn:         conn,
+		br:           bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn)),
+		subprotocol:  subprotocol,
+		compress:     compress,
+		maxSize:      maxSize,
+		fragmentSize: opts.FragmentSize,
+	}, nil
+}
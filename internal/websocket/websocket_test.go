@@ -0,0 +1,286 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const handshake = "GET /chat HTTP/1.1\r\n" +
+	"Host: localhost\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: keep-alive, Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n"
+
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	server, err := l.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server, client
+}
+
+type connHijacker struct {
+	conn     net.Conn
+	buffered []byte
+}
+
+func (h connHijacker) Hijack() (net.Conn, []byte, error) {
+	return h.conn, h.buffered, nil
+}
+
+// upgrade runs the handshake and returns the server side plus the client's
+// reader positioned right after the 101 response.
+func upgrade(t *testing.T, extraHeaders string, opts *Options) (*Conn, net.Conn, *bufio.Reader, string) {
+	server, client := tcpPipe(t)
+	req, err := request.RequestFromReader(strings.NewReader(handshake + extraHeaders + "\r\n"))
+	require.NoError(t, err)
+
+	w := response.NewStreamingWriter(server)
+	w.SetHijacker(connHijacker{conn: server})
+	conn, err := Upgrade(w, req, opts)
+	require.NoError(t, err)
+
+	br := bufio.NewReader(client)
+	var head strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+	return conn, client, br, head.String()
+}
+
+func writeClientFrame(t *testing.T, conn net.Conn, b0 byte, payload []byte, masked bool) {
+	frame := []byte{b0}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, maskBit|byte(len(payload)))
+	default:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+	if masked {
+		key := []byte{0x37, 0xfa, 0x21, 0x3d}
+		frame = append(frame, key...)
+		for i, b := range payload {
+			frame = append(frame, b^key[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := conn.Write(frame)
+	require.NoError(t, err)
+}
+
+func readServerFrame(t *testing.T, br *bufio.Reader) (byte, []byte) {
+	var hdr [2]byte
+	_, err := io.ReadFull(br, hdr[:])
+	require.NoError(t, err)
+	require.Zero(t, hdr[1]&0x80, "server frames must not be masked")
+	n := int(hdr[1] & 0x7f)
+	if n == 126 {
+		var ext [2]byte
+		io.ReadFull(br, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, n)
+	_, err = io.ReadFull(br, payload)
+	require.NoError(t, err)
+	return hdr[0], payload
+}
+
+func TestHandshake(t *testing.T) {
+	// Test: The RFC 6455 example key
+	_, _, _, head := upgrade(t, "Sec-WebSocket-Protocol: mqtt, chat\r\n", &Options{Subprotocols: []string{"chat"}})
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 101 Switching Protocols\r\n"))
+	assert.Contains(t, head, "sec-websocket-accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+	assert.Contains(t, head, "sec-websocket-protocol: chat\r\n")
+	assert.NotContains(t, head, "sec-websocket-extensions")
+
+	// Test: Wrong version asks for 13
+	req, err := request.RequestFromReader(strings.NewReader(strings.Replace(handshake, "Version: 13", "Version: 8", 1) + "\r\n"))
+	require.NoError(t, err)
+	w := response.NewWriter()
+	_, err = Upgrade(w, req, nil)
+	require.ErrorIs(t, err, ERROR_BAD_HANDSHAKE)
+	res := string(w.Bytes())
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 426 Upgrade Required\r\n"))
+	assert.Contains(t, res, "sec-websocket-version: 13\r\n")
+
+	// Test: Missing key
+	req, err = request.RequestFromReader(strings.NewReader(strings.Replace(handshake, "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n", "", 1) + "\r\n"))
+	require.NoError(t, err)
+	w = response.NewWriter()
+	_, err = Upgrade(w, req, nil)
+	require.ErrorIs(t, err, ERROR_BAD_HANDSHAKE)
+	assert.True(t, strings.HasPrefix(string(w.Bytes()), "HTTP/1.1 400 Bad Request\r\n"))
+
+	// Test: Origin check
+	req, err = request.RequestFromReader(strings.NewReader(handshake + "Origin: https://evil.example\r\n\r\n"))
+	require.NoError(t, err)
+	w = response.NewWriter()
+	_, err = Upgrade(w, req, &Options{CheckOrigin: func(r *request.Request) bool {
+		return r.Headers.Get("origin") == "https://good.example"
+	}})
+	require.ErrorIs(t, err, ERROR_ORIGIN_NOT_ALLOWED)
+	assert.True(t, strings.HasPrefix(string(w.Bytes()), "HTTP/1.1 403 Forbidden\r\n"))
+
+	// Test: Without a CheckOrigin, other sites are turned away
+	for _, origin := range []string{"https://evil.example", "http://localhost.evil.example", "null"} {
+		req, err = request.RequestFromReader(strings.NewReader(handshake + "Origin: " + origin + "\r\n\r\n"))
+		require.NoError(t, err)
+		w = response.NewWriter()
+		_, err = Upgrade(w, req, nil)
+		require.ErrorIs(t, err, ERROR_ORIGIN_NOT_ALLOWED, origin)
+		assert.True(t, strings.HasPrefix(string(w.Bytes()), "HTTP/1.1 403 Forbidden\r\n"), origin)
+	}
+
+	// Test: ...but pages from the same host get in
+	_, _, _, head = upgrade(t, "Origin: http://LOCALHOST\r\n", nil)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 101 Switching Protocols\r\n"))
+}
+
+func TestMessages(t *testing.T) {
+	conn, client, br, _ := upgrade(t, "", nil)
+
+	// Test: Fragmented text message with a ping in the middle
+	writeClientFrame(t, client, 0x01, []byte("Hel"), true)
+	writeClientFrame(t, client, 0x89, []byte("are you there"), true)
+	writeClientFrame(t, client, 0x80, []byte("lo"), true)
+	msgType, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, msgType)
+	assert.Equal(t, "Hello", string(data))
+	b0, payload := readServerFrame(t, br)
+	assert.Equal(t, byte(0x8A), b0)
+	assert.Equal(t, "are you there", string(payload))
+
+	// Test: Outgoing fragmentation
+	conn.fragmentSize = 4
+	require.NoError(t, conn.WriteMessage(BinaryMessage, []byte("0123456789")))
+	b0, payload = readServerFrame(t, br)
+	assert.Equal(t, byte(0x02), b0)
+	assert.Equal(t, "0123", string(payload))
+	b0, _ = readServerFrame(t, br)
+	assert.Equal(t, byte(0x00), b0)
+	b0, payload = readServerFrame(t, br)
+	assert.Equal(t, byte(0x80), b0)
+	assert.Equal(t, "89", string(payload))
+
+	// Test: Close handshake started by the client
+	writeClientFrame(t, client, 0x88, append([]byte{0x03, 0xE8}, "bye"...), true)
+	_, _, err = conn.ReadMessage()
+	var closeErr *CloseError
+	require.True(t, errors.As(err, &closeErr))
+	assert.Equal(t, CloseNormal, closeErr.Code)
+	assert.Equal(t, "bye", closeErr.Reason)
+	b0, payload = readServerFrame(t, br)
+	assert.Equal(t, byte(0x88), b0)
+	assert.Equal(t, []byte{0x03, 0xE8}, payload)
+	require.ErrorIs(t, conn.WriteMessage(TextMessage, []byte("late")), ERROR_CLOSED)
+}
+
+func TestBufferedFrames(t *testing.T) {
+	// Test: A frame that arrived along with the handshake isn't lost
+	server, client := tcpPipe(t)
+	req, err := request.RequestFromReader(strings.NewReader(handshake + "\r\n"))
+	require.NoError(t, err)
+	w := response.NewStreamingWriter(server)
+	early := []byte{0x81, 0x82, 0, 0, 0, 0, 'h', 'i'}
+	w.SetHijacker(connHijacker{conn: server, buffered: early})
+	conn, err := Upgrade(w, req, nil)
+	require.NoError(t, err)
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(data))
+	client.Close()
+}
+
+func TestProtocolErrors(t *testing.T) {
+	expectClose := func(t *testing.T, send func(client net.Conn), code CloseCode) {
+		conn, client, br, _ := upgrade(t, "", nil)
+		send(client)
+		_, _, err := conn.ReadMessage()
+		var closeErr *CloseError
+		require.True(t, errors.As(err, &closeErr))
+		assert.Equal(t, code, closeErr.Code)
+		b0, payload := readServerFrame(t, br)
+		assert.Equal(t, byte(0x88), b0)
+		assert.Equal(t, uint16(code), binary.BigEndian.Uint16(payload))
+	}
+
+	// Test: Unmasked client frame
+	expectClose(t, func(c net.Conn) { writeClientFrame(t, c, 0x81, []byte("hi"), false) }, CloseProtocolError)
+
+	// Test: Invalid UTF-8 in a text message
+	expectClose(t, func(c net.Conn) { writeClientFrame(t, c, 0x81, []byte{0xff, 0xfe}, true) }, CloseInvalidPayload)
+
+	// Test: Continuation without a start
+	expectClose(t, func(c net.Conn) { writeClientFrame(t, c, 0x80, []byte("x"), true) }, CloseProtocolError)
+
+	// Test: Fragmented control frame
+	expectClose(t, func(c net.Conn) { writeClientFrame(t, c, 0x09, []byte("x"), true) }, CloseProtocolError)
+
+	// Test: RSV1 without compression negotiated
+	expectClose(t, func(c net.Conn) { writeClientFrame(t, c, 0xC1, []byte("x"), true) }, CloseProtocolError)
+
+	// Test: Close code that can't be sent
+	expectClose(t, func(c net.Conn) { writeClientFrame(t, c, 0x88, []byte{0x03, 0xED}, true) }, CloseProtocolError)
+}
+
+func TestCompression(t *testing.T) {
+	// Test: Offers we can't honour are declined
+	_, ok := negotiateDeflate("permessage-deflate; server_max_window_bits=10")
+	assert.False(t, ok)
+	_, ok = negotiateDeflate("x-webkit-deflate-frame")
+	assert.False(t, ok)
+	_, ok = negotiateDeflate("permessage-deflate; server_max_window_bits=10, permessage-deflate; client_max_window_bits")
+	assert.True(t, ok)
+
+	conn, client, br, head := upgrade(t, "Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n", &Options{EnableCompression: true})
+	assert.Contains(t, head, "sec-websocket-extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n")
+
+	// Test: Compressed message from the client
+	text := strings.Repeat("compress me please ", 20)
+	compressed, err := deflate([]byte(text))
+	require.NoError(t, err)
+	writeClientFrame(t, client, 0xC1, compressed, true)
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, text, string(data))
+
+	// Test: Compressed message to the client
+	require.NoError(t, conn.WriteMessage(TextMessage, []byte(text)))
+	b0, payload := readServerFrame(t, br)
+	assert.Equal(t, byte(0xC1), b0)
+	assert.Less(t, len(payload), len(text))
+	inflated, err := inflate(payload, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, text, string(inflated))
+}